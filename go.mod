@@ -2,4 +2,17 @@ module filestation
 
 go 1.25.1
 
-require golang.org/x/crypto v0.45.0 // indirect
+require (
+	github.com/alecthomas/chroma/v2 v2.27.0
+	github.com/klauspost/compress v1.20.1
+	github.com/ulikunitz/xz v0.5.17
+	github.com/yuin/goldmark v1.8.6
+	golang.org/x/crypto v0.45.0
+	golang.org/x/image v0.44.0
+	rsc.io/qr v0.2.0
+)
+
+require (
+	github.com/dlclark/regexp2/v2 v2.2.1 // indirect
+	golang.org/x/sys v0.38.0 // indirect
+)
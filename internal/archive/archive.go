@@ -0,0 +1,269 @@
+// Package archive lists and extracts the contents of ZIP and tar archives
+// without unpacking them to disk.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ulikunitz/xz"
+)
+
+// Formats
+const (
+	FormatZip   = "zip"
+	FormatTar   = "tar"
+	FormatTarGz = "tar.gz"
+	FormatTarXz = "tar.xz"
+)
+
+// MaxEntries caps a listing so a huge archive can't bloat the metadata
+const MaxEntries = 5000
+
+var ErrNotFound = errors.New("entry not found in archive")
+
+// Entry is one file or directory in an archive.
+type Entry struct {
+	Name     string      `json:"name"` // Slash separated, without leading slash
+	Size     int64       `json:"size"`
+	Mode     fs.FileMode `json:"mode"`
+	Modified time.Time   `json:"modified"`
+	Dir      bool        `json:"dir,omitempty"`
+}
+
+// Listing is the content of an archive.
+type Listing struct {
+	Format    string  `json:"format"`
+	Entries   []Entry `json:"entries"`
+	Files     int     `json:"files"`
+	TotalSize int64   `json:"total_size"` // Uncompressed
+	Truncated bool    `json:"truncated,omitempty"`
+}
+
+// Format returns the archive format of a file called name, or "" if it
+// isn't one this package reads.
+func Format(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return FormatZip
+	case strings.HasSuffix(lower, ".tar"):
+		return FormatTar
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return FormatTarGz
+	case strings.HasSuffix(lower, ".tar.xz"), strings.HasSuffix(lower, ".txz"):
+		return FormatTarXz
+	}
+	return ""
+}
+
+// List reads the entries of the archive in r, which is size bytes long.
+// ZIP files only have their central directory read; tar files are
+// streamed through once.
+func List(r io.ReaderAt, size int64, format string) (*Listing, error) {
+	listing := &Listing{Format: format}
+	add := func(e Entry) bool {
+		if len(listing.Entries) == MaxEntries {
+			listing.Truncated = true
+			return false
+		}
+		listing.Entries = append(listing.Entries, e)
+		if !e.Dir {
+			listing.Files++
+			listing.TotalSize += e.Size
+		}
+		return true
+	}
+
+	if format == FormatZip {
+		zr, err := zip.NewReader(r, size)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zr.File {
+			if !add(zipEntry(f)) {
+				break
+			}
+		}
+	} else {
+		tr, closer, err := openTar(r, size, format)
+		if err != nil {
+			return nil, err
+		}
+		defer closer.Close()
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if e, ok := tarEntry(hdr); ok && !add(e) {
+				break
+			}
+		}
+	}
+
+	sort.Slice(listing.Entries, func(i, j int) bool {
+		return listing.Entries[i].Name < listing.Entries[j].Name
+	})
+	return listing, nil
+}
+
+// Open returns the content of the entry called name in the archive in r,
+// which is size bytes long. r must stay open until the entry is read.
+func Open(r io.ReaderAt, size int64, format, name string) (io.ReadCloser, *Entry, error) {
+	if format == FormatZip {
+		zr, err := zip.NewReader(r, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, f := range zr.File {
+			e := zipEntry(f)
+			if !e.Mode.IsRegular() || e.Name != name {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, nil, err
+			}
+			return rc, &e, nil
+		}
+		return nil, nil, ErrNotFound
+	}
+
+	tr, closer, err := openTar(r, size, format)
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			closer.Close()
+			if err == io.EOF {
+				err = ErrNotFound
+			}
+			return nil, nil, err
+		}
+		if e, ok := tarEntry(hdr); ok && e.Mode.IsRegular() && e.Name == name {
+			return readCloser{tr, closer}, &e, nil
+		}
+	}
+}
+
+func zipEntry(f *zip.File) Entry {
+	return Entry{
+		Name:     cleanName(f.Name),
+		Size:     int64(f.UncompressedSize64),
+		Mode:     f.Mode(),
+		Modified: f.Modified,
+		Dir:      f.FileInfo().IsDir(),
+	}
+}
+
+// tarEntry converts a header, skipping the ones that aren't files or
+// directories such as PAX globals
+func tarEntry(hdr *tar.Header) (Entry, bool) {
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeDir, tar.TypeSymlink, tar.TypeLink:
+	default:
+		return Entry{}, false
+	}
+	return Entry{
+		Name:     cleanName(hdr.Name),
+		Size:     hdr.Size,
+		Mode:     hdr.FileInfo().Mode(),
+		Modified: hdr.ModTime,
+		Dir:      hdr.Typeflag == tar.TypeDir,
+	}, true
+}
+
+// cleanName makes entry names comparable: "./a/b/" becomes "a/b". Names
+// are only ever displayed and matched, never used as paths on disk.
+func cleanName(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = path.Clean("/" + name)
+	return strings.TrimPrefix(name, "/")
+}
+
+func openTar(r io.ReaderAt, size int64, format string) (*tar.Reader, io.Closer, error) {
+	var src io.Reader = io.NewSectionReader(r, 0, size)
+	switch format {
+	case FormatTarGz:
+		gz, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tar.NewReader(gz), gz, nil
+	case FormatTarXz:
+		xr, err := xz.NewReader(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		src = xr
+	}
+	return tar.NewReader(src), io.NopCloser(nil), nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Node is an entry placed in the directory tree, for display.
+type Node struct {
+	Entry
+	Base  string
+	Depth int
+}
+
+// Tree orders entries as a directory tree, adding the directories that
+// archives often leave out.
+func (l *Listing) Tree() []Node {
+	dirs := make(map[string]bool)
+	var entries []Entry
+	for _, e := range l.Entries {
+		if e.Name == "" {
+			continue
+		}
+		if e.Dir {
+			if dirs[e.Name] {
+				continue
+			}
+			dirs[e.Name] = true
+		}
+		entries = append(entries, e)
+		for dir := path.Dir(e.Name); dir != "."; dir = path.Dir(dir) {
+			if !dirs[dir] {
+				dirs[dir] = true
+				entries = append(entries, Entry{Name: dir, Mode: fs.ModeDir | 0755, Dir: true})
+			}
+		}
+	}
+
+	// Sort by path components so a directory's content follows it directly
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := strings.Split(entries[i].Name, "/"), strings.Split(entries[j].Name, "/")
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+
+	nodes := make([]Node, len(entries))
+	for i, e := range entries {
+		nodes[i] = Node{Entry: e, Base: path.Base(e.Name), Depth: strings.Count(e.Name, "/")}
+	}
+	return nodes
+}
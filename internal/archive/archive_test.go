@@ -0,0 +1,237 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+type file struct {
+	name string
+	body string
+}
+
+// build writes files as an archive of format
+func build(t *testing.T, format string, files []file) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if format == FormatZip {
+		zw := zip.NewWriter(&buf)
+		for _, f := range files {
+			w, err := zw.Create(f.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte(f.body))
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	var w io.WriteCloser = nopWriteCloser{&buf}
+	switch format {
+	case FormatTarGz:
+		w = gzip.NewWriter(&buf)
+	case FormatTarXz:
+		xw, err := xz.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = xw
+	}
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.body)), Typeflag: tar.TypeReg}
+		if f.name[len(f.name)-1] == '/' {
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(f.body))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestFormat(t *testing.T) {
+	for name, want := range map[string]string{
+		"a.ZIP":     FormatZip,
+		"a.tar":     FormatTar,
+		"a.tgz":     FormatTarGz,
+		"a.tar.gz":  FormatTarGz,
+		"a.txz":     FormatTarXz,
+		"a.tar.xz":  FormatTarXz,
+		"a.gz":      "",
+		"a.zip.pdf": "",
+		"tar":       "",
+	} {
+		if got := Format(name); got != want {
+			t.Errorf("Format(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+// Entry names climbing out of the archive are listed and matched inside it
+func TestListNames(t *testing.T) {
+	files := []file{
+		{"../../etc/passwd", "root"},
+		{"/etc/shadow", "secret"},
+		{"./docs/../readme.txt", "hello"},
+		{`..\windows\evil.txt`, "evil"},
+		{"docs/", ""},
+	}
+	want := []string{"docs", "etc/passwd", "etc/shadow", "readme.txt", "windows/evil.txt"}
+	for _, format := range []string{FormatZip, FormatTar, FormatTarGz, FormatTarXz} {
+		t.Run(format, func(t *testing.T) {
+			data := build(t, format, files)
+			listing, err := List(bytes.NewReader(data), int64(len(data)), format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, e := range listing.Entries {
+				names = append(names, e.Name)
+			}
+			if !reflect.DeepEqual(names, want) {
+				t.Errorf("names = %q, want %q", names, want)
+			}
+			if listing.Files != 4 || listing.TotalSize != int64(len("rootsecrethelloevil")) {
+				t.Errorf("listed %d files of %d bytes, want 4 of 19", listing.Files, listing.TotalSize)
+			}
+
+			rc, e, err := Open(bytes.NewReader(data), int64(len(data)), format, "etc/passwd")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil || string(body) != "root" || e.Size != 4 {
+				t.Errorf("etc/passwd = %q (%d bytes), %v", body, e.Size, err)
+			}
+		})
+	}
+}
+
+func TestOpenMissing(t *testing.T) {
+	files := []file{{"docs/", ""}, {"docs/a.txt", "a"}}
+	for _, format := range []string{FormatZip, FormatTar, FormatTarGz} {
+		data := build(t, format, files)
+		for _, name := range []string{"b.txt", "docs", "a.txt", ""} {
+			if _, _, err := Open(bytes.NewReader(data), int64(len(data)), format, name); !errors.Is(err, ErrNotFound) {
+				t.Errorf("%s: Open(%q): got %v, want ErrNotFound", format, name, err)
+			}
+		}
+	}
+}
+
+// A truncated tar is an error, not a shorter listing
+func TestTruncatedTar(t *testing.T) {
+	data := build(t, FormatTar, []file{{"a.txt", "a"}, {"b.txt", string(bytes.Repeat([]byte("b"), 4096))}})
+	// a.txt takes two blocks, then b.txt is cut off after its header and
+	// 1000 bytes of its content
+	truncated := data[:1024+512+1000]
+	if _, err := List(bytes.NewReader(truncated), int64(len(truncated)), FormatTar); err == nil {
+		t.Error("List of a truncated tar succeeded")
+	}
+	rc, _, err := Open(bytes.NewReader(truncated), int64(len(truncated)), FormatTar, "b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if _, err := io.ReadAll(rc); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("reading a truncated entry: got %v, want io.ErrUnexpectedEOF", err)
+	}
+
+	gz := build(t, FormatTarGz, []file{{"a.txt", "a"}})
+	if _, err := List(bytes.NewReader(gz[:len(gz)/2]), int64(len(gz)/2), FormatTarGz); err == nil {
+		t.Error("List of a truncated tar.gz succeeded")
+	}
+}
+
+// Declared sizes are only reported; nothing is allocated or read for them
+func TestHugeDeclaredSize(t *testing.T) {
+	const huge = 1 << 50
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateRaw(&zip.FileHeader{Name: "bomb.bin", Method: zip.Store, CompressedSize64: 4, UncompressedSize64: huge})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("tiny"))
+	zw.Close()
+	data := buf.Bytes()
+	listing, err := List(bytes.NewReader(data), int64(len(data)), FormatZip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listing.TotalSize != huge {
+		t.Errorf("TotalSize = %d, want %d", listing.TotalSize, int64(huge))
+	}
+	rc, e, err := Open(bytes.NewReader(data), int64(len(data)), FormatZip, "bomb.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, rc)
+	rc.Close()
+	if err == nil || n > 4 || e.Size != huge {
+		t.Errorf("read %d bytes of an entry declaring %d, err %v", n, e.Size, err)
+	}
+
+	// A tar header claiming more data than follows
+	buf.Reset()
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "bomb.bin", Mode: 0644, Size: huge, Typeflag: tar.TypeReg})
+	tw.Write([]byte("tiny"))
+	data = buf.Bytes()
+	if _, err := List(bytes.NewReader(data), int64(len(data)), FormatTar); err == nil {
+		t.Error("List of a tar with a huge declared size succeeded")
+	}
+}
+
+func TestListCapped(t *testing.T) {
+	files := make([]file, MaxEntries+10)
+	for i := range files {
+		files[i] = file{name: fmt.Sprintf("f%05d.txt", i), body: "x"}
+	}
+	data := build(t, FormatTar, files)
+	listing, err := List(bytes.NewReader(data), int64(len(data)), FormatTar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !listing.Truncated || len(listing.Entries) != MaxEntries {
+		t.Errorf("listed %d entries, truncated %t; want %d, true", len(listing.Entries), listing.Truncated, MaxEntries)
+	}
+}
+
+func TestTree(t *testing.T) {
+	l := &Listing{Entries: []Entry{{Name: "b.txt"}, {Name: "a/c/d.txt"}, {Name: "a/b.txt"}, {Name: "a", Dir: true}}}
+	var got []string
+	for _, n := range l.Tree() {
+		got = append(got, n.Name)
+	}
+	want := []string{"a", "a/b.txt", "a/c", "a/c/d.txt", "b.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Tree = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,289 @@
+// Package audit keeps an append-only, hash-chained record of file and admin
+// actions. Each record stores the hash of the one before it, so editing or
+// removing a line breaks the chain from that point on.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions recorded in the log
+const (
+	ActionUpload         = "upload"
+	ActionDownload       = "download"
+	ActionPasswordFailed = "download_password_failed"
+	ActionDelete         = "delete"
+	ActionLogin          = "login"
+	ActionLoginFailed    = "login_failed"
+	ActionPasswordChange = "password_change"
+	ActionShareCreate    = "share_create"
+	ActionShareRevoke    = "share_revoke"
+	ActionKeyRotate      = "share_key_rotate"
+	ActionRequestCreate  = "upload_request_create"
+	ActionRequestClose   = "upload_request_close"
+	ActionQuarantine     = "quarantine"
+	ActionRateUnblock    = "rate_limit_unblock"
+)
+
+type Record struct {
+	Seq      int64     `json:"seq"`
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Actor    string    `json:"actor"`
+	IP       string    `json:"ip"`
+	File     string    `json:"file,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+	Success  bool      `json:"success"`
+	PrevHash string    `json:"prev_hash"`
+	Hash     string    `json:"hash"`
+}
+
+// computeHash hashes every field except Hash itself.
+func (rec Record) computeHash() string {
+	rec.Hash = ""
+	data, _ := json.Marshal(rec)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+type Log struct {
+	mu       sync.Mutex
+	path     string
+	lastSeq  int64
+	lastHash string
+}
+
+// Open opens or creates the audit log at path and resumes its chain.
+func Open(path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	l := &Log{path: path}
+	if err := l.endLastLine(); err != nil {
+		return nil, err
+	}
+
+	// Malformed lines don't stop the server; Verify reports them
+	records, err := l.readAll()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Seq != 0 {
+			l.lastSeq = records[i].Seq
+			l.lastHash = records[i].Hash
+			break
+		}
+	}
+	return l, nil
+}
+
+// endLastLine makes sure the log ends with a newline so the next record
+// starts a line of its own. A last line cut short by a crash in Append is
+// dropped: Append only moves the chain on once its line is synced, so the
+// record was never part of it.
+func (l *Log) endLastLine() error {
+	data, err := os.ReadFile(l.path)
+	if os.IsNotExist(err) || len(data) == 0 || data[len(data)-1] == '\n' {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	start := bytes.LastIndexByte(data, '\n') + 1
+	var rec Record
+	if json.Unmarshal(data[start:], &rec) == nil {
+		// Only the newline is missing
+		_, err = f.WriteAt([]byte("\n"), int64(len(data)))
+	} else {
+		err = f.Truncate(int64(start))
+	}
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Append adds a record to the log, filling in its sequence number, time
+// and hashes.
+func (l *Log) Append(rec Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec.Seq = l.lastSeq + 1
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	rec.PrevHash = l.lastHash
+	rec.Hash = rec.computeHash()
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	l.lastSeq = rec.Seq
+	l.lastHash = rec.Hash
+	return nil
+}
+
+func (l *Log) readAll() ([]Record, error) {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// A line that can't be parsed is kept as a record with no sequence
+	// number, which breaks the chain where it is
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			rec = Record{}
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// Verify walks the chain and returns the sequence number of the first
+// record that does not match, or 0 if the log is intact.
+func (l *Log) Verify() (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	records, err := l.readAll()
+	if err != nil {
+		return 0, err
+	}
+
+	prev := ""
+	for i, rec := range records {
+		if rec.Seq != int64(i+1) || rec.PrevHash != prev || rec.Hash != rec.computeHash() {
+			if rec.Seq == 0 {
+				return int64(i + 1), nil
+			}
+			return rec.Seq, nil
+		}
+		prev = rec.Hash
+	}
+	return 0, nil
+}
+
+type Filter struct {
+	Action string
+	Query  string // matched against IP, file and detail
+	From   time.Time
+	To     time.Time
+}
+
+func (f Filter) match(rec Record) bool {
+	if f.Action != "" && rec.Action != f.Action {
+		return false
+	}
+	if !f.From.IsZero() && rec.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !rec.Time.Before(f.To) {
+		return false
+	}
+	if f.Query != "" {
+		q := strings.ToLower(f.Query)
+		if !strings.Contains(strings.ToLower(rec.IP), q) &&
+			!strings.Contains(strings.ToLower(rec.File), q) &&
+			!strings.Contains(strings.ToLower(rec.Detail), q) {
+			return false
+		}
+	}
+	return true
+}
+
+// Query returns matching records, newest first.
+func (l *Log) Query(filter Filter) ([]Record, error) {
+	l.mu.Lock()
+	records, err := l.readAll()
+	l.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Record
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Seq != 0 && filter.match(records[i]) {
+			result = append(result, records[i])
+		}
+	}
+	return result, nil
+}
+
+// WriteJSON exports records as a JSON array.
+func WriteJSON(w io.Writer, records []Record) error {
+	if records == nil {
+		records = []Record{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(records)
+}
+
+// WriteCSV exports records with a header row.
+func WriteCSV(w io.Writer, records []Record) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"seq", "time", "action", "actor", "ip", "file", "detail", "success", "prev_hash", "hash"})
+	for _, rec := range records {
+		cw.Write([]string{
+			strconv.FormatInt(rec.Seq, 10),
+			rec.Time.Format(time.RFC3339),
+			rec.Action,
+			rec.Actor,
+			rec.IP,
+			rec.File,
+			rec.Detail,
+			strconv.FormatBool(rec.Success),
+			rec.PrevHash,
+			rec.Hash,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
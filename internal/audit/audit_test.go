@@ -0,0 +1,72 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func appendRecords(t *testing.T, l *Log, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := l.Append(Record{Action: ActionUpload, Success: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// A record cut short by a crash is dropped and the chain carries on
+func TestOpenTruncatedLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, l, 2)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":3,"time":"2026-`)
+	f.Close()
+
+	if l, err = Open(path); err != nil {
+		t.Fatalf("Open with a truncated last line: %v", err)
+	}
+	appendRecords(t, l, 1)
+	if brokenAt, err := l.Verify(); brokenAt != 0 || err != nil {
+		t.Errorf("Verify = %d, %v, want an intact log", brokenAt, err)
+	}
+	if records, err := l.Query(Filter{}); len(records) != 3 || err != nil || records[0].Seq != 3 {
+		t.Errorf("Query = %d records, %v", len(records), err)
+	}
+}
+
+// A malformed line in the middle doesn't stop the log from opening, but
+// Verify reports it
+func TestOpenMalformedLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, l, 1)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("not a record\n")
+	f.Close()
+	appendRecords(t, l, 1)
+
+	if l, err = Open(path); err != nil {
+		t.Fatalf("Open with a malformed line: %v", err)
+	}
+	appendRecords(t, l, 1)
+	if brokenAt, err := l.Verify(); brokenAt != 2 || err != nil {
+		t.Errorf("Verify = %d, %v, want the chain broken at 2", brokenAt, err)
+	}
+	if records, err := l.Query(Filter{}); len(records) != 3 || err != nil || records[0].Seq != 3 {
+		t.Errorf("Query = %d records, %v", len(records), err)
+	}
+}
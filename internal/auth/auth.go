@@ -1,11 +1,15 @@
 package auth
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"fmt"
 	"net/http"
+	"net/netip"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 
@@ -13,24 +17,26 @@ import (
 )
 
 type AuthManager struct {
-	mu              sync.RWMutex
-	passwordHash    string
-	sessions        map[string]time.Time
-	csrfTokens      map[string]time.Time
-	loginAttempts   map[string][]time.Time // IP -> attempts
-	lastCleanup     time.Time
+	mu            sync.RWMutex
+	passwordHash  string
+	sessions      map[string]time.Time
+	csrfTokens    map[string]time.Time
+	loginAttempts map[string][]time.Time // IP -> attempts
+	lastCleanup   time.Time
+	failedLogins  atomic.Uint64
 }
 
 const (
-	sessionDuration    = 24 * time.Hour
-	csrfTokenDuration  = 2 * time.Hour
-	maxLoginAttempts   = 5
-	loginWindow        = 15 * time.Minute
-	cleanupInterval    = 1 * time.Hour
-	minPasswordLength  = 8
+	sessionDuration   = 24 * time.Hour
+	csrfTokenDuration = 2 * time.Hour
+	maxLoginAttempts  = 5
+	loginWindow       = 15 * time.Minute
+	cleanupInterval   = 1 * time.Hour
+	minPasswordLength = 8
 )
 
-func New() *AuthManager {
+// New creates an AuthManager whose background cleanup stops when ctx is done.
+func New(ctx context.Context) *AuthManager {
 	am := &AuthManager{
 		passwordHash:  "",
 		sessions:      make(map[string]time.Time),
@@ -41,10 +47,10 @@ func New() *AuthManager {
 	// Default password: admin123
 	hash, _ := bcrypt.GenerateFromPassword([]byte("admin123"), bcrypt.DefaultCost)
 	am.passwordHash = string(hash)
-	
+
 	// Start cleanup goroutine
-	go am.cleanupRoutine()
-	
+	go am.cleanupRoutine(ctx)
+
 	return am
 }
 
@@ -109,10 +115,10 @@ func (am *AuthManager) ChangePassword(oldPassword, newPassword string) (bool, st
 		return false, "密码加密失败"
 	}
 	am.passwordHash = string(hash)
-	
+
 	// Invalidate all sessions (force re-login)
 	am.sessions = make(map[string]time.Time)
-	
+
 	return true, ""
 }
 
@@ -121,7 +127,7 @@ func (am *AuthManager) validatePassword(password string) error {
 		return &PasswordError{Message: "密码长度至少8位"}
 	}
 
-	var hasUpper, hasLower, hasNumber, hasSpecial bool
+	var hasUpper, hasLower, hasNumber bool
 	for _, char := range password {
 		switch {
 		case unicode.IsUpper(char):
@@ -130,8 +136,6 @@ func (am *AuthManager) validatePassword(password string) error {
 			hasLower = true
 		case unicode.IsNumber(char):
 			hasNumber = true
-		case unicode.IsPunct(char) || unicode.IsSymbol(char):
-			hasSpecial = true
 		}
 	}
 
@@ -188,15 +192,27 @@ func (am *AuthManager) isRateLimited(ip string) bool {
 }
 
 func (am *AuthManager) recordFailedAttempt(ip string) {
+	am.failedLogins.Add(1)
 	attempts := am.loginAttempts[ip]
 	attempts = append(attempts, time.Now())
 	am.loginAttempts[ip] = attempts
 }
 
-func (am *AuthManager) cleanupRoutine() {
+// FailedLogins returns the number of failed admin logins since start.
+func (am *AuthManager) FailedLogins() uint64 {
+	return am.failedLogins.Load()
+}
+
+func (am *AuthManager) cleanupRoutine(ctx context.Context) {
 	ticker := time.NewTicker(cleanupInterval)
-	for range ticker.C {
-		am.cleanup()
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			am.cleanup()
+		}
 	}
 }
 
@@ -246,10 +262,34 @@ func (am *AuthManager) CheckPassword(hash, password string) bool {
 	return err == nil
 }
 
+// CheckLimitedPassword checks a password other than the admin's, such as
+// that of an upload request, under the same failure limit as logins. It
+// reports limited without checking once ip has failed too often.
+func (am *AuthManager) CheckLimitedPassword(hash, password, ip string) (ok, limited bool) {
+	am.mu.Lock()
+	limited = am.isRateLimited(ip)
+	am.mu.Unlock()
+	if limited {
+		return false, true
+	}
+	if am.CheckPassword(hash, password) {
+		return true, false
+	}
+	am.mu.Lock()
+	am.loginAttempts[ip] = append(am.loginAttempts[ip], time.Now())
+	am.mu.Unlock()
+	return false, false
+}
+
+// IsAdmin reports whether the request carries a valid admin session.
+func (am *AuthManager) IsAdmin(r *http.Request) bool {
+	cookie, err := r.Cookie("session_token")
+	return err == nil && am.VerifySession(cookie.Value)
+}
+
 func (am *AuthManager) Middleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("session_token")
-		if err != nil || !am.VerifySession(cookie.Value) {
+		if !am.IsAdmin(r) {
 			http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
 			return
 		}
@@ -284,26 +324,91 @@ func generateToken() string {
 	return base64.URLEncoding.EncodeToString(b)
 }
 
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header first
-	xff := r.Header.Get("X-Forwarded-For")
-	if xff != "" {
-		ips := strings.Split(xff, ",")
-		return strings.TrimSpace(ips[0])
+// trustedProxies are the networks whose forwarding headers ClientIP
+// believes. Without any the headers are ignored.
+var trustedProxies []netip.Prefix
+
+// TrustProxies makes ClientIP honour X-Forwarded-For and X-Real-IP, and
+// Scheme X-Forwarded-Proto, on requests from the given addresses or CIDR
+// networks, the reverse proxies in front of the server. Call it before
+// serving.
+func TrustProxies(list []string) error {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(s)
+			if addrErr != nil {
+				return fmt.Errorf("invalid trusted proxy %q", s)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
 	}
+	trustedProxies = prefixes
+	return nil
+}
 
-	// Check X-Real-IP header
-	realIP := r.Header.Get("X-Real-IP")
-	if realIP != "" {
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that made the request. The
+// X-Forwarded-For and X-Real-IP headers, which any client can send, are
+// only honoured on requests from a trusted proxy.
+func ClientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+
+	// Each proxy appends the address it got the request from, so the
+	// client is the nearest address that isn't a proxy of ours
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hop := strings.TrimSpace(hops[i]); hop != "" && !isTrustedProxy(hop) {
+			return hop
+		}
+	}
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
 		return realIP
 	}
+	return ip
+}
 
-	// Fall back to RemoteAddr
+// Scheme returns "https" or "http", whichever the client used. Like the
+// headers ClientIP reads, X-Forwarded-Proto is only honoured on requests
+// from a trusted proxy.
+func Scheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if isTrustedProxy(remoteIP(r)) {
+		// The first proxy's view is the one the client saw
+		proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+		if strings.EqualFold(strings.TrimSpace(proto), "https") {
+			return "https"
+		}
+	}
+	return "http"
+}
+
+func remoteIP(r *http.Request) string {
 	ip := r.RemoteAddr
 	if idx := strings.LastIndex(ip, ":"); idx != -1 {
 		ip = ip[:idx]
 	}
-	return ip
+	return strings.Trim(ip, "[]")
 }
 
 type PasswordError struct {
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name, remote, xff, want string
+		proxies                 []string
+	}{
+		{"direct", "203.0.113.7:4321", "", "203.0.113.7", nil},
+		{"forged header", "203.0.113.7:4321", "10.9.8.7", "203.0.113.7", nil},
+		{"ipv6", "[2001:db8::1]:4321", "", "2001:db8::1", nil},
+		{"untrusted proxy", "203.0.113.7:4321", "10.9.8.7", "203.0.113.7", []string{"127.0.0.1"}},
+		{"trusted proxy", "127.0.0.1:4321", "198.51.100.2", "198.51.100.2", []string{"127.0.0.1"}},
+		// A client can prepend anything; only the hops our proxies added count
+		{"proxy chain", "10.0.0.5:4321", "1.2.3.4, 198.51.100.2, 10.0.0.9", "198.51.100.2", []string{"10.0.0.0/8"}},
+		{"no header", "127.0.0.1:4321", "", "127.0.0.1", []string{"127.0.0.1"}},
+	}
+	defer TrustProxies(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := TrustProxies(tt.proxies); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if got := ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheme(t *testing.T) {
+	tests := []struct {
+		name   string
+		remote string
+		proto  string
+		want   string
+	}{
+		{"untrusted client", "203.0.113.7:4321", "https", "http"},
+		{"trusted proxy", "10.0.0.5:4321", "https", "https"},
+		{"proxy chain", "10.0.0.5:4321", "HTTPS, http", "https"},
+		{"plain proxy", "10.0.0.5:4321", "http", "http"},
+		{"no header", "10.0.0.5:4321", "", "http"},
+	}
+	if err := TrustProxies([]string{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	defer TrustProxies(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			if got := Scheme(r); got != tt.want {
+				t.Errorf("Scheme = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
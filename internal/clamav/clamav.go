@@ -0,0 +1,173 @@
+// Package clamav scans files with a clamd daemon using its INSTREAM
+// command, over TCP or a unix socket.
+package clamav
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// chunkSize is how much data goes into one INSTREAM chunk
+const chunkSize = 64 << 10
+
+// Result is the verdict on one file.
+type Result struct {
+	Infected  bool
+	Signature string // Name of the matched signature when infected
+}
+
+type Scanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// New returns a scanner for the clamd at addr, which is either
+// "tcp://host:port", "unix:///path/to/clamd.sock", a bare "host:port" or
+// a bare socket path. A scan fails if it takes longer than timeout.
+func New(addr string, timeout time.Duration) (*Scanner, error) {
+	s := &Scanner{timeout: timeout}
+	switch {
+	case strings.HasPrefix(addr, "tcp://"):
+		s.network, s.address = "tcp", strings.TrimPrefix(addr, "tcp://")
+	case strings.HasPrefix(addr, "unix://"):
+		s.network, s.address = "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "/"):
+		s.network, s.address = "unix", addr
+	default:
+		s.network, s.address = "tcp", addr
+	}
+	if s.address == "" {
+		return nil, fmt.Errorf("invalid clamd address %q", addr)
+	}
+	if s.network == "tcp" {
+		if _, _, err := net.SplitHostPort(s.address); err != nil {
+			return nil, fmt.Errorf("invalid clamd address %q: %w", addr, err)
+		}
+	}
+	return s, nil
+}
+
+// Address returns where clamd is reached, for logging.
+func (s *Scanner) Address() string {
+	return s.network + "://" + s.address
+}
+
+// Ping checks that clamd is reachable and answering.
+func (s *Scanner) Ping(ctx context.Context) error {
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+		return err
+	}
+	reply, err := readReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected reply to PING: %q", reply)
+	}
+	return nil
+}
+
+// Scan streams r to clamd and returns its verdict. An error means the file
+// could not be scanned, for example because it exceeds clamd's
+// StreamMaxLength.
+func (s *Scanner) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriterSize(conn, chunkSize+4)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return Result{}, err
+	}
+	buf := make([]byte, chunkSize)
+	var size [4]byte
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			w.Write(size[:])
+			if _, err := w.Write(buf[:n]); err != nil {
+				// clamd hangs up once the stream is over its size limit;
+				// its reply says so
+				return Result{}, replyError(conn, err)
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return Result{}, readErr
+		}
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	w.Write(size[:])
+	if err := w.Flush(); err != nil {
+		return Result{}, replyError(conn, err)
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		return Result{}, err
+	}
+	return parseReply(reply)
+}
+
+func (s *Scanner) dial(ctx context.Context) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(s.timeout))
+	return conn, nil
+}
+
+// readReply reads one NUL terminated reply
+func readReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && (err != io.EOF || reply == "") {
+		return "", err
+	}
+	return strings.TrimRight(reply, "\x00\n"), nil
+}
+
+// replyError prefers clamd's explanation over the write error it caused
+func replyError(conn net.Conn, writeErr error) error {
+	if reply, err := readReply(conn); err == nil && reply != "" {
+		return errors.New(reply)
+	}
+	return writeErr
+}
+
+// parseReply reads replies such as "stream: OK" and
+// "stream: Eicar-Signature FOUND"
+func parseReply(reply string) (Result, error) {
+	_, verdict, ok := strings.Cut(reply, ": ")
+	if !ok {
+		return Result{}, errors.New(reply)
+	}
+	switch {
+	case verdict == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	}
+	return Result{}, errors.New(reply)
+}
@@ -0,0 +1,166 @@
+package clamav
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd answers INSTREAM like clamd: streams containing "EICAR" are
+// infected and streams over limit bytes are refused
+func fakeClamd(t *testing.T, network, address string, limit int) string {
+	t.Helper()
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFake(conn, limit)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveFake(conn net.Conn, limit int) {
+	defer conn.Close()
+	cmd := make([]byte, len("zINSTREAM\x00"))
+	if _, err := io.ReadFull(conn, cmd[:len("zPING\x00")]); err != nil {
+		return
+	}
+	if string(cmd[:len("zPING\x00")]) == "zPING\x00" {
+		conn.Write([]byte("PONG\x00"))
+		return
+	}
+	if _, err := io.ReadFull(conn, cmd[len("zPING\x00"):]); err != nil || string(cmd) != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+
+	var data bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if data.Len()+int(size) > limit {
+			conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+			return
+		}
+		if _, err := io.CopyN(&data, conn, int64(size)); err != nil {
+			return
+		}
+	}
+	if bytes.Contains(data.Bytes(), []byte("EICAR")) {
+		conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+		return
+	}
+	conn.Write([]byte("stream: OK\x00"))
+}
+
+func TestScan(t *testing.T) {
+	addr := fakeClamd(t, "tcp", "127.0.0.1:0", 1<<20)
+	s, err := New(addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		data      string
+		infected  bool
+		signature string
+		wantErr   bool
+	}{
+		{"empty", "", false, "", false},
+		{"clean", "hello world", false, "", false},
+		{"infected", "X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*", true, "Eicar-Test-Signature", false},
+		{"infected in a later chunk", strings.Repeat("a", 3*chunkSize) + "EICAR", true, "Eicar-Test-Signature", false},
+		{"over the size limit", strings.Repeat("a", 2<<20), false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := s.Scan(context.Background(), strings.NewReader(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Scan() error = %v, want error %t", err, tt.wantErr)
+			}
+			if result.Infected != tt.infected || result.Signature != tt.signature {
+				t.Errorf("Scan() = %+v, want infected %t signature %q", result, tt.infected, tt.signature)
+			}
+		})
+	}
+}
+
+func TestScanUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clamd.sock")
+	fakeClamd(t, "unix", path, 1<<20)
+	s, err := New("unix://"+path, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+	result, err := s.Scan(context.Background(), strings.NewReader("EICAR"))
+	if err != nil || !result.Infected {
+		t.Fatalf("Scan() = %+v, %v, want infected", result, err)
+	}
+}
+
+func TestScanUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s, err := New("tcp://"+addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Scan(context.Background(), strings.NewReader("data")); err == nil {
+		t.Fatal("Scan() of an unreachable clamd succeeded")
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		addr    string
+		network string
+		address string
+		wantErr bool
+	}{
+		{"tcp://localhost:3310", "tcp", "localhost:3310", false},
+		{"localhost:3310", "tcp", "localhost:3310", false},
+		{"unix:///run/clamd.sock", "unix", "/run/clamd.sock", false},
+		{"/run/clamd.sock", "unix", "/run/clamd.sock", false},
+		{"localhost", "", "", true},
+		{"unix://", "", "", true},
+	}
+	for _, tt := range tests {
+		s, err := New(tt.addr, time.Second)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("New(%q) error = %v, want error %t", tt.addr, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (s.network != tt.network || s.address != tt.address) {
+			t.Errorf("New(%q) = %s %s, want %s %s", tt.addr, s.network, s.address, tt.network, tt.address)
+		}
+	}
+}
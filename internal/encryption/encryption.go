@@ -0,0 +1,453 @@
+// Package encryption encrypts stored files at rest.
+//
+// Every file gets its own random data key. The body is split into chunks
+// sealed with AES-256-GCM, so any byte range can be decrypted without
+// reading what comes before it. The data key is wrapped by a master key
+// and kept in a fixed size header in front of the chunks, so changing the
+// master key only rewrites headers:
+//
+//	magic (8) | key ID (8) | nonce (12) | wrapped data key (32+16) | chunks...
+//
+// Files protected by a download password have their data key wrapped by a
+// key derived from the password instead, so the server can only read them
+// while someone who knows the password is asking.
+//
+// Chunk i is sealed with the nonce i (8 bytes, big endian) followed by 1
+// for the last chunk and 0 otherwise, which makes truncating or reordering
+// chunks fail authentication. A file always has at least one chunk.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	KeySize    = 32
+	HeaderSize = len(magic) + idSize + nonceSize + KeySize + tagSize
+
+	magic     = "FSENC\x00\x00\x01"
+	idSize    = 8
+	nonceSize = 12
+	tagSize   = 16
+	// chunkSize is the plaintext size of every chunk but the last
+	chunkSize = 64 << 10
+)
+
+var (
+	ErrWrongKey = errors.New("file was encrypted with a different master key")
+	ErrCorrupt  = errors.New("encrypted file is corrupt or was tampered with")
+
+	errClosed = errors.New("encryption: write after close")
+)
+
+// Key wraps data keys. It is either the master key or derived from the
+// password of a file.
+type Key struct {
+	id   [idSize]byte
+	aead cipher.AEAD
+}
+
+// ParseKey reads a 32 byte master key given as hex, base64 or raw bytes.
+func ParseKey(data []byte) (*Key, error) {
+	text := strings.TrimSpace(string(data))
+	var raw []byte
+	if b, err := hex.DecodeString(text); err == nil && len(b) == KeySize {
+		raw = b
+	} else if b, err := base64.StdEncoding.DecodeString(text); err == nil && len(b) == KeySize {
+		raw = b
+	} else if len(data) == KeySize {
+		raw = data
+	} else {
+		return nil, fmt.Errorf("master key must be %d bytes, hex or base64 encoded", KeySize)
+	}
+	return newKey(raw)
+}
+
+func newKey(raw []byte) (*Key, error) {
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return nil, err
+	}
+	k := &Key{aead: aead}
+	sum := sha256.Sum256(append([]byte("filestation master key id\x00"), raw...))
+	copy(k.id[:], sum[:])
+	return k, nil
+}
+
+// LoadKey reads a master key from a file.
+func LoadKey(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k, err := ParseKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return k, nil
+}
+
+// KDF derives a key from a password with Argon2id. It is stored with the
+// file it protects; keeping the parameters lets later versions raise them
+// without breaking older files.
+type KDF struct {
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"` // KiB
+	Threads uint8  `json:"threads"`
+}
+
+// NewKDF returns a KDF with a fresh salt and the parameters RFC 9106
+// recommends for memory constrained servers.
+func NewKDF() *KDF {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	return &KDF{Salt: salt, Time: 3, Memory: 64 << 10, Threads: 4}
+}
+
+// Key derives the key for password. A wrong password gives a key that
+// fails with ErrWrongKey.
+func (k *KDF) Key(password string) (*Key, error) {
+	if len(k.Salt) < 16 || k.Time == 0 || k.Memory == 0 || k.Threads == 0 {
+		return nil, errors.New("invalid key derivation parameters")
+	}
+	return newKey(argon2.IDKey([]byte(password), k.Salt, k.Time, k.Memory, k.Threads, KeySize))
+}
+
+// ID identifies the key without revealing it, for logs.
+func (k *Key) ID() string {
+	return hex.EncodeToString(k.id[:])
+}
+
+// IsEncrypted reports whether data starting with head is in this package's
+// format.
+func IsEncrypted(head []byte) bool {
+	return bytes.HasPrefix(head, []byte(magic))
+}
+
+// PlaintextSize returns the size of the content of an encrypted file of
+// size bytes.
+func PlaintextSize(size int64) int64 {
+	body := size - int64(HeaderSize)
+	if body < tagSize {
+		return 0
+	}
+	chunks := (body + chunkSize + tagSize - 1) / (chunkSize + tagSize)
+	return body - chunks*tagSize
+}
+
+// Rewrap re-encrypts the data key in header, the first HeaderSize bytes of
+// an encrypted file, from old to new. Headers already using new are
+// returned unchanged.
+func Rewrap(header []byte, old, new *Key) ([]byte, error) {
+	if len(header) < HeaderSize || !IsEncrypted(header) {
+		return nil, ErrCorrupt
+	}
+	if bytes.Equal(header[len(magic):len(magic)+idSize], new.id[:]) {
+		return header[:HeaderSize], nil
+	}
+	dataKey, err := unwrap(header, old)
+	if err != nil {
+		return nil, err
+	}
+	return wrap(dataKey, new)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrap builds a header holding dataKey sealed with master
+func wrap(dataKey []byte, master *Key) ([]byte, error) {
+	header := make([]byte, 0, HeaderSize)
+	header = append(header, magic...)
+	header = append(header, master.id[:]...)
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+	return master.aead.Seal(header, nonce, dataKey, master.id[:]), nil
+}
+
+// unwrap returns the data key in header
+func unwrap(header []byte, master *Key) ([]byte, error) {
+	id := header[len(magic) : len(magic)+idSize]
+	if !bytes.Equal(id, master.id[:]) {
+		return nil, ErrWrongKey
+	}
+	nonce := header[len(magic)+idSize : len(magic)+idSize+nonceSize]
+	dataKey, err := master.aead.Open(nil, nonce, header[len(magic)+idSize+nonceSize:HeaderSize], id)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return dataKey, nil
+}
+
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[nonceSize-1] = 1
+	}
+	return nonce
+}
+
+// Writer encrypts what is written to it.
+type Writer struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	out   []byte
+	index int64
+	err   error
+}
+
+// NewWriter writes the header of a new encrypted file to w, with a fresh
+// data key wrapped by master, and returns a writer for its content. Close
+// must be called to write the last chunk.
+func NewWriter(w io.Writer, master *Key) (*Writer, error) {
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	header, err := wrap(dataKey, master)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, chunkSize),
+		out:  make([]byte, 0, chunkSize+tagSize),
+	}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 && w.err == nil {
+		// A full chunk is only sealed once more data arrives, since the
+		// last one is sealed differently
+		if len(w.buf) == chunkSize {
+			w.flush(false)
+			continue
+		}
+		n := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, w.err
+}
+
+// Close seals the last chunk. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.flush(true)
+	if w.err != nil {
+		return w.err
+	}
+	w.err = errClosed
+	return nil
+}
+
+func (w *Writer) flush(last bool) {
+	w.out = w.aead.Seal(w.out[:0], chunkNonce(w.index, last), w.buf, nil)
+	_, w.err = w.w.Write(w.out)
+	w.buf = w.buf[:0]
+	w.index++
+}
+
+// Reader decrypts an encrypted file. It supports seeking and concurrent
+// ReadAt calls, so files can be served with http.ServeContent.
+type Reader struct {
+	r      io.ReaderAt
+	aead   cipher.AEAD
+	size   int64 // Plaintext
+	chunks int64
+	end    int64 // Ciphertext size
+	pos    int64
+
+	// The most recently decrypted chunk, for sequential reads
+	cached int64
+	plain  []byte
+	cipher []byte
+}
+
+// NewReader returns a reader for the encrypted file in r, which is size
+// bytes long.
+func NewReader(r io.ReaderAt, size int64, master *Key) (*Reader, error) {
+	if size < int64(HeaderSize)+tagSize {
+		return nil, ErrCorrupt
+	}
+	header := make([]byte, HeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if !IsEncrypted(header) {
+		return nil, ErrCorrupt
+	}
+	dataKey, err := unwrap(header, master)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	plainSize := PlaintextSize(size)
+	reader := &Reader{
+		r:      r,
+		aead:   aead,
+		size:   plainSize,
+		chunks: (size - int64(HeaderSize) + chunkSize + tagSize - 1) / (chunkSize + tagSize),
+		end:    size,
+		cached: -1,
+	}
+	// Reads of an empty file never open a chunk, so check now that its
+	// only chunk is an empty last one rather than what is left of a
+	// truncated file
+	if plainSize == 0 {
+		if _, _, err := reader.decrypt(0, nil, nil); err != nil {
+			return nil, err
+		}
+	}
+	return reader, nil
+}
+
+// Size returns the size of the decrypted content.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.readAt(p, r.pos, true)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("encryption: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("encryption: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// ReadAt decrypts the chunks covering p without touching the read
+// position or the chunk cache.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	return r.readAt(p, off, false)
+}
+
+func (r *Reader) readAt(p []byte, off int64, cache bool) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	var plain, ciphertext []byte
+	read := 0
+	for read < len(p) && off < r.size {
+		index := off / chunkSize
+		var chunk []byte
+		if cache && index == r.cached {
+			chunk = r.plain
+		} else {
+			if cache {
+				plain, ciphertext, r.cached = r.plain, r.cipher, -1
+			}
+			var err error
+			if chunk, ciphertext, err = r.decrypt(index, plain[:0], ciphertext); err != nil {
+				return read, err
+			}
+			plain = chunk
+			if cache {
+				r.cached, r.plain, r.cipher = index, chunk, ciphertext
+			}
+		}
+		n := copy(p[read:], chunk[off-index*chunkSize:])
+		read += n
+		off += int64(n)
+	}
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// decrypt reads and opens chunk index, reusing the given buffers
+func (r *Reader) decrypt(index int64, plain, ciphertext []byte) ([]byte, []byte, error) {
+	start := int64(HeaderSize) + index*(chunkSize+tagSize)
+	length := min(chunkSize+tagSize, r.end-start)
+	if cap(ciphertext) < int(length) {
+		ciphertext = make([]byte, chunkSize+tagSize)
+	}
+	ciphertext = ciphertext[:length]
+	if _, err := r.r.ReadAt(ciphertext, start); err != nil && err != io.EOF {
+		return nil, ciphertext, err
+	}
+	plain, err := r.aead.Open(plain, chunkNonce(index, index == r.chunks-1), ciphertext, nil)
+	if err != nil {
+		return nil, ciphertext, ErrCorrupt
+	}
+	return plain, ciphertext, nil
+}
+
+// Seal encrypts a small piece of data, such as a metadata sidecar, in the
+// same format as files.
+func Seal(master *Key, data []byte) ([]byte, error) {
+	var out bytes.Buffer
+	w, err := NewWriter(&out, master)
+	if err != nil {
+		return nil, err
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Open decrypts data made by Seal.
+func Open(master *Key, data []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(data), int64(len(data)), master)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
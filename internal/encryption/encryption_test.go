@@ -0,0 +1,157 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func testKey(t *testing.T, hex string) *Key {
+	t.Helper()
+	key, err := ParseKey([]byte(strings.Repeat(hex, KeySize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func seal(t *testing.T, key *Key, data []byte) []byte {
+	t.Helper()
+	sealed, err := Seal(key, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := testKey(t, "01")
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 100} {
+		data := randomBytes(size)
+		sealed := seal(t, key, data)
+		if got := PlaintextSize(int64(len(sealed))); got != int64(size) {
+			t.Errorf("size %d: PlaintextSize = %d", size, got)
+		}
+		got, err := Open(key, sealed)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("size %d: Open = %d bytes, %v", size, len(got), err)
+		}
+	}
+
+	// Writes of any size give the same content
+	data := randomBytes(2*chunkSize + 7)
+	var out bytes.Buffer
+	w, err := NewWriter(&out, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rest := data; len(rest) > 0; {
+		n := min(len(rest), 1000)
+		w.Write(rest[:n])
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Open(key, out.Bytes()); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("small writes: Open = %d bytes, %v", len(got), err)
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	key := testKey(t, "01")
+	data := randomBytes(3*chunkSize + 100)
+	sealed := seal(t, key, data)
+	r, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != int64(len(data)) {
+		t.Fatalf("Size = %d, want %d", r.Size(), len(data))
+	}
+	for _, tt := range []struct{ off, n int }{
+		{0, 10},
+		{chunkSize - 5, 10},    // Across a chunk boundary
+		{chunkSize, chunkSize}, // A whole chunk
+		{10, 2*chunkSize + 50}, // Several chunks
+		{len(data) - 30, 30},   // The end of the last chunk
+	} {
+		p := make([]byte, tt.n)
+		if n, err := r.ReadAt(p, int64(tt.off)); err != nil || n != tt.n || !bytes.Equal(p, data[tt.off:tt.off+tt.n]) {
+			t.Errorf("ReadAt(%d, %d) = %d, %v", tt.off, tt.n, n, err)
+		}
+	}
+	p := make([]byte, 50)
+	if n, err := r.ReadAt(p, int64(len(data)-20)); n != 20 || err != io.EOF {
+		t.Errorf("ReadAt past the end = %d, %v, want 20, EOF", n, err)
+	}
+
+	// Seeking doesn't disturb sequential reads
+	if _, err := r.Seek(chunkSize+1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(rest, data[chunkSize+1:]) {
+		t.Errorf("read after Seek = %d bytes, %v", len(rest), err)
+	}
+}
+
+func TestTampering(t *testing.T) {
+	key := testKey(t, "01")
+	data := randomBytes(2*chunkSize + 100)
+	sealed := seal(t, key, data)
+
+	if _, err := Open(testKey(t, "02"), sealed); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("wrong key: got %v, want ErrWrongKey", err)
+	}
+	// Dropping whole chunks leaves a valid-looking file whose last chunk
+	// wasn't sealed as the last one
+	for _, size := range []int{len(sealed) - 1, HeaderSize + chunkSize + tagSize, HeaderSize + tagSize} {
+		if _, err := Open(key, sealed[:size]); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("truncated to %d bytes: got %v, want ErrCorrupt", size, err)
+		}
+	}
+	flipped := bytes.Clone(sealed)
+	flipped[HeaderSize+chunkSize+tagSize+10] ^= 1
+	if _, err := Open(key, flipped); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("flipped bit: got %v, want ErrCorrupt", err)
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	old, new := testKey(t, "01"), testKey(t, "02")
+	data := randomBytes(chunkSize + 1)
+	sealed := seal(t, old, data)
+
+	header, err := Rewrap(sealed, old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrapped := append(header, sealed[HeaderSize:]...)
+	if got, err := Open(new, rewrapped); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Open with the new key = %d bytes, %v", len(got), err)
+	}
+	if _, err := Open(old, rewrapped); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Open with the old key: got %v, want ErrWrongKey", err)
+	}
+
+	// Headers already using the new key are left as they are
+	if again, err := Rewrap(rewrapped, old, new); err != nil || !bytes.Equal(again, header) {
+		t.Errorf("rewrapping twice = %v, want the same header", err)
+	}
+	if _, err := Rewrap(sealed, testKey(t, "03"), new); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("rewrapping from the wrong key: got %v, want ErrWrongKey", err)
+	}
+	if _, err := Rewrap([]byte("not encrypted"), old, new); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("rewrapping a plain file: got %v, want ErrCorrupt", err)
+	}
+}
@@ -0,0 +1,201 @@
+package fileops
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressedMagic starts the content of a file stored compressed. The zstd
+// stream follows, and the file ends with its size before compression as
+// a big endian uint64, which is only known once the upload is complete.
+var compressedMagic = []byte("FSZSTD\x00\x01")
+
+const compressedTrailerSize = 8
+
+// compressibleTypes are content types that typically shrink a lot, such as
+// logs, CSV files and SQL dumps, which all sniff as text/plain
+var compressibleTypes = map[string]bool{
+	"application/json":       true,
+	"application/xml":        true,
+	"application/javascript": true,
+	"application/x-ndjson":   true,
+	"image/svg+xml":          true,
+}
+
+// Compressible reports whether content of the given type is worth
+// compressing at rest.
+func Compressible(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") || compressibleTypes[contentType]
+}
+
+// compressWriter compresses what is written to it into dst, which it
+// closes on Close after writing the trailer
+type compressWriter struct {
+	dst  io.WriteCloser
+	enc  *zstd.Encoder
+	size uint64
+}
+
+func newCompressWriter(dst io.WriteCloser) (*compressWriter, error) {
+	if _, err := dst.Write(compressedMagic); err != nil {
+		return nil, err
+	}
+	// Browsers only decode Content-Encoding: zstd with windows of up to
+	// 8MB (RFC 9659), and one encoder goroutine per upload keeps memory
+	// use predictable with many uploads at once
+	enc, err := zstd.NewWriter(dst,
+		zstd.WithWindowSize(8<<20),
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithZeroFrames(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &compressWriter{dst: dst, enc: enc}, nil
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	n, err := w.enc.Write(p)
+	w.size += uint64(n)
+	return n, err
+}
+
+func (w *compressWriter) Close() error {
+	err := w.enc.Close()
+	if err == nil {
+		_, err = w.dst.Write(binary.BigEndian.AppendUint64(nil, w.size))
+	}
+	if closeErr := w.dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// decompress makes f read the content of a file stored compressed, as
+// recorded in its metadata. Other files are left as they are: uploads may
+// well start with the magic themselves.
+func (f *File) decompress(compressed bool) error {
+	if !compressed {
+		return nil
+	}
+	head := make([]byte, len(compressedMagic))
+	if n, _ := f.content.ReadAt(head, 0); n < len(head) || !bytes.Equal(head, compressedMagic) {
+		return errors.New("compressed file has no compression header")
+	}
+	if f.size < int64(len(compressedMagic))+compressedTrailerSize {
+		return errors.New("compressed file is truncated")
+	}
+	trailer := make([]byte, compressedTrailerSize)
+	if _, err := f.content.ReadAt(trailer, f.size-compressedTrailerSize); err != nil {
+		return err
+	}
+	f.zstd = io.NewSectionReader(f.content, int64(len(compressedMagic)), f.size-int64(len(compressedMagic))-compressedTrailerSize)
+	d := &decompressor{src: f.zstd, size: int64(binary.BigEndian.Uint64(trailer))}
+	f.content, f.size, f.closer = d, d.size, d
+	return nil
+}
+
+// decompressor reads a zstd stream as a seekable file of known size.
+// zstd can only be decoded forward, so going back starts over from the
+// beginning; downloads, and range requests resuming them, mostly move
+// forward.
+type decompressor struct {
+	src  *io.SectionReader
+	size int64
+
+	mu      sync.Mutex
+	dec     *zstd.Decoder
+	pos     int64 // Offset of the next Read
+	decoded int64 // Offset dec has reached
+}
+
+func (d *decompressor) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n, err := d.readAt(p, d.pos)
+	d.pos += int64(n)
+	return n, err
+}
+
+func (d *decompressor) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	total := 0
+	for total < len(p) {
+		n, err := d.readAt(p[total:], off+int64(total))
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (d *decompressor) Seek(offset int64, whence int) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+func (d *decompressor) Close() error {
+	if d.dec != nil {
+		d.dec.Close()
+	}
+	return nil
+}
+
+func (d *decompressor) readAt(p []byte, off int64) (int, error) {
+	if off >= d.size {
+		return 0, io.EOF
+	}
+	if d.dec == nil || off < d.decoded {
+		if err := d.restart(); err != nil {
+			return 0, err
+		}
+	}
+	if off > d.decoded {
+		n, err := io.CopyN(io.Discard, d.dec, off-d.decoded)
+		d.decoded += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	if remaining := d.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := d.dec.Read(p)
+	d.decoded += int64(n)
+	if err == io.EOF && d.decoded < d.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (d *decompressor) restart() error {
+	if _, err := d.src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	d.decoded = 0
+	if d.dec == nil {
+		var err error
+		d.dec, err = zstd.NewReader(d.src, zstd.WithDecoderConcurrency(1))
+		return err
+	}
+	return d.dec.Reset(d.src)
+}
@@ -0,0 +1,392 @@
+package fileops
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"filestation/internal/encryption"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// masterKey encrypts files and sidecars written from now on when set
+var masterKey *encryption.Key
+
+// SetMasterKey turns on encryption at rest. Files stored before keep their
+// format; both kinds are read transparently.
+func SetMasterKey(key *encryption.Key) {
+	masterKey = key
+}
+
+// File is a stored file opened for reading. Encrypted files are decrypted
+// on the fly, a chunk at a time, so seeking stays cheap. Compressed files
+// are decompressed on the fly too.
+type File struct {
+	content interface {
+		io.ReadSeeker
+		io.ReaderAt
+	}
+	f       *os.File
+	closer  io.Closer
+	zstd    *io.SectionReader
+	size    int64
+	modTime time.Time
+}
+
+// OpenFile opens the content of the stored file described by meta, which
+// tells how it is stored. Files encrypted with their password need the key
+// derived from it; for others key is nil.
+func OpenFile(uploadDir string, meta *FileMetadata, key *encryption.Key) (*File, error) {
+	filename := meta.Filename
+	if strings.Contains(filename, "..") || strings.Contains(filename, "/") || strings.Contains(filename, "\\") {
+		return nil, fmt.Errorf("invalid filename")
+	}
+	return openPath(filepath.Join(uploadDir, filename), meta.Encrypted, meta.Compressed, key)
+}
+
+// OpenThumbnail opens the thumbnail of a stored file. Thumbnails are made
+// by the server, so unlike uploads they can be told encrypted by their
+// first bytes.
+func OpenThumbnail(uploadDir, filename string) (*File, error) {
+	path := ThumbnailPath(uploadDir, filename)
+	return openPath(path, hasEncryptionHeader(path), false, nil)
+}
+
+// ReadFile returns the whole content of the stored file described by meta.
+func ReadFile(uploadDir string, meta *FileMetadata, key *encryption.Key) ([]byte, error) {
+	f, err := OpenFile(uploadDir, meta, key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// hasEncryptionHeader reports whether the file at path starts like an
+// encrypted file. Only use it on files the server wrote itself.
+func hasEncryptionHeader(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, encryption.HeaderSize)
+	n, _ := f.ReadAt(head, 0)
+	return encryption.IsEncrypted(head[:n])
+}
+
+// openPath opens a stored file in the format its metadata records
+func openPath(path string, encrypted, compressed bool, key *encryption.Key) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	file := &File{f: f, size: info.Size(), modTime: info.ModTime()}
+
+	if !encrypted {
+		file.content = io.NewSectionReader(f, 0, file.size)
+		if err := file.decompress(compressed); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return file, nil
+	}
+	if key == nil {
+		key = masterKey
+	}
+	if key == nil {
+		f.Close()
+		return nil, fmt.Errorf("%s is encrypted and no master key is configured", filepath.Base(path))
+	}
+	r, err := encryption.NewReader(f, file.size, key)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	file.content, file.size = r, r.Size()
+	if err := file.decompress(compressed); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	return f.content.Read(p)
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	return f.content.Seek(offset, whence)
+}
+
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	return f.content.ReadAt(p, off)
+}
+
+func (f *File) Close() error {
+	if f.closer != nil {
+		f.closer.Close()
+	}
+	return f.f.Close()
+}
+
+// Size returns the size of the content, which for encrypted and compressed
+// files differs from what they take on disk.
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// Zstd returns the zstd stream of a file stored compressed, for clients
+// that decode it themselves, or nil for other files.
+func (f *File) Zstd() *io.SectionReader {
+	return f.zstd
+}
+
+func (f *File) ModTime() time.Time {
+	return f.modTime
+}
+
+// contentWriter encrypts what is written to dst with key, or with the
+// master key when encryption is on
+func contentWriter(dst io.Writer, key *encryption.Key) (io.WriteCloser, error) {
+	if key == nil {
+		key = masterKey
+	}
+	if key == nil {
+		return nopWriteCloser{dst}, nil
+	}
+	return encryption.NewWriter(dst, key)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// WriteThumbnail stores the thumbnail of filename as produced by write,
+// replacing it atomically.
+func WriteThumbnail(uploadDir, filename string, write func(w io.Writer) error) error {
+	path := ThumbnailPath(uploadDir, filename)
+	tmp := path + ".tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w, err := contentWriter(dst, nil)
+	if err == nil {
+		err = write(w)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// readSidecar reads a small sidecar file, decrypting it if need be
+func readSidecar(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil || !encryption.IsEncrypted(data) {
+		return data, err
+	}
+	if masterKey == nil {
+		return nil, fmt.Errorf("%s is encrypted and no master key is configured", filepath.Base(path))
+	}
+	return encryption.Open(masterKey, data)
+}
+
+// sealSidecar encrypts sidecar content when encryption is on
+func sealSidecar(data []byte) ([]byte, error) {
+	if masterKey == nil {
+		return data, nil
+	}
+	return encryption.Seal(masterKey, data)
+}
+
+// sealLine encrypts one line of an append-only sidecar. Encrypted lines are
+// base64 so they stay lines.
+func sealLine(line []byte) ([]byte, error) {
+	if masterKey == nil {
+		return line, nil
+	}
+	sealed, err := encryption.Seal(masterKey, line)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// openLine decrypts a line written by sealLine. Plain JSON lines are
+// returned as they are.
+func openLine(line []byte) ([]byte, error) {
+	if bytes.HasPrefix(line, []byte("{")) {
+		return line, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(line))
+	if err != nil {
+		return nil, err
+	}
+	if masterKey == nil {
+		return nil, fmt.Errorf("line is encrypted and no master key is configured")
+	}
+	return encryption.Open(masterKey, sealed)
+}
+
+// RotateKey rewraps the data keys of every encrypted file and sidecar in
+// dir from old to new, leaving their content untouched. Files already
+// using new are left alone, so an interrupted rotation can be run again.
+// Files whose metadata says they are encrypted with their download
+// password are skipped; any other file wrapped with another key means old
+// is not the current master key, and fails the rotation. The server must
+// not be running. It returns the number of files rewrapped and skipped.
+func RotateKey(dir string, old, new *encryption.Key) (rotated, skipped int, err error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasSuffix(name, partSuffix) || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		var changed bool
+		switch {
+		case strings.HasSuffix(name, ".downloads.jsonl"):
+			changed, err = rewrapLines(path, old, new)
+		case strings.HasPrefix(name, "."):
+			// Sidecars are written by the server, always with the master key
+			changed, err = rewrapFile(path, old, new)
+		default:
+			var meta *FileMetadata
+			if meta, err = rotationMetadata(dir, name, old, new); err != nil {
+				break
+			}
+			if !meta.Encrypted {
+				continue
+			}
+			changed, err = rewrapFile(path, old, new)
+			if errors.Is(err, encryption.ErrWrongKey) && meta.PasswordKDF != nil {
+				skipped++
+				continue
+			}
+		}
+		switch {
+		case errors.Is(err, encryption.ErrWrongKey):
+			return rotated, skipped, fmt.Errorf("%s: %w, is %s the current master key?", name, err, old.ID())
+		case err != nil:
+			return rotated, skipped, fmt.Errorf("%s: %w", name, err)
+		case changed:
+			rotated++
+		}
+	}
+	return rotated, skipped, nil
+}
+
+// rotationMetadata reads the metadata of filename during a rotation, when
+// its sidecar may already have been rewrapped to new
+func rotationMetadata(dir, filename string, old, new *encryption.Key) (*FileMetadata, error) {
+	meta := &FileMetadata{}
+	data, err := os.ReadFile(metadataPath(dir, filename))
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if encryption.IsEncrypted(data) {
+		plain, err := encryption.Open(old, data)
+		if errors.Is(err, encryption.ErrWrongKey) {
+			plain, err = encryption.Open(new, data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("metadata: %w", err)
+		}
+		data = plain
+	}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("metadata: %w", err)
+	}
+	return meta, nil
+}
+
+// rewrapFile replaces the header of an encrypted file in place
+func rewrapFile(path string, old, new *encryption.Key) (bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, encryption.HeaderSize)
+	if n, _ := f.ReadAt(header, 0); !encryption.IsEncrypted(header[:n]) {
+		return false, nil
+	}
+	rewrapped, err := encryption.Rewrap(header, old, new)
+	if err != nil || bytes.Equal(rewrapped, header) {
+		return false, err
+	}
+	if _, err := f.WriteAt(rewrapped, 0); err != nil {
+		return false, err
+	}
+	return true, f.Sync()
+}
+
+// rewrapLines rewrites a sidecar of sealed lines with rewrapped headers
+func rewrapLines(path string, old, new *encryption.Key) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var out bytes.Buffer
+	changed := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if sealed, err := base64.StdEncoding.DecodeString(string(line)); err == nil && encryption.IsEncrypted(sealed) {
+			header, err := encryption.Rewrap(sealed, old, new)
+			if err != nil {
+				return false, err
+			}
+			if !bytes.Equal(header, sealed[:encryption.HeaderSize]) {
+				copy(sealed, header)
+				line = []byte(base64.StdEncoding.EncodeToString(sealed))
+				changed = true
+			}
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil || !changed {
+		return false, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out.Bytes(), 0644); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp, path)
+}
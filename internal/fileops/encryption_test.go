@@ -0,0 +1,61 @@
+package fileops
+
+import (
+	"errors"
+	"filestation/internal/encryption"
+	"strings"
+	"testing"
+)
+
+func testKey(t *testing.T, hex string) *encryption.Key {
+	t.Helper()
+	key, err := encryption.ParseKey([]byte(strings.Repeat(hex, encryption.KeySize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestRotateKey(t *testing.T) {
+	dir := t.TempDir()
+	old, new, wrong := testKey(t, "01"), testKey(t, "02"), testKey(t, "03")
+	SetMasterKey(old)
+	defer SetMasterKey(nil)
+
+	plain, err := SaveFile(strings.NewReader("master key"), "plain.txt", dir, FileMetadata{}, SaveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kdf := &encryption.KDF{Salt: make([]byte, 16), Time: 1, Memory: 64, Threads: 1}
+	passwordKey, err := kdf.Key("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	protected, err := SaveFile(strings.NewReader("password"), "protected.txt", dir, FileMetadata{PasswordKDF: kdf}, SaveOptions{Key: passwordKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := RotateKey(dir, wrong, new); !errors.Is(err, encryption.ErrWrongKey) {
+		t.Fatalf("rotating from the wrong key: got %v, want ErrWrongKey", err)
+	}
+	rotated, skipped, err := RotateKey(dir, old, new)
+	// Both metadata sidecars and the file encrypted with the master key
+	if err != nil || rotated != 3 || skipped != 1 {
+		t.Fatalf("RotateKey = %d, %d, %v, want 3, 1, nil", rotated, skipped, err)
+	}
+	if rotated, skipped, err := RotateKey(dir, old, new); err != nil || rotated != 0 || skipped != 1 {
+		t.Fatalf("RotateKey again = %d, %d, %v, want 0, 1, nil", rotated, skipped, err)
+	}
+
+	SetMasterKey(new)
+	for name, key := range map[string]*encryption.Key{plain: nil, protected: passwordKey} {
+		meta, err := GetFile(dir, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadFile(dir, meta, key); err != nil {
+			t.Errorf("reading %s after rotation: %v", name, err)
+		}
+	}
+}
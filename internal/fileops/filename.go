@@ -0,0 +1,89 @@
+package fileops
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxNameBytes keeps stored names, with their random prefix and sidecar
+// suffixes such as ".downloads.jsonl", under the usual 255 byte limit
+const maxNameBytes = 180
+
+// reservedNames can't be used as file names on Windows, with or without an
+// extension
+var reservedNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true,
+	"com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true,
+	"lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// SanitizeFilename turns a name sent by a client into one that is safe to
+// store and to offer back for download on any OS. Directories are dropped,
+// control and reserved characters become "_", dot runs collapse so the
+// name never contains "..", and Windows device names get a "_" prefix.
+// Non-ASCII letters are kept. An unusable name becomes "file".
+func SanitizeFilename(name string) string {
+	name = strings.ToValidUTF8(name, "_")
+	// Browsers on Windows may send the full path
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case unicode.IsSpace(r):
+			// Including CR, LF and tabs
+			b.WriteRune(' ')
+		case unicode.IsControl(r), unicode.Is(unicode.Cf, r), r == utf8.RuneError:
+			// Drop NUL and invisible direction overrides that make
+			// "exe.pdf" display as "fdp.exe"
+			continue
+		case strings.ContainsRune(`<>:"|?*`, r):
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	name = b.String()
+	for strings.Contains(name, "..") {
+		name = strings.ReplaceAll(name, "..", ".")
+	}
+	for strings.Contains(name, "  ") {
+		name = strings.ReplaceAll(name, "  ", " ")
+	}
+	// Windows ignores trailing dots and spaces, and leading dots would
+	// hide the file and clash with metadata sidecars
+	name = strings.Trim(name, ". ")
+
+	if name == "" {
+		return "file"
+	}
+	stem, _, _ := strings.Cut(name, ".")
+	if reservedNames[strings.ToLower(strings.TrimSpace(stem))] {
+		name = "_" + name
+	}
+	return truncateName(name, maxNameBytes)
+}
+
+// truncateName shortens name to at most max bytes on a rune boundary,
+// keeping a reasonably short extension
+func truncateName(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	limit := max - len(ext)
+	for limit > 0 && !utf8.RuneStart(stem[limit]) {
+		limit--
+	}
+	return strings.TrimRight(stem[:limit], ". ") + ext
+}
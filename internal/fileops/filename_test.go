@@ -0,0 +1,67 @@
+package fileops
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain", "report.pdf", "report.pdf"},
+		{"chinese", "季度报告（终版）.docx", "季度报告（终版）.docx"},
+		{"spaces kept", "my file.txt", "my file.txt"},
+		{"unix path", "../../etc/passwd", "passwd"},
+		{"windows path", `C:\Users\me\Desktop\合同.pdf`, "合同.pdf"},
+		{"quotes", `say "hi".txt`, "say _hi_.txt"},
+		{"crlf injection", "a.txt\r\nSet-Cookie: x=1", "a.txt Set-Cookie_ x=1"},
+		{"nul byte", "a\x00.txt", "a.txt"},
+		{"tab", "a\tb.txt", "a b.txt"},
+		{"reserved chars", `a<b>c:d|e?f*.txt`, "a_b_c_d_e_f_.txt"},
+		{"rtl override", "invoice\u202efdp.exe", "invoicefdp.exe"},
+		{"dot runs", "a..b...txt", "a.b.txt"},
+		{"only dots", "..", "file"},
+		{"hidden", ".htaccess", "htaccess"},
+		{"trailing dot and space", "setup.exe. . ", "setup.exe"},
+		{"empty", "", "file"},
+		{"slash only", "/", "file"},
+		{"device", "CON", "_CON"},
+		{"device with extension", "nul.txt", "_nul.txt"},
+		{"device lookalike", "console.txt", "console.txt"},
+		{"com port", "com1.tar.gz", "_com1.tar.gz"},
+		{"invalid utf8", "a\xff\xfeb.txt", "a_b.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizeFilename(tt.in); got != tt.want {
+				t.Errorf("SanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFilenameLength(t *testing.T) {
+	tests := []struct {
+		name, in, ext string
+	}{
+		{"ascii", strings.Repeat("a", 300) + ".pdf", ".pdf"},
+		{"chinese", strings.Repeat("文", 100) + ".txt", ".txt"},
+		{"long extension", "a." + strings.Repeat("b", 300), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SanitizeFilename(tt.in)
+			if len(got) > maxNameBytes {
+				t.Errorf("got %d bytes, want at most %d", len(got), maxNameBytes)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("got invalid UTF-8 %q", got)
+			}
+			if !strings.HasSuffix(got, tt.ext) {
+				t.Errorf("got %q, want extension %q", got, tt.ext)
+			}
+		})
+	}
+}
@@ -1,31 +1,111 @@
 package fileops
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"filestation/internal/archive"
+	"filestation/internal/encryption"
 	"fmt"
 	"io"
-	"mime/multipart"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
 type FileMetadata struct {
-	Description      string    `json:"description"`
-	Uploader         ClientInfo `json:"uploader"`
-	UploadTime       time.Time `json:"upload_time"`
-	ExpirationTime   time.Time `json:"expiration_time"`
-	OriginalFilename string    `json:"original_filename"`
-	PasswordHash     string    `json:"password_hash,omitempty"`
-	Filename         string    `json:"-"` // Internal use
-	Size             int64     `json:"-"` // Internal use
-	IsTemp           bool      `json:"-"` // Internal use
-	RemainingTime    string    `json:"-"` // Internal use
-	HasPassword      bool      `json:"-"` // Internal use
-	FormattedSize    string    `json:"-"` // Internal use
-	Icon             string    `json:"-"` // Internal use
+	Description        string           `json:"description"`
+	Uploader           ClientInfo       `json:"uploader"`
+	UploadTime         time.Time        `json:"upload_time"`
+	ExpirationTime     time.Time        `json:"expiration_time"`
+	OriginalFilename   string           `json:"original_filename"`
+	PasswordHash       string           `json:"password_hash,omitempty"`
+	FirstDownload      time.Time        `json:"first_download,omitempty"`
+	NotifyEmail        string           `json:"notify_email,omitempty"`
+	NotifyLocale       string           `json:"notify_locale,omitempty"`
+	ExpiryWarned       bool             `json:"expiry_warned,omitempty"`
+	MaxDownloads       int              `json:"max_downloads,omitempty"` // 0 means unlimited
+	Downloads          int              `json:"downloads,omitempty"`
+	LastDownload       time.Time        `json:"last_download,omitempty"`
+	Visibility         string           `json:"visibility,omitempty"`    // Empty means public
+	Owner              string           `json:"owner,omitempty"`         // Hash of the uploader's owner token
+	Language           string           `json:"language,omitempty"`      // Set for pasted text snippets
+	Thumbnail          bool             `json:"thumbnail,omitempty"`     // A thumbnail sidecar exists
+	Archive            *archive.Listing `json:"archive,omitempty"`       // Cached content of an archive
+	Scan               *ScanResult      `json:"scan,omitempty"`          // Unset when scanning is off
+	ContentType        string           `json:"content_type,omitempty"`  // Detected from the content
+	TypeMismatch       bool             `json:"type_mismatch,omitempty"` // Extension doesn't match the content
+	Encrypted          bool             `json:"encrypted,omitempty"`     // Stored encrypted at rest
+	PasswordKDF        *encryption.KDF  `json:"password_kdf,omitempty"`  // Set when encrypted with the download password
+	E2E                string           `json:"e2e,omitempty"`           // Name and description sealed by the uploader's browser
+	Compressed         bool             `json:"compressed,omitempty"`    // Stored zstd compressed
+	OriginalSize       int64            `json:"original_size,omitempty"` // Size before compression
+	Filename           string           `json:"-"`                       // Internal use
+	Size               int64            `json:"-"`                       // Internal use
+	StoredSize         int64            `json:"-"`                       // Internal use
+	IsTemp             bool             `json:"-"`                       // Internal use
+	RemainingTime      string           `json:"-"`                       // Internal use
+	HasPassword        bool             `json:"-"`                       // Internal use
+	FormattedSize      string           `json:"-"`                       // Internal use
+	Icon               string           `json:"-"`                       // Internal use
+	RemainingDownloads int              `json:"-"`                       // Internal use
+	Preview            string           `json:"-"`                       // Internal use
+	IsArchive          bool             `json:"-"`                       // Internal use
+}
+
+// partSuffix marks files that are still being written.
+const partSuffix = ".part"
+
+// Visibility levels
+const (
+	VisibilityPublic   = "public"   // Listed on the index
+	VisibilityUnlisted = "unlisted" // Reachable by link only
+	VisibilityPrivate  = "private"  // Owner and admin only
+)
+
+// Malware scan states
+const (
+	ScanPending  = "pending"
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+	ScanFailed   = "failed" // Couldn't be scanned; the file stays available
+)
+
+// ScanResult is the verdict of the malware scanner on a file
+type ScanResult struct {
+	Status    string    `json:"status"`
+	Signature string    `json:"signature,omitempty"` // What an infected file matched
+	Error     string    `json:"error,omitempty"`     // Why a scan failed
+	Time      time.Time `json:"time,omitempty"`
+}
+
+// setSize sets the size of the content from what the file takes on disk,
+// which Size holds when called, and how it is stored
+func (m *FileMetadata) setSize() {
+	m.StoredSize = m.Size
+	switch {
+	case m.Compressed:
+		m.Size = m.OriginalSize
+	case m.Encrypted:
+		m.Size = encryption.PlaintextSize(m.StoredSize)
+	}
+	m.FormattedSize = FormatSize(m.Size)
+}
+
+// Blocked reports whether the file must not be served because it is
+// still being scanned or was found infected
+func (m *FileMetadata) Blocked() bool {
+	return m.Scan != nil && (m.Scan.Status == ScanPending || m.Scan.Status == ScanInfected)
+}
+
+// IsPublic reports whether the file is listed on the public index
+func (m *FileMetadata) IsPublic() bool {
+	return m.Visibility == "" || m.Visibility == VisibilityPublic
 }
 
 type ClientInfo struct {
@@ -33,31 +113,123 @@ type ClientInfo struct {
 	Device string `json:"device"`
 }
 
-func SaveFile(file multipart.File, header *multipart.FileHeader, uploadDir string, meta FileMetadata) error {
-	// Create unique filename
-	uniqueFilename := fmt.Sprintf("%s_%s", uuidShort(), header.Filename)
-	filepath := filepath.Join(uploadDir, uniqueFilename)
-	
-	// Save file
-	dst, err := os.Create(filepath)
-	if err != nil {
-		return err
+// SaveOptions controls how SaveFile stores a file
+type SaveOptions struct {
+	// Policy, if set, rejects files by extension or content type with a
+	// *PolicyError
+	Policy *TypePolicy
+	// Key, if set, encrypts the file instead of the master key. It is
+	// derived from the download password, see FileMetadata.PasswordKDF.
+	Key *encryption.Key
+	// Compress stores files whose content type is Compressible with zstd
+	Compress bool
+	// Quota, if set, is asked before every write whether the file may grow
+	// to the given size on disk. SaveFile stops and removes the partial
+	// file when it refuses.
+	Quota Quota
+}
+
+// Quota limits the size of a file being saved, see SaveOptions
+type Quota interface {
+	Grow(size int64) error
+}
+
+// quotaWriter asks a Quota before writing
+type quotaWriter struct {
+	w       io.Writer
+	quota   Quota
+	written int64
+}
+
+func (w *quotaWriter) Write(p []byte) (int, error) {
+	if err := w.quota.Grow(w.written + int64(len(p))); err != nil {
+		return 0, err
 	}
-	defer dst.Close()
+	n, err := w.w.Write(p)
+	w.written += int64(n)
+	return n, err
+}
 
-	if _, err := io.Copy(dst, file); err != nil {
-		return err
+// SaveFile stores src under a unique name derived from filename along with
+// meta, and returns the stored name. The content type is detected from the
+// first bytes and recorded in the metadata, and decides whether the file
+// is compressed.
+func SaveFile(src io.Reader, filename string, uploadDir string, meta FileMetadata, opts SaveOptions) (string, error) {
+	if err := opts.Policy.CheckName(filename); err != nil {
+		return "", err
+	}
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
 	}
+	head = head[:n]
+	meta.ContentType = DetectContentType(head)
+	meta.TypeMismatch = TypeMismatch(filename, meta.ContentType)
+	if err := opts.Policy.CheckType(meta.ContentType); err != nil {
+		return "", err
+	}
+	src = io.MultiReader(bytes.NewReader(head), src)
 
-	// Save metadata file with dot prefix (e.g., .filename.json)
-	metaPath := filepathJoin(uploadDir, "."+uniqueFilename+".json")
-	
-	metaJSON, err := json.MarshalIndent(meta, "", "  ")
+	// Create unique filename. Files not on the index get a long random
+	// prefix so their links can't be guessed.
+	prefix := uuidShort()
+	if !meta.IsPublic() {
+		prefix = randomHex(16)
+	}
+	uniqueFilename := fmt.Sprintf("%s_%s", prefix, SanitizeFilename(filename))
+	finalPath := filepath.Join(uploadDir, uniqueFilename)
+
+	// Write to a .part file first so an interrupted upload never shows up
+	// in the listing and can be swept by RemovePartials
+	partPath := finalPath + partSuffix
+	dst, err := os.Create(partPath)
 	if err != nil {
-		return err
+		return "", err
+	}
+	var out io.Writer = dst
+	if opts.Quota != nil {
+		out = &quotaWriter{w: dst, quota: opts.Quota}
+	}
+	// Compress first; encrypted data doesn't compress
+	meta.Compressed = opts.Compress && Compressible(meta.ContentType)
+	w, err := contentWriter(out, opts.Key)
+	if err == nil && meta.Compressed {
+		w, err = newCompressWriter(w)
+	}
+	var written int64
+	if err == nil {
+		written, err = io.Copy(w, src)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		dst.Close()
+		os.Remove(partPath)
+		return "", err
+	}
+	meta.Encrypted = opts.Key != nil || masterKey != nil
+	if meta.Compressed {
+		meta.OriginalSize = written
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(partPath)
+		return "", err
 	}
 
-	return os.WriteFile(metaPath, metaJSON, 0644)
+	// Save metadata file with dot prefix (e.g., .filename.json) before the
+	// file becomes visible, so it is never listed without its password
+	if err := writeMetadata(uploadDir, uniqueFilename, &meta); err != nil {
+		os.Remove(partPath)
+		return "", err
+	}
+	if err := os.Rename(partPath, finalPath); err != nil {
+		os.Remove(partPath)
+		os.Remove(metadataPath(uploadDir, uniqueFilename))
+		return "", err
+	}
+	return uniqueFilename, nil
 }
 
 func GetFiles(uploadDir string) ([]FileMetadata, error) {
@@ -70,7 +242,7 @@ func GetFiles(uploadDir string) ([]FileMetadata, error) {
 	now := time.Now()
 
 	for _, entry := range entries {
-		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || strings.HasSuffix(entry.Name(), ".part") {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || strings.HasSuffix(entry.Name(), partSuffix) {
 			continue
 		}
 
@@ -86,13 +258,17 @@ func GetFiles(uploadDir string) ([]FileMetadata, error) {
 			UploadTime:       info.ModTime(),
 			Description:      "临时文件",
 			IsTemp:           true,
-			FormattedSize:    formatSize(info.Size()),
+			FormattedSize:    FormatSize(info.Size()),
 			Icon:             getFileIcon(entry.Name()),
 		}
 
 		// Read metadata file
 		metaPath := filepathJoin(uploadDir, "."+entry.Name()+".json")
-		if metaData, err := os.ReadFile(metaPath); err == nil {
+		metaData, err := readSidecar(metaPath)
+		if err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
 			var storedMeta FileMetadata
 			if err := json.Unmarshal(metaData, &storedMeta); err == nil {
 				meta.Description = storedMeta.Description
@@ -101,12 +277,49 @@ func GetFiles(uploadDir string) ([]FileMetadata, error) {
 				meta.ExpirationTime = storedMeta.ExpirationTime
 				meta.PasswordHash = storedMeta.PasswordHash
 				meta.HasPassword = meta.PasswordHash != ""
-				
+				meta.FirstDownload = storedMeta.FirstDownload
+				meta.NotifyEmail = storedMeta.NotifyEmail
+				meta.NotifyLocale = storedMeta.NotifyLocale
+				meta.ExpiryWarned = storedMeta.ExpiryWarned
+				meta.MaxDownloads = storedMeta.MaxDownloads
+				meta.Downloads = storedMeta.Downloads
+				meta.LastDownload = storedMeta.LastDownload
+				meta.Visibility = storedMeta.Visibility
+				meta.Owner = storedMeta.Owner
+				meta.Language = storedMeta.Language
+				meta.Thumbnail = storedMeta.Thumbnail
+				meta.Scan = storedMeta.Scan
+				meta.ContentType = storedMeta.ContentType
+				meta.TypeMismatch = storedMeta.TypeMismatch
+				meta.Encrypted = storedMeta.Encrypted
+				meta.PasswordKDF = storedMeta.PasswordKDF
+				meta.E2E = storedMeta.E2E
+				meta.Compressed = storedMeta.Compressed
+				meta.OriginalSize = storedMeta.OriginalSize
+				meta.setSize()
+				// Infected files are quarantined; never list one whose move
+				// failed
+				if meta.Scan != nil && meta.Scan.Status == ScanInfected {
+					continue
+				}
+				if meta.MaxDownloads > 0 {
+					// Burnt files are deleted right away; never list one
+					// whose deletion failed
+					if meta.DownloadsExhausted() {
+						continue
+					}
+					meta.RemainingDownloads = meta.MaxDownloads - meta.Downloads
+				}
+
 				// Update icon based on original filename
 				if meta.OriginalFilename != "" {
 					meta.Icon = getFileIcon(meta.OriginalFilename)
 				}
-				
+				if meta.Language == "" {
+					meta.Preview = PreviewKind(meta.OriginalFilename)
+				}
+				meta.IsArchive = archive.Format(meta.OriginalFilename) != ""
+
 				if !meta.ExpirationTime.IsZero() {
 					if meta.ExpirationTime.After(now) {
 						meta.RemainingTime = formatDuration(meta.ExpirationTime.Sub(now))
@@ -129,6 +342,22 @@ func GetFiles(uploadDir string) ([]FileMetadata, error) {
 	return files, nil
 }
 
+// ListedFiles returns the files shown on the public index, plus any
+// unlisted or private files belonging to owner
+func ListedFiles(uploadDir, owner string) ([]FileMetadata, error) {
+	files, err := GetFiles(uploadDir)
+	if err != nil {
+		return nil, err
+	}
+	listed := files[:0]
+	for _, f := range files {
+		if f.IsPublic() || (owner != "" && f.Owner == owner) {
+			listed = append(listed, f)
+		}
+	}
+	return listed, nil
+}
+
 func GetFile(uploadDir, filename string) (*FileMetadata, error) {
 	// Security check for path traversal
 	if strings.Contains(filename, "..") || strings.Contains(filename, "/") || strings.Contains(filename, "\\") {
@@ -146,29 +375,187 @@ func GetFile(uploadDir, filename string) (*FileMetadata, error) {
 		OriginalFilename: filename,
 		Size:             info.Size(),
 		UploadTime:       info.ModTime(),
+		FormattedSize:    FormatSize(info.Size()),
 	}
 
 	metaPath := filepathJoin(uploadDir, "."+filename+".json")
-	if metaData, err := os.ReadFile(metaPath); err == nil {
+	if metaData, err := readSidecar(metaPath); err == nil {
 		json.Unmarshal(metaData, meta)
 		meta.HasPassword = meta.PasswordHash != ""
+		meta.setSize()
+	} else if !os.IsNotExist(err) {
+		// Encrypted with another key; never hand out the file without
+		// its password and limits
+		return nil, err
 	}
 
 	return meta, nil
 }
 
+// UpdateMetadata applies update to the stored metadata of filename while
+// holding the metadata lock, and saves the result unless update fails
+func UpdateMetadata(uploadDir, filename string, update func(meta *FileMetadata) error) error {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	return updateMetadataLocked(uploadDir, filename, update)
+}
+
+func updateMetadataLocked(uploadDir, filename string, update func(meta *FileMetadata) error) error {
+	meta, err := GetFile(uploadDir, filename)
+	if err != nil {
+		return err
+	}
+	if err := update(meta); err != nil {
+		return err
+	}
+	return writeMetadata(uploadDir, filename, meta)
+}
+
+// ErrDownloadLimit is returned by ReserveDownload when the downloads made
+// and in progress reach the download limit of the file
+var ErrDownloadLimit = errors.New("download limit reached")
+
+// pendingDownloads counts the downloads in progress per file. Guarded by
+// metaMu.
+var pendingDownloads = make(map[string]int)
+
+// DownloadSlot is a download set aside while the file is transferred, so
+// that parallel requests can't together go past the download limit.
+type DownloadSlot struct {
+	uploadDir string
+	filename  string
+	done      bool // Guarded by metaMu
+}
+
+// ReserveDownload sets a download of filename aside before its content is
+// sent. The slot must be completed or released once the transfer ends.
+func ReserveDownload(uploadDir, filename string) (*DownloadSlot, error) {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	meta, err := GetFile(uploadDir, filename)
+	if err != nil {
+		return nil, err
+	}
+	if meta.MaxDownloads > 0 && meta.Downloads+pendingDownloads[filename] >= meta.MaxDownloads {
+		return nil, ErrDownloadLimit
+	}
+	pendingDownloads[filename]++
+	return &DownloadSlot{uploadDir: uploadDir, filename: filename}, nil
+}
+
+// Filename is the stored name of the file being downloaded
+func (d *DownloadSlot) Filename() string {
+	return d.filename
+}
+
+// Complete counts the reserved download as completed and returns the
+// updated metadata. The first download time is set on the first call.
+func (d *DownloadSlot) Complete() (*FileMetadata, error) {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	d.releaseLocked()
+	var updated *FileMetadata
+	err := updateMetadataLocked(d.uploadDir, d.filename, func(meta *FileMetadata) error {
+		if meta.FirstDownload.IsZero() {
+			meta.FirstDownload = time.Now()
+		}
+		meta.Downloads++
+		meta.LastDownload = time.Now()
+		updated = meta
+		return nil
+	})
+	return updated, err
+}
+
+// Release gives back a download that didn't complete. It does nothing
+// after Complete.
+func (d *DownloadSlot) Release() {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	d.releaseLocked()
+}
+
+func (d *DownloadSlot) releaseLocked() {
+	if d.done {
+		return
+	}
+	d.done = true
+	if pendingDownloads[d.filename]--; pendingDownloads[d.filename] <= 0 {
+		delete(pendingDownloads, d.filename)
+	}
+}
+
+// DownloadsExhausted reports whether the file has reached its download limit
+func (m *FileMetadata) DownloadsExhausted() bool {
+	return m.MaxDownloads > 0 && m.Downloads >= m.MaxDownloads
+}
+
+// DeleteFile removes a stored file and its metadata sidecar
+func DeleteFile(uploadDir, filename string) error {
+	if strings.Contains(filename, "..") || strings.Contains(filename, "/") || strings.Contains(filename, "\\") {
+		return fmt.Errorf("invalid filename")
+	}
+	err := os.Remove(filepath.Join(uploadDir, filename))
+	removeSidecars(uploadDir, filename)
+	return err
+}
+
 // Helpers
 
+// metaMu serializes read-modify-write updates of metadata sidecars
+var metaMu sync.Mutex
+
+func metadataPath(uploadDir, filename string) string {
+	return filepathJoin(uploadDir, "."+filename+".json")
+}
+
+// ThumbnailPath is where the thumbnail of filename is cached
+func ThumbnailPath(uploadDir, filename string) string {
+	return filepathJoin(uploadDir, "."+filename+".thumb.jpg")
+}
+
+// removeSidecars deletes the metadata, download history and thumbnail of
+// filename
+func removeSidecars(uploadDir, filename string) {
+	os.Remove(metadataPath(uploadDir, filename))
+	os.Remove(statsPath(uploadDir, filename))
+	os.Remove(ThumbnailPath(uploadDir, filename))
+}
+
+// writeMetadata atomically replaces the sidecar of filename
+func writeMetadata(uploadDir, filename string, meta *FileMetadata) error {
+	metaJSON, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	if metaJSON, err = sealSidecar(metaJSON); err != nil {
+		return err
+	}
+	path := metadataPath(uploadDir, filename)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, metaJSON, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 func uuidShort() string {
-	// Generate a short unique identifier based on current time
-	return fmt.Sprintf("%x", time.Now().UnixNano())[:8]
+	// Generate a short random identifier
+	return randomHex(4)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
 func filepathJoin(dir, name string) string {
 	return filepath.Join(dir, name)
 }
 
-func formatSize(size int64) string {
+// FormatSize formats a byte count for display, e.g. "1.5 MB"
+func FormatSize(size int64) string {
 	const unit = 1024
 	if size < unit {
 		return fmt.Sprintf("%d B", size)
@@ -225,18 +612,21 @@ func formatDuration(d time.Duration) string {
 	return fmt.Sprintf("%d分钟", minutes)
 }
 
-// Cleanup removes expired files from the upload directory
-func Cleanup(uploadDir string) error {
+// Cleanup removes expired files from the upload directory and returns the
+// metadata of the files it removed
+func Cleanup(uploadDir string) ([]FileMetadata, error) {
 	entries, err := os.ReadDir(uploadDir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var removed []FileMetadata
+
 	now := time.Now()
 	defaultRetention := 24 * time.Hour
 
 	for _, entry := range entries {
-		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || strings.HasSuffix(entry.Name(), ".part") {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || strings.HasSuffix(entry.Name(), partSuffix) {
 			continue
 		}
 
@@ -249,9 +639,15 @@ func Cleanup(uploadDir string) error {
 		// Check metadata file for expiration time
 		metaPath := filepathJoin(uploadDir, "."+entry.Name()+".json")
 		expirationTime := time.Time{}
+		storedMeta := FileMetadata{OriginalFilename: entry.Name()}
 
-		if metaData, err := os.ReadFile(metaPath); err == nil {
-			var storedMeta FileMetadata
+		metaData, err := readSidecar(metaPath)
+		if err != nil && !os.IsNotExist(err) {
+			// Unreadable, probably encrypted with another key; keep it
+			// rather than guess its expiry
+			continue
+		}
+		if err == nil {
 			if err := json.Unmarshal(metaData, &storedMeta); err == nil {
 				if !storedMeta.ExpirationTime.IsZero() {
 					expirationTime = storedMeta.ExpirationTime
@@ -266,10 +662,79 @@ func Cleanup(uploadDir string) error {
 
 		// Delete expired files
 		if now.After(expirationTime) {
-			os.Remove(filePath)
-			os.Remove(metaPath)
+			if err := os.Remove(filePath); err == nil {
+				storedMeta.Filename = entry.Name()
+				storedMeta.Size = info.Size()
+				storedMeta.HasPassword = storedMeta.PasswordHash != ""
+				removed = append(removed, storedMeta)
+			}
+			removeSidecars(uploadDir, entry.Name())
+		}
+	}
+
+	return removed, nil
+}
+
+// Usage reports the number of stored files and their total size, including
+// expired files that have not been cleaned up yet
+func Usage(uploadDir string) (int, int64, error) {
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	count, total := 0, int64(0)
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || strings.HasSuffix(entry.Name(), partSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
 		}
+		count++
+		total += info.Size()
 	}
 
+	return count, total, nil
+}
+
+// Quarantine moves an infected file and its metadata out of the upload
+// directory into dir, where nothing serves them. If the file can't be
+// moved it is deleted instead.
+func Quarantine(uploadDir, dir, filename string) error {
+	if strings.Contains(filename, "..") || strings.Contains(filename, "/") || strings.Contains(filename, "\\") {
+		return fmt.Errorf("invalid filename")
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err == nil {
+		err = os.Rename(filepath.Join(uploadDir, filename), filepath.Join(dir, filename))
+	}
+	if err != nil {
+		if removeErr := os.Remove(filepath.Join(uploadDir, filename)); removeErr != nil {
+			return fmt.Errorf("quarantine: %w; delete: %v", err, removeErr)
+		}
+		removeSidecars(uploadDir, filename)
+		return fmt.Errorf("quarantine failed, file deleted: %w", err)
+	}
+	os.Rename(metadataPath(uploadDir, filename), metadataPath(dir, filename))
+	removeSidecars(uploadDir, filename)
 	return nil
-}
\ No newline at end of file
+}
+
+// RemovePartials deletes incomplete uploads left behind in the upload directory
+func RemovePartials(uploadDir string) error {
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), partSuffix) {
+			continue
+		}
+		os.Remove(filepath.Join(uploadDir, entry.Name()))
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package fileops
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// TypePolicy restricts which files may be uploaded. Extensions are lower
+// case with a dot; types may end in "/*" to match a whole family, such as
+// "image/*". Empty allow lists allow everything not denied.
+type TypePolicy struct {
+	AllowExtensions []string
+	DenyExtensions  []string
+	AllowTypes      []string
+	DenyTypes       []string
+}
+
+// PolicyError is returned by SaveFile when a file breaks the type policy.
+// Its message is meant for the uploader.
+type PolicyError struct {
+	Message string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Message
+}
+
+// ParseList splits a comma separated list such as "exe, .msi" or
+// "image/*,application/pdf" into lower case entries. Extensions get a
+// leading dot.
+func ParseList(list string, extensions bool) []string {
+	var entries []string
+	for _, f := range strings.Split(list, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "" {
+			continue
+		}
+		if extensions && !strings.HasPrefix(f, ".") {
+			f = "." + f
+		}
+		entries = append(entries, f)
+	}
+	return entries
+}
+
+// Empty reports whether the policy allows everything.
+func (p *TypePolicy) Empty() bool {
+	return p == nil || len(p.AllowExtensions)+len(p.DenyExtensions)+len(p.AllowTypes)+len(p.DenyTypes) == 0
+}
+
+// CheckName checks the extension of a file called name. Every suffix
+// counts, so "report.exe.pdf" can't slip past a deny list on ".exe" nor
+// "setup.exe" past one on ".exe" by adding a trailing dot.
+func (p *TypePolicy) CheckName(name string) error {
+	if p.Empty() {
+		return nil
+	}
+	lower := strings.TrimRight(strings.ToLower(name), ". ")
+	ext := filepath.Ext(lower)
+	for _, deny := range p.DenyExtensions {
+		if strings.Contains(lower+".", deny+".") {
+			return &PolicyError{Message: "不允许上传 " + deny + " 文件"}
+		}
+	}
+	if len(p.AllowExtensions) > 0 && !contains(p.AllowExtensions, ext) {
+		return &PolicyError{Message: "只允许上传以下类型的文件：" + strings.Join(p.AllowExtensions, " ")}
+	}
+	return nil
+}
+
+// CheckType checks the detected content type of a file.
+func (p *TypePolicy) CheckType(contentType string) error {
+	if p.Empty() {
+		return nil
+	}
+	for _, deny := range p.DenyTypes {
+		if matchType(deny, contentType) {
+			return &PolicyError{Message: "不允许上传此类文件（文件内容为 " + contentType + "）"}
+		}
+	}
+	if len(p.AllowTypes) == 0 {
+		return nil
+	}
+	for _, allow := range p.AllowTypes {
+		if matchType(allow, contentType) {
+			return nil
+		}
+	}
+	return &PolicyError{Message: "不允许上传此类文件（文件内容为 " + contentType + "），只允许：" + strings.Join(p.AllowTypes, " ")}
+}
+
+func matchType(pattern, contentType string) bool {
+	if family, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(contentType, family+"/")
+	}
+	return pattern == contentType
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
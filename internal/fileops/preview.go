@@ -0,0 +1,156 @@
+package fileops
+
+import (
+	"bytes"
+	"filestation/internal/encryption"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Preview kinds
+const (
+	PreviewImage    = "image"
+	PreviewPDF      = "pdf"
+	PreviewAudio    = "audio"
+	PreviewVideo    = "video"
+	PreviewText     = "text"
+	PreviewMarkdown = "markdown"
+)
+
+// previewTypes are the types browsers may render inline. Anything that can
+// run script, such as HTML or SVG, is deliberately missing.
+var previewTypes = map[string]string{
+	"image/png":       PreviewImage,
+	"image/jpeg":      PreviewImage,
+	"image/gif":       PreviewImage,
+	"image/webp":      PreviewImage,
+	"image/bmp":       PreviewImage,
+	"application/pdf": PreviewPDF,
+	"audio/mpeg":      PreviewAudio,
+	"audio/mp4":       PreviewAudio,
+	"audio/aac":       PreviewAudio,
+	"audio/ogg":       PreviewAudio,
+	"audio/flac":      PreviewAudio,
+	"audio/wav":       PreviewAudio,
+	"audio/wave":      PreviewAudio,
+	"video/mp4":       PreviewVideo,
+	"video/webm":      PreviewVideo,
+	"video/ogg":       PreviewVideo,
+}
+
+// extensionTypes gives the type of media the content sniffer can't
+// identify on its own
+var extensionTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".bmp":  "image/bmp",
+	".pdf":  "application/pdf",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/ogg",
+	".flac": "audio/flac",
+	".wav":  "audio/wav",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".ogv":  "video/ogg",
+}
+
+var textExtensions = map[string]bool{
+	".txt": true, ".log": true, ".csv": true, ".json": true, ".xml": true,
+	".yaml": true, ".yml": true, ".toml": true, ".ini": true, ".conf": true,
+	".sh": true, ".bat": true, ".py": true, ".go": true, ".c": true, ".h": true,
+	".cpp": true, ".java": true, ".js": true, ".ts": true, ".css": true,
+	".html": true, ".sql": true, ".rs": true, ".php": true, ".diff": true,
+}
+
+// sniffLen is how much of a file the content sniffer looks at
+const sniffLen = 512
+
+// PreviewKind guesses from the name alone whether a file can be previewed,
+// which is enough to decide whether to offer it. SniffPreview decides.
+func PreviewKind(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == ".md" || ext == ".markdown" {
+		return PreviewMarkdown
+	}
+	if textExtensions[ext] {
+		return PreviewText
+	}
+	return previewTypes[extensionTypes[ext]]
+}
+
+// SniffPreview decides how the file called name, starting with head, can be
+// shown inline and the Content-Type to send it with. The type always comes
+// from the safe list, so a file can't make the browser treat it as anything
+// that runs script. The kind is empty if the file can only be downloaded.
+func SniffPreview(head []byte, name string) (kind, contentType string) {
+	ext := strings.ToLower(filepath.Ext(name))
+	sniffed, _, _ := strings.Cut(http.DetectContentType(head), ";")
+
+	switch {
+	case sniffed == "application/ogg":
+		sniffed = "audio/ogg"
+		if ext == ".ogv" {
+			sniffed = "video/ogg"
+		}
+	case sniffed == "application/octet-stream" || sniffed == "text/plain":
+		// Sniffing only knows media with a distinctive header
+		if t, ok := extensionTypes[ext]; ok && sniffed == "application/octet-stream" {
+			sniffed = t
+		}
+	}
+	if kind, ok := previewTypes[sniffed]; ok {
+		return kind, sniffed
+	}
+
+	if isText(head) {
+		if ext == ".md" || ext == ".markdown" {
+			return PreviewMarkdown, "text/plain; charset=utf-8"
+		}
+		return PreviewText, "text/plain; charset=utf-8"
+	}
+	return "", ""
+}
+
+// isText reports whether head looks like UTF-8 text. A multi-byte
+// character cut off at the end of head doesn't count against it.
+func isText(head []byte) bool {
+	if bytes.IndexByte(head, 0) >= 0 {
+		return false
+	}
+	for len(head) > 0 {
+		r, size := utf8.DecodeRune(head)
+		if r == utf8.RuneError && size == 1 {
+			return len(head) < utf8.UTFMax && !utf8.FullRune(head)
+		}
+		head = head[size:]
+	}
+	return true
+}
+
+// SniffFile runs SniffPreview on the stored file described by meta,
+// opened with key.
+func SniffFile(uploadDir string, meta *FileMetadata, key *encryption.Key) (kind, contentType string, err error) {
+	f, err := OpenFile(uploadDir, meta, key)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", "", err
+	}
+	kind, contentType = SniffPreview(head[:n], meta.OriginalFilename)
+	return kind, contentType, nil
+}
@@ -0,0 +1,115 @@
+package fileops
+
+import (
+	"bytes"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// signatures are formats net/http doesn't sniff, mostly executables and
+// archives, which are what an extension policy cares about
+var signatures = []struct {
+	offset int
+	magic  string
+	mime   string
+}{
+	{0, "MZ", "application/x-msdownload"},
+	{0, "\x7fELF", "application/x-executable"},
+	{0, "\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+	{0, "\xce\xfa\xed\xfe", "application/x-mach-binary"},
+	{0, "#!", "text/x-shellscript"},
+	{0, "7z\xbc\xaf\x27\x1c", "application/x-7z-compressed"},
+	{0, "\xfd7zXZ\x00", "application/x-xz"},
+	{0, "BZh", "application/x-bzip2"},
+	{0, "\x28\xb5\x2f\xfd", "application/zstd"},
+	{257, "ustar", "application/x-tar"},
+}
+
+// DetectContentType returns the MIME type of a file starting with head,
+// without parameters. It knows executables and more archive formats than
+// http.DetectContentType, which it falls back to.
+func DetectContentType(head []byte) string {
+	for _, sig := range signatures {
+		if len(head) >= sig.offset+len(sig.magic) && bytes.Equal(head[sig.offset:sig.offset+len(sig.magic)], []byte(sig.magic)) {
+			return sig.mime
+		}
+	}
+	mime, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	return mime
+}
+
+// executableTypes are content types that run on their own
+var executableTypes = map[string]bool{
+	"application/x-msdownload":  true,
+	"application/x-executable":  true,
+	"application/x-mach-binary": true,
+	"text/x-shellscript":        true,
+}
+
+var executableExtensions = map[string]bool{
+	".exe": true, ".dll": true, ".sys": true, ".scr": true, ".com": true,
+	".msi": true, ".efi": true, ".bin": true, ".elf": true, ".so": true,
+	".run": true, ".appimage": true, ".dylib": true, ".sh": true,
+	".bash": true, ".py": true, ".pl": true, ".rb": true, "": true,
+}
+
+// expectedTypes lists, for extensions whose content can be recognized,
+// the type prefixes their content may have
+var expectedTypes = map[string][]string{
+	".png":  {"image/png"},
+	".jpg":  {"image/jpeg"},
+	".jpeg": {"image/jpeg"},
+	".gif":  {"image/gif"},
+	".webp": {"image/webp"},
+	".bmp":  {"image/bmp"},
+	".ico":  {"image/x-icon"},
+	".pdf":  {"application/pdf"},
+	".zip":  {"application/zip"},
+	".docx": {"application/zip"},
+	".xlsx": {"application/zip"},
+	".pptx": {"application/zip"},
+	".odt":  {"application/zip"},
+	".jar":  {"application/zip"},
+	".apk":  {"application/zip"},
+	".gz":   {"application/x-gzip"},
+	".tgz":  {"application/x-gzip"},
+	".xz":   {"application/x-xz"},
+	".bz2":  {"application/x-bzip2"},
+	".zst":  {"application/zstd"},
+	".7z":   {"application/x-7z-compressed"},
+	".rar":  {"application/x-rar-compressed"},
+	".tar":  {"application/x-tar"},
+	".mp4":  {"video/mp4"},
+	".webm": {"video/webm"},
+	".avi":  {"video/avi"},
+	".wav":  {"audio/wave"},
+	".ogg":  {"application/ogg"},
+	".exe":  {"application/x-msdownload"},
+	".dll":  {"application/x-msdownload"},
+	".txt":  {"text/"},
+	".md":   {"text/"},
+	".csv":  {"text/"},
+	".log":  {"text/"},
+	".json": {"text/", "application/json"},
+}
+
+// TypeMismatch reports whether content of type contentType is suspicious
+// for a file called name: an executable disguised as something else, or a
+// file whose extension promises a format its content doesn't have.
+func TypeMismatch(name, contentType string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	if executableTypes[contentType] {
+		return !executableExtensions[ext]
+	}
+	expected, ok := expectedTypes[ext]
+	if !ok {
+		return false
+	}
+	for _, prefix := range expected {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package fileops
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// DownloadEvent is one attempt to download a file
+type DownloadEvent struct {
+	Time      time.Time `json:"time"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Bytes     int64     `json:"bytes"`
+	Completed bool      `json:"completed"`
+}
+
+// DailyDownloads is the number of downloads started on one day
+type DailyDownloads struct {
+	Day       time.Time
+	Completed int
+	Aborted   int
+}
+
+func statsPath(uploadDir, filename string) string {
+	return filepathJoin(uploadDir, "."+filename+".downloads.jsonl")
+}
+
+// AppendDownloadEvent adds an entry to the download history of filename
+func AppendDownloadEvent(uploadDir, filename string, event DownloadEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if line, err = sealLine(line); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(statsPath(uploadDir, filename), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// GetDownloadEvents returns the download history of filename, newest first
+func GetDownloadEvents(uploadDir, filename string) ([]DownloadEvent, error) {
+	f, err := os.Open(statsPath(uploadDir, filename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []DownloadEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, err := openLine(scanner.Bytes())
+		if err != nil {
+			continue
+		}
+		var event DownloadEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			continue
+		}
+		events = append(events, event)
+	}
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, scanner.Err()
+}
+
+// DownloadsPerDay buckets events into the last days days, oldest first
+func DownloadsPerDay(events []DownloadEvent, days int) []DailyDownloads {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	result := make([]DailyDownloads, days)
+	for i := range result {
+		result[i].Day = today.AddDate(0, 0, i-days+1)
+	}
+	for _, event := range events {
+		t := event.Time.In(now.Location())
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, now.Location())
+		i := int(day.Sub(result[0].Day).Hours()/24 + 0.5)
+		if i < 0 || i >= days {
+			continue
+		}
+		if event.Completed {
+			result[i].Completed++
+		} else {
+			result[i].Aborted++
+		}
+	}
+	return result
+}
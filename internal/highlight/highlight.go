@@ -0,0 +1,119 @@
+// Package highlight renders source text as HTML with syntax highlighting
+// and line numbers, and markdown as HTML. Output only uses CSS classes,
+// never inline styles, and all text is escaped, so it is safe to embed in
+// pages.
+package highlight
+
+import (
+	"bytes"
+	"html/template"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+// Language is an entry of the language picker.
+type Language struct {
+	ID   string // Lexer name; ones Highlight doesn't know stay plain text
+	Name string
+	Ext  string // Extension given to pasted text, with dot
+}
+
+// Languages are offered when pasting text. Highlight accepts any lexer
+// name; these are just the common ones.
+var Languages = []Language{
+	{"plaintext", "纯文本", ".txt"},
+	{"log", "日志", ".log"},
+	{"bash", "Shell", ".sh"},
+	{"go", "Go", ".go"},
+	{"python", "Python", ".py"},
+	{"javascript", "JavaScript", ".js"},
+	{"typescript", "TypeScript", ".ts"},
+	{"java", "Java", ".java"},
+	{"c", "C", ".c"},
+	{"cpp", "C++", ".cpp"},
+	{"csharp", "C#", ".cs"},
+	{"rust", "Rust", ".rs"},
+	{"php", "PHP", ".php"},
+	{"sql", "SQL", ".sql"},
+	{"html", "HTML", ".html"},
+	{"css", "CSS", ".css"},
+	{"json", "JSON", ".json"},
+	{"yaml", "YAML", ".yaml"},
+	{"toml", "TOML", ".toml"},
+	{"ini", "INI", ".ini"},
+	{"xml", "XML", ".xml"},
+	{"nginx", "Nginx", ".conf"},
+	{"docker", "Dockerfile", ".dockerfile"},
+	{"diff", "Diff", ".diff"},
+	{"markdown", "Markdown", ".md"},
+}
+
+// Known reports whether id names one of Languages.
+func Known(id string) bool {
+	_, ok := find(id)
+	return ok
+}
+
+// Extension returns the file extension used for text in language id.
+func Extension(id string) string {
+	if l, ok := find(id); ok {
+		return l.Ext
+	}
+	return ".txt"
+}
+
+func find(id string) (Language, bool) {
+	for _, l := range Languages {
+		if l.ID == id {
+			return l, true
+		}
+	}
+	return Language{}, false
+}
+
+var formatter = html.New(
+	html.WithClasses(true),
+	html.WithLineNumbers(true),
+	html.LineNumbersInTable(true),
+	html.WithLinkableLineNumbers(true, "L"),
+	html.TabWidth(4),
+)
+
+var style = styles.Get("github")
+
+// Highlight renders code in language. If language is empty or unknown the
+// lexer is picked by filename, and failing that the text stays plain.
+func Highlight(code, language, filename string) (template.HTML, error) {
+	var lexer chroma.Lexer
+	if language != "" {
+		lexer = lexers.Get(language)
+	}
+	if lexer == nil && filename != "" {
+		lexer = lexers.Match(filename)
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	lexer = chroma.Coalesce(lexer)
+
+	iterator, err := lexer.Tokenise(nil, code)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := formatter.Format(&buf, style, iterator); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// CSS returns the stylesheet for the classes Highlight emits.
+func CSS() template.CSS {
+	var b strings.Builder
+	formatter.WriteCSS(&b, style)
+	return template.CSS(b.String())
+}
@@ -0,0 +1,22 @@
+package highlight
+
+import (
+	"bytes"
+	"html/template"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// markdown leaves goldmark's HTML renderer in its default safe mode: raw
+// HTML in the source is dropped and javascript: style links are emptied.
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// Markdown renders GitHub flavoured markdown as HTML that is safe to embed.
+func Markdown(source string) (template.HTML, error) {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(source), &buf); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
@@ -0,0 +1,306 @@
+// Package mailer sends templated notification emails over SMTP.
+package mailer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Message kinds
+const (
+	KindShare      = "share"
+	KindDownloaded = "downloaded"
+	KindExpiring   = "expiring"
+	KindReceived   = "received"
+)
+
+const DefaultLocale = "zh-CN"
+
+type Config struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	// StartTLS upgrades the connection before authenticating. Disable it
+	// only for a local SMTP sink.
+	StartTLS bool
+}
+
+// Data is passed to the message templates.
+type Data struct {
+	SiteTitle   string
+	Filename    string
+	Description string
+	Link        string
+	Expiration  time.Time
+	Time        time.Time
+	IP          string
+	Request     string // Title of the upload request a file was sent to
+}
+
+type Mailer struct {
+	config Config
+	from   *mail.Address
+}
+
+// New validates config. A nil Mailer is returned, without error, when no
+// SMTP host is configured; its methods are no-ops.
+func New(config Config) (*Mailer, error) {
+	if config.Host == "" {
+		return nil, nil
+	}
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %w", config.From, err)
+	}
+	return &Mailer{config: config, from: from}, nil
+}
+
+// Enabled reports whether mail can be sent.
+func (m *Mailer) Enabled() bool {
+	return m != nil
+}
+
+// ValidAddress reports whether addr is a single plain email address.
+func ValidAddress(addr string) bool {
+	parsed, err := mail.ParseAddress(addr)
+	return err == nil && parsed.Address == addr
+}
+
+// Locale picks the best supported locale for an Accept-Language header.
+func Locale(acceptLanguage string) string {
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		switch {
+		case strings.HasPrefix(strings.ToLower(tag), "zh"):
+			return "zh-CN"
+		case strings.HasPrefix(strings.ToLower(tag), "en"):
+			return "en"
+		}
+	}
+	return DefaultLocale
+}
+
+// Send renders the kind message in locale and delivers it to to.
+func (m *Mailer) Send(to, kind, locale string, data Data) error {
+	if m == nil {
+		return nil
+	}
+	subject, body, err := render(kind, locale, data)
+	if err != nil {
+		return err
+	}
+	rcpt, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid recipient %q: %w", to, err)
+	}
+	return m.deliver(rcpt, buildMessage(m.from, rcpt, subject, body))
+}
+
+func (m *Mailer) deliver(rcpt *mail.Address, msg []byte) error {
+	addr := net.JoinHostPort(m.config.Host, strconv.Itoa(m.config.Port))
+	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Minute))
+
+	c, err := smtp.NewClient(conn, m.config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if m.config.StartTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: m.config.Host}); err != nil {
+			return fmt.Errorf("starttls: %w", err)
+		}
+	}
+	if m.config.Username != "" {
+		auth := smtp.PlainAuth("", m.config.Username, m.config.Password, m.config.Host)
+		if err := c.Auth(auth); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+	if err := c.Mail(m.from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(rcpt.Address); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func buildMessage(from, to *mail.Address, subject, body string) []byte {
+	var buf bytes.Buffer
+	header := func(k, v string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+	}
+	header("From", from.String())
+	header("To", to.String())
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	buf.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	qp.Close()
+	return buf.Bytes()
+}
+
+type message struct {
+	subject string
+	body    string
+}
+
+// messages holds the subject and body templates per locale and kind.
+var messages = map[string]map[string]message{
+	"zh-CN": {
+		KindShare: {
+			subject: "有人通过{{.SiteTitle}}向您分享了文件：{{.Filename}}",
+			body: `您好，
+
+有人通过{{.SiteTitle}}向您分享了文件「{{.Filename}}」。
+{{if .Description}}
+描述：{{.Description}}
+{{end}}
+下载地址：{{.Link}}
+{{if not .Expiration.IsZero}}
+该链接将于 {{.Expiration.Format "2006-01-02 15:04"}} 失效。
+{{end}}`,
+		},
+		KindDownloaded: {
+			subject: "您的文件已被下载：{{.Filename}}",
+			body: `您好，
+
+您在{{.SiteTitle}}上传的文件「{{.Filename}}」已于 {{.Time.Format "2006-01-02 15:04"}} 被下载（IP：{{.IP}}）。
+
+文件地址：{{.Link}}
+`,
+		},
+		KindReceived: {
+			subject: "您的上传请求「{{.Request}}」收到了文件：{{.Filename}}",
+			body: `您好，
+
+有人于 {{.Time.Format "2006-01-02 15:04"}} 通过您在{{.SiteTitle}}创建的上传请求「{{.Request}}」上传了文件「{{.Filename}}」（IP：{{.IP}}）。
+{{if .Description}}
+留言：{{.Description}}
+{{end}}
+文件地址：{{.Link}}
+`,
+		},
+		KindExpiring: {
+			subject: "您的文件即将过期：{{.Filename}}",
+			body: `您好，
+
+您在{{.SiteTitle}}上传的文件「{{.Filename}}」将于 {{.Expiration.Format "2006-01-02 15:04"}} 过期并被自动删除。
+
+文件地址：{{.Link}}
+`,
+		},
+	},
+	"en": {
+		KindShare: {
+			subject: "A file was shared with you on {{.SiteTitle}}: {{.Filename}}",
+			body: `Hello,
+
+Someone shared the file "{{.Filename}}" with you on {{.SiteTitle}}.
+{{if .Description}}
+Description: {{.Description}}
+{{end}}
+Download: {{.Link}}
+{{if not .Expiration.IsZero}}
+The link expires on {{.Expiration.Format "2006-01-02 15:04"}}.
+{{end}}`,
+		},
+		KindDownloaded: {
+			subject: "Your file was downloaded: {{.Filename}}",
+			body: `Hello,
+
+Your file "{{.Filename}}" on {{.SiteTitle}} was downloaded at {{.Time.Format "2006-01-02 15:04"}} (IP: {{.IP}}).
+
+Link: {{.Link}}
+`,
+		},
+		KindReceived: {
+			subject: "Your upload request \"{{.Request}}\" received a file: {{.Filename}}",
+			body: `Hello,
+
+The file "{{.Filename}}" was sent to your upload request "{{.Request}}" on {{.SiteTitle}} at {{.Time.Format "2006-01-02 15:04"}} (IP: {{.IP}}).
+{{if .Description}}
+Message: {{.Description}}
+{{end}}
+Link: {{.Link}}
+`,
+		},
+		KindExpiring: {
+			subject: "Your file is about to expire: {{.Filename}}",
+			body: `Hello,
+
+Your file "{{.Filename}}" on {{.SiteTitle}} expires on {{.Expiration.Format "2006-01-02 15:04"}} and will then be deleted.
+
+Link: {{.Link}}
+`,
+		},
+	},
+}
+
+func render(kind, locale string, data Data) (string, string, error) {
+	byKind, ok := messages[locale]
+	if !ok {
+		byKind = messages[DefaultLocale]
+	}
+	msg, ok := byKind[kind]
+	if !ok {
+		return "", "", fmt.Errorf("unknown message kind %q", kind)
+	}
+
+	subject, err := execute(msg.subject, data)
+	if err != nil {
+		return "", "", err
+	}
+	body, err := execute(msg.body, data)
+	if err != nil {
+		return "", "", err
+	}
+	// Subjects must stay on one header line
+	subject = strings.Join(strings.Fields(subject), " ")
+	return subject, body, nil
+}
+
+func execute(text string, data Data) (string, error) {
+	tmpl, err := template.New("").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,109 @@
+package mailer
+
+import (
+	"bufio"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+// smtpSink accepts one message over SMTP and sends its recipient and
+// content to the returned channel
+func smtpSink(t *testing.T) (*net.TCPAddr, <-chan [2]string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received := make(chan [2]string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { io.WriteString(conn, s+"\r\n") }
+		reply("220 sink")
+		var rcpt string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 sink")
+			case strings.HasPrefix(cmd, "RCPT TO:"):
+				rcpt = strings.Trim(strings.TrimSpace(line)[len("RCPT TO:"):], "<>")
+				reply("250 OK")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(strings.TrimPrefix(line, "."))
+				}
+				received <- [2]string{rcpt, data.String()}
+				reply("250 OK")
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr), received
+}
+
+func TestSend(t *testing.T) {
+	addr, received := smtpSink(t)
+	m, err := New(Config{Host: addr.IP.String(), Port: addr.Port, From: "FileStation <files@example.com>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := Data{SiteTitle: "FileStation", Filename: "report.pdf", Link: "https://files.example.com/download/abc_report.pdf"}
+	if err := m.Send("someone@example.com", KindShare, "en", data); err != nil {
+		t.Fatal(err)
+	}
+
+	got := <-received
+	if got[0] != "someone@example.com" {
+		t.Errorf("recipient = %q", got[0])
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(got[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from := msg.Header.Get("From"); !strings.Contains(from, "files@example.com") {
+		t.Errorf("From = %q", from)
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "Download: "+data.Link) {
+		t.Errorf("body does not contain the link:\n%s", body)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if m, err := New(Config{}); m.Enabled() || err != nil {
+		t.Errorf("New without a host = %v, %v, want a disabled mailer", m, err)
+	}
+	if _, err := New(Config{Host: "localhost", From: "not an address"}); err == nil {
+		t.Error("New accepted an invalid sender")
+	}
+}
@@ -0,0 +1,343 @@
+// Package quota limits how much the stored files may take: in total, per
+// user, per client IP, and how much free disk space must be left.
+package quota
+
+import (
+	"filestation/internal/fileops"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// diskCheckInterval is how many bytes an upload may write between two
+// checks of the free disk space
+const diskCheckInterval = 16 << 20
+
+// Limits are the quotas in bytes. Zero means unlimited.
+type Limits struct {
+	Total   int64 // All stored files
+	PerUser int64 // Files uploaded by one owner token
+	PerIP   int64 // Files uploaded from one client IP
+	MinFree int64 // Disk space that must stay free
+}
+
+// Enabled reports whether any limit is set
+func (l Limits) Enabled() bool {
+	return l.Total > 0 || l.PerUser > 0 || l.PerIP > 0 || l.MinFree > 0
+}
+
+// Scopes of an ExceededError
+const (
+	ScopeTotal = "total"
+	ScopeUser  = "user"
+	ScopeIP    = "ip"
+	ScopeDisk  = "disk"
+)
+
+// ExceededError is returned when storing a file would exceed a limit
+type ExceededError struct {
+	Scope string
+	Used  int64 // Bytes already used, or free on disk for ScopeDisk
+	Limit int64
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("%s quota exceeded: %d of %d bytes", e.Scope, e.Used, e.Limit)
+}
+
+// Message describes the error to the uploader
+func (e *ExceededError) Message() string {
+	switch e.Scope {
+	case ScopeUser:
+		return fmt.Sprintf("存储空间不足：您的配额为 %s，已使用 %s", fileops.FormatSize(e.Limit), fileops.FormatSize(e.Used))
+	case ScopeIP:
+		return fmt.Sprintf("存储空间不足：您的网络地址的配额为 %s，已使用 %s", fileops.FormatSize(e.Limit), fileops.FormatSize(e.Used))
+	case ScopeDisk:
+		return "存储空间不足：服务器磁盘空间不够，请稍后重试"
+	}
+	return "存储空间不足：服务器存储已满，请稍后重试"
+}
+
+// Entry is the usage of one user or IP
+type Entry struct {
+	Key   string
+	Files int
+	Bytes int64
+}
+
+// Usage is what the stored files take, largest uploaders first
+type Usage struct {
+	Total int64
+	Files int
+	Users []Entry
+	IPs   []Entry
+	// Free is the free disk space, -1 when unknown
+	Free int64
+}
+
+// Manager checks uploads against the limits. Usage is read from the upload
+// directory when an upload starts; uploads in progress are counted by
+// their reservations.
+type Manager struct {
+	limits Limits
+	dir    string
+
+	mu       sync.Mutex
+	byUser   map[string]int64
+	byIP     map[string]int64
+	total    int64
+	reserved map[*Reservation]bool
+}
+
+// New returns a Manager for the files in dir
+func New(dir string, limits Limits) *Manager {
+	return &Manager{limits: limits, dir: dir, reserved: make(map[*Reservation]bool)}
+}
+
+// Limits returns the configured limits
+func (m *Manager) Limits() Limits {
+	return m.limits
+}
+
+// Check reports whether size more bytes from user and ip would fit,
+// without reserving them. It is meant to refuse an upload before its body
+// is read.
+func (m *Manager) Check(user, ip string, size int64) error {
+	if !m.limits.Enabled() {
+		return nil
+	}
+	if err := m.refresh(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkLocked(user, normalizeIP(ip), size); err != nil {
+		return err
+	}
+	return m.checkDisk(size)
+}
+
+// Reserve sets size bytes aside for an upload by user from ip. The
+// reservation grows as the file is written, see Grow, and must be
+// released once the file is stored or has failed.
+func (m *Manager) Reserve(user, ip string, size int64) (*Reservation, error) {
+	res := &Reservation{m: m, user: user, ip: normalizeIP(ip), reserved: size}
+	if !m.limits.Enabled() {
+		return res, nil
+	}
+	if err := m.refresh(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkLocked(res.user, res.ip, size); err != nil {
+		return nil, err
+	}
+	if err := m.checkDisk(size); err != nil {
+		return nil, err
+	}
+	m.reserved[res] = true
+	return res, nil
+}
+
+// Usage returns what the stored files take per user and IP
+func (m *Manager) Usage() (*Usage, error) {
+	files, err := fileops.GetFiles(m.dir)
+	if err != nil {
+		return nil, err
+	}
+	u := &Usage{Files: len(files), Free: freeSpace(m.dir)}
+	users := make(map[string]*Entry)
+	ips := make(map[string]*Entry)
+	add := func(entries map[string]*Entry, key string, size int64) {
+		if entries[key] == nil {
+			entries[key] = &Entry{Key: key}
+		}
+		entries[key].Files++
+		entries[key].Bytes += size
+	}
+	for _, f := range files {
+		size := storedSize(f)
+		u.Total += size
+		add(users, f.Owner, size)
+		add(ips, normalizeIP(f.Uploader.IP), size)
+	}
+	u.Users, u.IPs = sorted(users), sorted(ips)
+	return u, nil
+}
+
+func sorted(entries map[string]*Entry) []Entry {
+	list := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Bytes != list[j].Bytes {
+			return list[i].Bytes > list[j].Bytes
+		}
+		return list[i].Key < list[j].Key
+	})
+	return list
+}
+
+// refresh reads the usage of the stored files
+func (m *Manager) refresh() error {
+	files, err := fileops.GetFiles(m.dir)
+	if err != nil {
+		return err
+	}
+	byUser := make(map[string]int64)
+	byIP := make(map[string]int64)
+	var total int64
+	for _, f := range files {
+		size := storedSize(f)
+		total += size
+		byUser[f.Owner] += size
+		byIP[normalizeIP(f.Uploader.IP)] += size
+	}
+	m.mu.Lock()
+	m.byUser, m.byIP, m.total = byUser, byIP, total
+	m.mu.Unlock()
+	return nil
+}
+
+// checkLocked reports whether extra more bytes from user and ip fit next
+// to the stored files and the reservations
+func (m *Manager) checkLocked(user, ip string, extra int64) error {
+	total, byUser, byIP := m.total, m.byUser[user], m.byIP[ip]
+	for res := range m.reserved {
+		size := res.size()
+		total += size
+		if res.user == user {
+			byUser += size
+		}
+		if res.ip == ip {
+			byIP += size
+		}
+	}
+	switch {
+	case m.limits.Total > 0 && total+extra > m.limits.Total:
+		return &ExceededError{Scope: ScopeTotal, Used: total, Limit: m.limits.Total}
+	case m.limits.PerUser > 0 && user != "" && byUser+extra > m.limits.PerUser:
+		return &ExceededError{Scope: ScopeUser, Used: byUser, Limit: m.limits.PerUser}
+	case m.limits.PerIP > 0 && ip != "" && byIP+extra > m.limits.PerIP:
+		return &ExceededError{Scope: ScopeIP, Used: byIP, Limit: m.limits.PerIP}
+	}
+	return nil
+}
+
+// checkDisk reports whether need more bytes can be written while leaving
+// the minimum free space
+func (m *Manager) checkDisk(need int64) error {
+	if m.limits.MinFree <= 0 {
+		return nil
+	}
+	if free := freeSpace(m.dir); free >= 0 && free-need < m.limits.MinFree {
+		return &ExceededError{Scope: ScopeDisk, Used: free, Limit: m.limits.MinFree}
+	}
+	return nil
+}
+
+// freeSpace returns the bytes available on the volume holding dir, or -1
+// when it can't be read
+func freeSpace(dir string) int64 {
+	free, err := fileops.DiskFree(dir)
+	if err != nil {
+		return -1
+	}
+	return int64(free)
+}
+
+// Reservation is the space set aside for an upload in progress. It
+// implements fileops.Quota.
+type Reservation struct {
+	m        *Manager
+	user, ip string
+
+	reserved    int64 // Guarded by m.mu
+	written     int64 // Guarded by m.mu
+	diskChecked int64 // Guarded by m.mu
+}
+
+// size is what the upload takes or is expected to take
+func (r *Reservation) size() int64 {
+	return max(r.reserved, r.written)
+}
+
+// Grow is told how many bytes of the upload are on disk and refuses when
+// the file outgrows the limits or the disk fills up.
+func (r *Reservation) Grow(written int64) error {
+	m := r.m
+	if !m.limits.Enabled() {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if written > r.size() {
+		if err := m.checkLocked(r.user, r.ip, written-r.size()); err != nil {
+			return err
+		}
+	}
+	if written-r.diskChecked >= diskCheckInterval {
+		// The disk may also be filled by other uploads or programs
+		if err := m.checkDisk(max(r.reserved-written, 0)); err != nil {
+			return err
+		}
+		r.diskChecked = written
+	}
+	r.written = written
+	return nil
+}
+
+// Release frees the reservation. The file, if it was stored, counts as
+// written from now on.
+func (r *Reservation) Release(stored bool) {
+	m := r.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.reserved[r] {
+		return
+	}
+	delete(m.reserved, r)
+	if stored {
+		m.total += r.written
+		m.byUser[r.user] += r.written
+		m.byIP[r.ip] += r.written
+	}
+}
+
+// storedSize is what a file takes on disk
+func storedSize(f fileops.FileMetadata) int64 {
+	if f.StoredSize > 0 {
+		return f.StoredSize
+	}
+	return f.Size
+}
+
+// normalizeIP drops the port older uploads recorded along with the IP
+func normalizeIP(ip string) string {
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		return host
+	}
+	return ip
+}
+
+// ParseSize parses a size such as "500MB", "10G" or "1048576". Units are
+// powers of 1024.
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	number := strings.TrimRight(strings.TrimSuffix(s, "B"), "KMGT")
+	unit := strings.TrimSuffix(s[len(number):], "B")
+	n, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || n < 0 || len(unit) > 1 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	shift := map[string]uint{"": 0, "K": 10, "M": 20, "G": 30, "T": 40}[unit]
+	return int64(n * float64(int64(1)<<shift)), nil
+}
@@ -0,0 +1,128 @@
+package quota
+
+import (
+	"bytes"
+	"errors"
+	"filestation/internal/fileops"
+	"os"
+	"testing"
+	"time"
+)
+
+func save(t *testing.T, dir, owner, ip string, size int, q fileops.Quota) error {
+	t.Helper()
+	meta := fileops.FileMetadata{
+		Owner:          owner,
+		Uploader:       fileops.ClientInfo{IP: ip},
+		ExpirationTime: time.Now().Add(time.Hour),
+	}
+	_, err := fileops.SaveFile(bytes.NewReader(make([]byte, size)), "data.bin", dir, meta, fileops.SaveOptions{Quota: q})
+	return err
+}
+
+func scope(err error) string {
+	var exceeded *ExceededError
+	if errors.As(err, &exceeded) {
+		return exceeded.Scope
+	}
+	return ""
+}
+
+func TestReserve(t *testing.T) {
+	dir := t.TempDir()
+	m := New(dir, Limits{Total: 1000, PerUser: 600, PerIP: 500})
+	if err := save(t, dir, "alice", "10.0.0.1:1234", 400, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, user, ip string
+		size           int64
+		scope          string
+	}{
+		{"fits", "alice", "10.0.0.2", 200, ""},
+		{"user", "alice", "10.0.0.2", 201, ScopeUser},
+		// The port recorded by older uploads is ignored
+		{"ip", "bob", "10.0.0.1", 101, ScopeIP},
+		{"total", "bob", "10.0.0.3", 601, ScopeTotal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := m.Reserve(tt.user, tt.ip, tt.size)
+			if got := scope(err); got != tt.scope {
+				t.Fatalf("Reserve(%d) = %v, want scope %q", tt.size, err, tt.scope)
+			}
+			if res != nil {
+				res.Release(false)
+			}
+		})
+	}
+}
+
+func TestReservationsCount(t *testing.T) {
+	m := New(t.TempDir(), Limits{PerUser: 100})
+	first, err := m.Reserve("alice", "", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Reserve("alice", "", 60); scope(err) != ScopeUser {
+		t.Fatalf("second reservation: got %v, want user quota exceeded", err)
+	}
+	first.Release(false)
+	second, err := m.Reserve("alice", "", 60)
+	if err != nil {
+		t.Fatalf("after release: %v", err)
+	}
+	second.Release(false)
+}
+
+func TestGrowAbortsSave(t *testing.T) {
+	dir := t.TempDir()
+	m := New(dir, Limits{PerUser: 100 << 10})
+	// The upload claims less than it sends
+	res, err := m.Reserve("alice", "10.0.0.1", 10<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = save(t, dir, "alice", "10.0.0.1", 200<<10, res)
+	res.Release(err == nil)
+	if scope(err) != ScopeUser {
+		t.Fatalf("SaveFile = %v, want user quota exceeded", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("left %d files behind after the aborted upload", len(entries))
+	}
+
+	usage, err := m.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Total != 0 {
+		t.Errorf("usage = %d after the aborted upload, want 0", usage.Total)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"", 0},
+		{"1024", 1024},
+		{"10K", 10 << 10},
+		{"500MB", 500 << 20},
+		{"1.5g", 3 << 29},
+		{"2TB", 2 << 40},
+	}
+	for _, tt := range tests {
+		if got, err := ParseSize(tt.in); err != nil || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"MB", "-1G", "10XB", "1KMB"} {
+		if _, err := ParseSize(in); err == nil {
+			t.Errorf("ParseSize(%q) succeeded, want an error", in)
+		}
+	}
+}
@@ -0,0 +1,449 @@
+// Package ratelimit limits how much a client IP may use a route: requests
+// or bytes per time window, and requests in progress at once.
+package ratelimit
+
+import (
+	"filestation/internal/fileops"
+	"filestation/internal/quota"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of rules
+const (
+	KindRequests   = "requests"   // Requests per window
+	KindBytes      = "bytes"      // Bytes received and sent per window
+	KindConcurrent = "concurrent" // Requests in progress at once
+)
+
+// concurrentRetry is the Retry-After sent when too many requests are in
+// progress; unlike a window, there is no telling when one finishes.
+const concurrentRetry = 30 * time.Second
+
+// cleanupInterval is how often counters of clients gone quiet are dropped
+const cleanupInterval = 5 * time.Minute
+
+// Rule limits the requests to a route from one client IP
+type Rule struct {
+	// Pattern is the ServeMux pattern of the route, e.g. "POST /upload"
+	// or "GET /download/{filename}". Without a method it applies to
+	// every method of the path.
+	Pattern string
+	Kind    string
+	Limit   int64
+	Window  time.Duration // Unused for KindConcurrent
+}
+
+// ParseRule parses a rule written as "<pattern>=<limit>", where the limit
+// is "20/hour" requests, "10GB/day" bytes or "3 concurrent" requests. The
+// window is a unit (second, minute, hour, day) or a duration like "30m".
+func ParseRule(s string) (Rule, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return Rule{}, fmt.Errorf("invalid rate limit %q, want <pattern>=<limit>", s)
+	}
+	rule := Rule{Pattern: strings.Join(strings.Fields(s[:i]), " ")}
+	limit := strings.ToLower(strings.TrimSpace(s[i+1:]))
+	if rule.Pattern == "" {
+		return Rule{}, fmt.Errorf("invalid rate limit %q: missing route pattern", s)
+	}
+
+	if n, ok := strings.CutSuffix(limit, "concurrent"); ok {
+		count, err := strconv.ParseInt(strings.TrimSpace(n), 10, 64)
+		if err != nil || count <= 0 {
+			return Rule{}, fmt.Errorf("invalid rate limit %q: bad concurrency", s)
+		}
+		rule.Kind, rule.Limit = KindConcurrent, count
+		return rule, nil
+	}
+
+	amount, window, ok := strings.Cut(limit, "/")
+	if !ok {
+		return Rule{}, fmt.Errorf("invalid rate limit %q, want a limit like 20/hour, 10GB/day or 3 concurrent", s)
+	}
+	var err error
+	if rule.Window, err = parseWindow(strings.TrimSpace(window)); err != nil {
+		return Rule{}, fmt.Errorf("invalid rate limit %q: %w", s, err)
+	}
+	amount = strings.TrimSpace(amount)
+	if strings.TrimRight(amount, "0123456789") == "" {
+		rule.Kind = KindRequests
+		rule.Limit, err = strconv.ParseInt(amount, 10, 64)
+	} else {
+		rule.Kind = KindBytes
+		rule.Limit, err = quota.ParseSize(amount)
+	}
+	if err != nil || rule.Limit <= 0 {
+		return Rule{}, fmt.Errorf("invalid rate limit %q: bad amount %q", s, amount)
+	}
+	return rule, nil
+}
+
+func parseWindow(s string) (time.Duration, error) {
+	switch s {
+	case "s", "sec", "second":
+		return time.Second, nil
+	case "m", "min", "minute":
+		return time.Minute, nil
+	case "h", "hour":
+		return time.Hour, nil
+	case "d", "day":
+		return 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("bad window %q", s)
+	}
+	return d, nil
+}
+
+func (r Rule) String() string {
+	switch r.Kind {
+	case KindConcurrent:
+		return fmt.Sprintf("%s=%d concurrent", r.Pattern, r.Limit)
+	case KindBytes:
+		return fmt.Sprintf("%s=%s/%s", r.Pattern, fileops.FormatSize(r.Limit), formatWindow(r.Window))
+	}
+	return fmt.Sprintf("%s=%d/%s", r.Pattern, r.Limit, formatWindow(r.Window))
+}
+
+func formatWindow(d time.Duration) string {
+	switch d {
+	case time.Second:
+		return "second"
+	case time.Minute:
+		return "minute"
+	case time.Hour:
+		return "hour"
+	case 24 * time.Hour:
+		return "day"
+	}
+	return d.String()
+}
+
+// Description describes the limit to admins
+func (r Rule) Description() string {
+	if r.Kind == KindConcurrent {
+		return fmt.Sprintf("同时 %d 个请求", r.Limit)
+	}
+	per := map[time.Duration]string{
+		time.Second:    "每秒",
+		time.Minute:    "每分钟",
+		time.Hour:      "每小时",
+		24 * time.Hour: "每天",
+	}[r.Window]
+	if per == "" {
+		per = "每 " + r.Window.String()
+	}
+	if r.Kind == KindBytes {
+		return fmt.Sprintf("%s %s", per, fileops.FormatSize(r.Limit))
+	}
+	return fmt.Sprintf("%s %d 次请求", per, r.Limit)
+}
+
+// matches reports whether the rule applies to the route with the given
+// ServeMux pattern
+func (r Rule) matches(pattern string) bool {
+	if r.Pattern == pattern {
+		return true
+	}
+	_, path, ok := strings.Cut(pattern, " ")
+	return ok && !strings.Contains(r.Pattern, " ") && r.Pattern == path
+}
+
+// LimitedError is returned when a request exceeds a rule
+type LimitedError struct {
+	Rule       Rule
+	RetryAfter time.Duration
+}
+
+func (e *LimitedError) Error() string {
+	return fmt.Sprintf("rate limit %s exceeded, retry after %s", e.Rule, e.RetryAfter)
+}
+
+// Message describes the error to the client
+func (e *LimitedError) Message() string {
+	wait := formatWait(e.RetryAfter)
+	switch e.Rule.Kind {
+	case KindConcurrent:
+		return fmt.Sprintf("同时进行的请求过多（最多 %d 个），请等待当前传输完成后重试", e.Rule.Limit)
+	case KindBytes:
+		return fmt.Sprintf("传输流量已达上限，请 %s后重试", wait)
+	}
+	return fmt.Sprintf("请求过于频繁，请 %s后重试", wait)
+}
+
+func formatWait(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%d 秒", int((d+time.Second-1)/time.Second))
+	}
+	minutes := int((d + time.Minute - 1) / time.Minute)
+	switch {
+	case minutes < 60:
+		return fmt.Sprintf("%d 分钟", minutes)
+	case minutes%60 == 0:
+		return fmt.Sprintf("%d 小时", minutes/60)
+	}
+	return fmt.Sprintf("%d 小时 %d 分钟", minutes/60, minutes%60)
+}
+
+type counterKey struct {
+	rule int
+	ip   string
+}
+
+type counter struct {
+	start   time.Time // Start of the current window
+	used    int64     // Requests or bytes in the current window
+	active  int64     // Requests in progress
+	refused int64     // Requests refused in the current window
+}
+
+// Counter is the state of one rule for one client IP
+type Counter struct {
+	Rule    Rule
+	IP      string
+	Used    int64     // Requests, bytes or requests in progress
+	Refused int64     // Requests refused since the window started
+	ResetAt time.Time // Zero for KindConcurrent
+	Blocked bool
+}
+
+// Limiter enforces rules per client IP. Counters are kept in memory and
+// start over when the server restarts.
+type Limiter struct {
+	rules []Rule
+
+	mu          sync.Mutex
+	counters    map[counterKey]*counter
+	lastCleanup time.Time
+}
+
+// New returns a Limiter enforcing rules
+func New(rules []Rule) *Limiter {
+	return &Limiter{rules: rules, counters: make(map[counterKey]*counter), lastCleanup: time.Now()}
+}
+
+// Enabled reports whether any rule is configured
+func (l *Limiter) Enabled() bool {
+	return len(l.rules) > 0
+}
+
+// Rules returns the configured rules
+func (l *Limiter) Rules() []Rule {
+	return l.rules
+}
+
+// Ticket is a request let through by Acquire. Its bytes are counted with
+// Transfer as they go, and Done must be called when it has finished.
+type Ticket struct {
+	l       *Limiter
+	keys    []counterKey
+	bytes   bool          // Whether a byte rule applies
+	limited *LimitedError // The rule that cut the transfer off
+}
+
+// Acquire checks a request from ip to the route with the given ServeMux
+// pattern against every rule matching it, and counts it if it is allowed.
+func (l *Limiter) Acquire(pattern, ip string) (*Ticket, error) {
+	t := &Ticket{l: l}
+	if !l.Enabled() {
+		return t, nil
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastCleanup) >= cleanupInterval {
+		l.cleanup(now)
+	}
+
+	var counters []*counter
+	var limited *LimitedError
+	for i, rule := range l.rules {
+		if !rule.matches(pattern) {
+			continue
+		}
+		key := counterKey{i, ip}
+		c := l.counters[key]
+		if c == nil {
+			c = &counter{start: now}
+			l.counters[key] = c
+		}
+		if rule.Kind != KindConcurrent && now.Sub(c.start) >= rule.Window {
+			c.start, c.used, c.refused = now, 0, 0
+		}
+		t.keys = append(t.keys, key)
+		t.bytes = t.bytes || rule.Kind == KindBytes
+		counters = append(counters, c)
+
+		var retry time.Duration
+		switch {
+		case rule.Kind == KindConcurrent && c.active >= rule.Limit:
+			retry = concurrentRetry
+		case rule.Kind != KindConcurrent && c.used >= rule.Limit:
+			retry = c.start.Add(rule.Window).Sub(now)
+		default:
+			continue
+		}
+		c.refused++
+		// The client has to wait for the rule that is blocked longest
+		if limited == nil || retry > limited.RetryAfter {
+			limited = &LimitedError{Rule: rule, RetryAfter: retry}
+		}
+	}
+	if limited != nil {
+		return nil, limited
+	}
+
+	for i, c := range counters {
+		c.active++
+		if l.rules[t.keys[i].rule].Kind == KindRequests {
+			c.used++
+		}
+	}
+	return t, nil
+}
+
+// Transfer counts n more bytes received or sent by the request against
+// the byte rules while it is in progress, so that one large transfer
+// can't run past them. It returns how many of the n bytes are allowed,
+// with a *LimitedError when that is fewer; the request should then be cut
+// off.
+func (t *Ticket) Transfer(n int64) (int64, error) {
+	if !t.bytes {
+		return n, nil
+	}
+	now := time.Now()
+	l := t.l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	allowed := n
+	var limiting *counter
+	var limited *LimitedError
+	for _, key := range t.keys {
+		rule := l.rules[key.rule]
+		c := l.counters[key]
+		if c == nil || rule.Kind != KindBytes {
+			continue
+		}
+		if now.Sub(c.start) >= rule.Window {
+			c.start, c.used, c.refused = now, 0, 0
+		}
+		if left := max(rule.Limit-c.used, 0); left < allowed {
+			allowed, limiting = left, c
+			limited = &LimitedError{Rule: rule, RetryAfter: c.start.Add(rule.Window).Sub(now)}
+		}
+	}
+	for _, key := range t.keys {
+		if c := l.counters[key]; c != nil && l.rules[key.rule].Kind == KindBytes {
+			c.used += allowed
+		}
+	}
+	if limited == nil {
+		return allowed, nil
+	}
+	if t.limited == nil {
+		// A cut off request counts as refused once
+		limiting.refused++
+		t.limited = limited
+	}
+	return allowed, limited
+}
+
+// Limited returns the error of the rule that cut the request off, or nil
+func (t *Ticket) Limited() *LimitedError {
+	if !t.bytes {
+		return nil
+	}
+	l := t.l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return t.limited
+}
+
+// Done ends the request
+func (t *Ticket) Done() {
+	if len(t.keys) == 0 {
+		return
+	}
+	l := t.l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range t.keys {
+		if c := l.counters[key]; c != nil {
+			c.active--
+		}
+	}
+}
+
+// Counters returns the state of every client IP the rules have seen
+// within their current window, blocked ones first
+func (l *Limiter) Counters() []Counter {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cleanup(now)
+
+	list := make([]Counter, 0, len(l.counters))
+	for key, c := range l.counters {
+		rule := l.rules[key.rule]
+		entry := Counter{Rule: rule, IP: key.ip, Refused: c.refused}
+		if rule.Kind == KindConcurrent {
+			entry.Used = c.active
+			entry.Blocked = c.active >= rule.Limit
+		} else {
+			entry.Used = c.used
+			entry.ResetAt = c.start.Add(rule.Window)
+			entry.Blocked = c.used >= rule.Limit
+		}
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Blocked != b.Blocked {
+			return a.Blocked
+		}
+		if a.IP != b.IP {
+			return a.IP < b.IP
+		}
+		return a.Rule.String() < b.Rule.String()
+	})
+	return list
+}
+
+// Unblock starts the windows of every rule over for ip. Requests in
+// progress still count towards concurrency limits.
+func (l *Limiter) Unblock(ip string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	found := false
+	for key, c := range l.counters {
+		if key.ip != ip {
+			continue
+		}
+		c.start, c.used, c.refused = now, 0, 0
+		found = true
+	}
+	return found
+}
+
+// cleanup drops the counters of idle clients whose window has passed
+func (l *Limiter) cleanup(now time.Time) {
+	l.lastCleanup = now
+	for key, c := range l.counters {
+		rule := l.rules[key.rule]
+		if c.active > 0 {
+			continue
+		}
+		if rule.Kind == KindConcurrent || now.Sub(c.start) >= rule.Window {
+			delete(l.counters, key)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Rule
+	}{
+		{"POST /upload=20/hour", Rule{Pattern: "POST /upload", Kind: KindRequests, Limit: 20, Window: time.Hour}},
+		{"GET  /download/{filename} = 10GB/day", Rule{Pattern: "GET /download/{filename}", Kind: KindBytes, Limit: 10 << 30, Window: 24 * time.Hour}},
+		{"/download/{filename}=3 concurrent", Rule{Pattern: "/download/{filename}", Kind: KindConcurrent, Limit: 3}},
+		{"POST /paste=5/30m", Rule{Pattern: "POST /paste", Kind: KindRequests, Limit: 5, Window: 30 * time.Minute}},
+	}
+	for _, tt := range tests {
+		if got, err := ParseRule(tt.in); err != nil || got != tt.want {
+			t.Errorf("ParseRule(%q) = %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"POST /upload", "=20/hour", "POST /upload=20", "POST /upload=0/hour", "POST /upload=20/fortnight", "POST /upload=x concurrent"} {
+		if _, err := ParseRule(in); err == nil {
+			t.Errorf("ParseRule(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func retryAfter(err error) time.Duration {
+	var limited *LimitedError
+	if errors.As(err, &limited) {
+		return limited.RetryAfter
+	}
+	return 0
+}
+
+func TestAcquire(t *testing.T) {
+	l := New([]Rule{
+		{Pattern: "POST /upload", Kind: KindRequests, Limit: 2, Window: time.Hour},
+		{Pattern: "/download/{filename}", Kind: KindConcurrent, Limit: 1},
+		{Pattern: "GET /download/{filename}", Kind: KindBytes, Limit: 100, Window: time.Hour},
+	})
+
+	for i := 0; i < 2; i++ {
+		ticket, err := l.Acquire("POST /upload", "10.0.0.1")
+		if err != nil {
+			t.Fatalf("upload %d: %v", i, err)
+		}
+		ticket.Done()
+	}
+	if _, err := l.Acquire("POST /upload", "10.0.0.1"); retryAfter(err) <= 0 {
+		t.Fatalf("third upload: got %v, want rate limited", err)
+	}
+	if _, err := l.Acquire("POST /upload", "10.0.0.2"); err != nil {
+		t.Fatalf("another client: %v", err)
+	}
+	if _, err := l.Acquire("POST /paste", "10.0.0.1"); err != nil {
+		t.Fatalf("another route: %v", err)
+	}
+
+	download, err := l.Acquire("GET /download/{filename}", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The rule without a method applies to every method of the path
+	if _, err := l.Acquire("POST /download/{filename}", "10.0.0.1"); retryAfter(err) != concurrentRetry {
+		t.Fatalf("concurrent download: got %v, want rate limited", err)
+	}
+	// Bytes are counted as they are transferred, and cut off at the limit
+	if n, err := download.Transfer(60); n != 60 || err != nil {
+		t.Fatalf("Transfer within the byte limit = %d, %v", n, err)
+	}
+	if n, err := download.Transfer(60); n != 40 || retryAfter(err) <= 0 {
+		t.Fatalf("Transfer over the byte limit = %d, %v, want 40 and rate limited", n, err)
+	}
+	if download.Limited() == nil {
+		t.Fatal("Limited is nil after the transfer was cut off")
+	}
+	download.Done()
+	if _, err := l.Acquire("GET /download/{filename}", "10.0.0.1"); retryAfter(err) <= 0 {
+		t.Fatalf("download over the byte limit: got %v, want rate limited", err)
+	}
+
+	if !l.Unblock("10.0.0.1") {
+		t.Fatal("Unblock found no counters")
+	}
+	for _, pattern := range []string{"POST /upload", "GET /download/{filename}"} {
+		ticket, err := l.Acquire(pattern, "10.0.0.1")
+		if err != nil {
+			t.Fatalf("%s after unblock: %v", pattern, err)
+		}
+		ticket.Done()
+	}
+}
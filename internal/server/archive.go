@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+	"filestation/internal/archive"
+	"filestation/internal/audit"
+	"filestation/internal/auth"
+	"filestation/internal/encryption"
+	"filestation/internal/fileops"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+)
+
+// archiveListing returns the content of an archive, reading it on first
+// use and caching it in the metadata afterwards. Archives encrypted with
+// their password are read every time, so their names stay encrypted too.
+func (s *Server) archiveListing(meta *fileops.FileMetadata, format string, key *encryption.Key) (*archive.Listing, error) {
+	if meta.Archive != nil {
+		return meta.Archive, nil
+	}
+	f, err := fileops.OpenFile(s.config.UploadDir, meta, key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	listing, err := archive.List(f, f.Size(), format)
+	if err != nil || meta.PasswordKDF != nil {
+		return listing, err
+	}
+	err = fileops.UpdateMetadata(s.config.UploadDir, meta.Filename, func(meta *fileops.FileMetadata) error {
+		meta.Archive = listing
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to cache archive listing", "file", meta.Filename, "err", err)
+	}
+	return listing, nil
+}
+
+// handleArchive shows the files in a ZIP or tar archive. Protected
+// archives ask for the password first, since names can be revealing.
+func (s *Server) handleArchive(w http.ResponseWriter, r *http.Request) {
+	meta, ok := s.requestedFile(w, r)
+	if !ok {
+		return
+	}
+	format := archive.Format(meta.OriginalFilename)
+	if format == "" {
+		http.Redirect(w, r, "/download/"+url.PathEscape(meta.Filename), http.StatusSeeOther)
+		return
+	}
+	password, key, ok := s.unlockFile(w, r, meta)
+	if !ok {
+		return
+	}
+
+	data := map[string]interface{}{
+		"SiteTitle": s.config.SiteTitle,
+		"File":      meta,
+		"Password":  password,
+	}
+	listing, err := s.archiveListing(meta, format, key)
+	if err != nil {
+		slog.Warn("Failed to read archive", "file", meta.Filename, "err", err)
+		data["Error"] = "无法读取压缩包，文件可能已损坏"
+	} else {
+		data["Listing"] = listing
+		data["Tree"] = listing.Tree()
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	s.templates.Render(w, "archive.html", data)
+}
+
+// handleArchiveEntry sends one file of an archive as a download of its
+// own. Extracting counts as a download of the archive, so download limits
+// can't be dodged one entry at a time.
+func (s *Server) handleArchiveEntry(w http.ResponseWriter, r *http.Request) {
+	meta, ok := s.requestedFile(w, r)
+	if !ok {
+		return
+	}
+	format := archive.Format(meta.OriginalFilename)
+	if format == "" {
+		http.Error(w, "Not an archive", http.StatusNotFound)
+		return
+	}
+	_, key, ok := s.unlockFile(w, r, meta)
+	if !ok {
+		return
+	}
+
+	slot, ok := s.reserveDownload(w, meta.Filename)
+	if !ok {
+		return
+	}
+	defer slot.Release()
+
+	name := r.FormValue("name")
+	f, err := fileops.OpenFile(s.config.UploadDir, meta, key)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	rc, entry, err := archive.Open(f, f.Size(), format, name)
+	if err != nil {
+		if errors.Is(err, archive.ErrNotFound) {
+			http.Error(w, "Entry not found", http.StatusNotFound)
+		} else {
+			slog.Warn("Failed to read archive", "file", meta.Filename, "entry", name, "err", err)
+			http.Error(w, "Failed to read archive", http.StatusInternalServerError)
+		}
+		return
+	}
+	defer rc.Close()
+
+	s.metrics.activeTransfers.Inc("download")
+	defer s.metrics.activeTransfers.Dec("download")
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", fileops.SanitizeFilename(path.Base(entry.Name))))
+	w.Header().Set("Content-Length", strconv.FormatInt(entry.Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		return
+	}
+	n, err := io.Copy(w, rc)
+	complete := err == nil && n == entry.Size
+
+	s.metrics.downloads.Inc()
+	s.metrics.downloadBytes.Add(float64(n))
+	slog.Info("Archive entry downloaded", "file", meta.Filename, "entry", entry.Name, "bytes", n, "ip", auth.ClientIP(r))
+	s.recordAudit(r, audit.Record{
+		Action:  audit.ActionDownload,
+		File:    meta.Filename,
+		Detail:  fmt.Sprintf("entry=%s bytes=%d", entry.Name, n),
+		Success: complete,
+	})
+	event := fileops.DownloadEvent{
+		Time:      time.Now(),
+		IP:        auth.ClientIP(r),
+		UserAgent: r.UserAgent(),
+		Bytes:     n,
+		Completed: complete,
+	}
+	if err := fileops.AppendDownloadEvent(s.config.UploadDir, meta.Filename, event); err != nil {
+		slog.Error("Failed to record download event", "file", meta.Filename, "err", err)
+	}
+	if complete {
+		s.recordCompletedDownload(r, slot)
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"filestation/internal/audit"
+	"filestation/internal/auth"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// recordAudit appends rec to the audit log, filling in the client IP and
+// actor from the request when they are not set
+func (s *Server) recordAudit(r *http.Request, rec audit.Record) {
+	if rec.IP == "" {
+		rec.IP = auth.ClientIP(r)
+	}
+	if rec.Actor == "" {
+		rec.Actor = "anonymous"
+		if s.auth.IsAdmin(r) {
+			rec.Actor = "admin"
+		}
+	}
+	if err := s.audit.Append(rec); err != nil {
+		slog.Error("Failed to write audit record", "action", rec.Action, "err", err)
+	}
+}
+
+// auditFilter reads the filter fields shared by the audit page and export
+func auditFilter(r *http.Request) audit.Filter {
+	filter := audit.Filter{
+		Action: r.FormValue("action"),
+		Query:  r.FormValue("q"),
+	}
+	if t, err := time.ParseInLocation("2006-01-02", r.FormValue("from"), time.Local); err == nil {
+		filter.From = t
+	}
+	if t, err := time.ParseInLocation("2006-01-02", r.FormValue("to"), time.Local); err == nil {
+		// Inclusive of the whole end day
+		filter.To = t.AddDate(0, 0, 1)
+	}
+	return filter
+}
+
+func (s *Server) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	records, err := s.audit.Query(auditFilter(r))
+	if err != nil {
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+	brokenAt, err := s.audit.Verify()
+	if err != nil {
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+
+	s.templates.Render(w, "admin/audit.html", map[string]interface{}{
+		"SiteTitle": s.config.SiteTitle,
+		"Records":   records,
+		"BrokenAt":  brokenAt,
+		"Action":    r.FormValue("action"),
+		"Query":     r.FormValue("q"),
+		"From":      r.FormValue("from"),
+		"To":        r.FormValue("to"),
+		"RawQuery":  r.URL.RawQuery,
+		"Actions": []string{
+			audit.ActionUpload,
+			audit.ActionDownload,
+			audit.ActionPasswordFailed,
+			audit.ActionDelete,
+			audit.ActionLogin,
+			audit.ActionLoginFailed,
+			audit.ActionPasswordChange,
+			audit.ActionShareCreate,
+			audit.ActionShareRevoke,
+			audit.ActionKeyRotate,
+			audit.ActionRequestCreate,
+			audit.ActionRequestClose,
+			audit.ActionQuarantine,
+			audit.ActionRateUnblock,
+		},
+	})
+}
+
+func (s *Server) handleAdminAuditExport(w http.ResponseWriter, r *http.Request) {
+	records, err := s.audit.Query(auditFilter(r))
+	if err != nil {
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+
+	name := "audit-" + time.Now().Format("20060102-150405")
+	switch r.FormValue("format") {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+name+".csv\"")
+		// BOM so Excel detects UTF-8
+		w.Write([]byte("\xef\xbb\xbf"))
+		audit.WriteCSV(w, records)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+name+".json\"")
+		audit.WriteJSON(w, records)
+	}
+}
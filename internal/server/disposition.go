@@ -0,0 +1,48 @@
+package server
+
+import (
+	"strings"
+)
+
+// contentDisposition builds a Content-Disposition header value per
+// RFC 6266: an ASCII filename for old clients plus filename* carrying the
+// real name as percent-encoded UTF-8. disposition is "attachment" or
+// "inline".
+func contentDisposition(disposition, name string) string {
+	name = strings.ToValidUTF8(name, "_")
+	var fallback strings.Builder
+	for _, r := range name {
+		switch {
+		case r < 0x20, r >= 0x7f:
+			fallback.WriteByte('_')
+		case r == '"', r == '\\', r == '%':
+			// Quotes and backslashes would need escaping that clients
+			// handle inconsistently; some decode %XX in plain filename
+			fallback.WriteByte('_')
+		default:
+			fallback.WriteRune(r)
+		}
+	}
+	v := disposition + `; filename="` + fallback.String() + `"`
+	if fallback.String() != name {
+		v += "; filename*=UTF-8''" + encodeRFC5987(name)
+	}
+	return v
+}
+
+// encodeRFC5987 percent-encodes everything outside RFC 5987's attr-char
+func encodeRFC5987(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&15])
+	}
+	return b.String()
+}
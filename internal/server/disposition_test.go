@@ -0,0 +1,28 @@
+package server
+
+import "testing"
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		name, disposition, in, want string
+	}{
+		{"ascii", "attachment", "report.pdf", `attachment; filename="report.pdf"`},
+		{"inline", "inline", "photo.png", `inline; filename="photo.png"`},
+		{"chinese", "attachment", "报告.pdf", `attachment; filename="__.pdf"; filename*=UTF-8''%E6%8A%A5%E5%91%8A.pdf`},
+		{"space", "attachment", "my file.txt", `attachment; filename="my file.txt"`},
+		{"quote", "attachment", `a"b.txt`, `attachment; filename="a_b.txt"; filename*=UTF-8''a%22b.txt`},
+		{"backslash", "attachment", `a\b.txt`, `attachment; filename="a_b.txt"; filename*=UTF-8''a%5Cb.txt`},
+		{"crlf", "attachment", "a\r\nSet-Cookie: x.txt", `attachment; filename="a__Set-Cookie: x.txt"; filename*=UTF-8''a%0D%0ASet-Cookie%3A%20x.txt`},
+		{"percent", "attachment", "100%.txt", `attachment; filename="100_.txt"; filename*=UTF-8''100%25.txt`},
+		{"semicolon", "attachment", "a;b=c.txt", `attachment; filename="a;b=c.txt"`},
+		{"invalid utf8", "attachment", "a\xff.txt", `attachment; filename="a_.txt"`},
+		{"emoji", "attachment", "🎉.txt", `attachment; filename="_.txt"; filename*=UTF-8''%F0%9F%8E%89.txt`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contentDisposition(tt.disposition, tt.in); got != tt.want {
+				t.Errorf("contentDisposition(%q, %q) =\n%s\nwant\n%s", tt.disposition, tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"filestation/internal/encryption"
+	"filestation/internal/fileops"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return New(ctx, Config{
+		SiteTitle: "test",
+		UploadDir: t.TempDir(),
+		DataDir:   t.TempDir(),
+	})
+}
+
+// upload stores content through the upload form and returns the stored
+// name
+func upload(t *testing.T, s *Server, content string, fields map[string]string) string {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	fw, _ := mw.CreateFormFile("file", "notes.txt")
+	fw.Write([]byte(content))
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	var result struct {
+		Success bool
+		URL     string
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil || !result.Success {
+		t.Fatalf("upload failed: %d %s", rec.Code, rec.Body)
+	}
+	return strings.TrimPrefix(result.URL, "/download/")
+}
+
+func TestPasswordDownloadCounts(t *testing.T) {
+	s := newTestServer(t)
+	const content = "secret notes"
+	name := upload(t, s, content, map[string]string{"password": "hunter2", "max_downloads": "2"})
+
+	download := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"password": {password}}
+		req := httptest.NewRequest(http.MethodPost, "/download/"+name, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := download("wrong"); strings.Contains(rec.Body.String(), content) {
+		t.Fatal("wrong password returned the file")
+	}
+	if rec := download("hunter2"); rec.Code != http.StatusOK || rec.Body.String() != content {
+		t.Fatalf("first download: %d %q", rec.Code, rec.Body)
+	}
+	meta, err := fileops.GetFile(s.config.UploadDir, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Downloads != 1 || meta.FirstDownload.IsZero() {
+		t.Fatalf("after one download: downloads=%d first=%v", meta.Downloads, meta.FirstDownload)
+	}
+
+	// The second download reaches the limit and removes the file
+	if rec := download("hunter2"); rec.Code != http.StatusOK || rec.Body.String() != content {
+		t.Fatalf("second download: %d %q", rec.Code, rec.Body)
+	}
+	if rec := download("hunter2"); rec.Code == http.StatusOK {
+		t.Fatalf("third download succeeded past the limit: %q", rec.Body)
+	}
+}
+
+func TestMultiRangeDownloadCounts(t *testing.T) {
+	s := newTestServer(t)
+	const content = "burn after reading"
+	name := upload(t, s, content, map[string]string{"max_downloads": "1"})
+
+	req := httptest.NewRequest(http.MethodGet, "/download/"+name, nil)
+	req.Header.Set("Range", "bytes=0-4,5-9,10-17")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != content {
+		t.Fatalf("multi-range download: %d %q", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/download/"+name, nil))
+	if rec.Code == http.StatusOK {
+		t.Fatalf("download after the limit succeeded: %q", rec.Body)
+	}
+}
+
+func TestParallelDownloadsRespectLimit(t *testing.T) {
+	s := newTestServer(t)
+	const content = "burn after reading"
+	name := upload(t, s, content, map[string]string{"max_downloads": "1"})
+
+	// A download in progress holds the only download left
+	slot, err := fileops.ReserveDownload(s.config.UploadDir, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/download/"+name, nil))
+	if rec.Code != http.StatusGone {
+		t.Fatalf("download while another is in progress: %d %q", rec.Code, rec.Body)
+	}
+
+	// Once it fails the download is available again
+	slot.Release()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	served := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/download/"+name, nil))
+			if rec.Body.String() == content {
+				mu.Lock()
+				served++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if served != 1 {
+		t.Fatalf("burn-after-reading file was served %d times", served)
+	}
+}
+
+// Uploads starting with the magic of a stored format are still plain files
+func TestMagicPrefixedUpload(t *testing.T) {
+	key, err := encryption.ParseKey([]byte(strings.Repeat("ab", encryption.KeySize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, master := range []*encryption.Key{nil, key} {
+		s := newTestServer(t)
+		s.config.Compress = true
+		fileops.SetMasterKey(master)
+		for _, content := range []string{
+			"FSZSTD\x00\x01 not compressed",
+			"FSENC\x00\x00\x01 not encrypted",
+			strings.Repeat("compressed text\n", 100),
+		} {
+			name := upload(t, s, content, nil)
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/download/"+name, nil))
+			if rec.Code != http.StatusOK || rec.Body.String() != content {
+				t.Errorf("download of %q (master key %t): %d %q", content[:16], master != nil, rec.Code, rec.Body)
+			}
+		}
+	}
+	fileops.SetMasterKey(nil)
+}
+
+// Only responses carrying content count in the download metric
+func TestDownloadMetric(t *testing.T) {
+	s := newTestServer(t)
+	name := upload(t, s, "content", nil)
+	for _, header := range []map[string]string{
+		nil,
+		{"Range": "bytes=0-2"},
+		{"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)},
+		{"Range": "bytes=100-200"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/download/"+name, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		s.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/download/missing.txt", nil))
+
+	var out bytes.Buffer
+	s.metrics.registry.Write(&out)
+	if !strings.Contains(out.String(), "\nfilestation_downloads_total 2\n") {
+		t.Errorf("metrics after a 200, a 206, a 304, a 416 and a 404:\n%s", out.String())
+	}
+}
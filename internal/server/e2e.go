@@ -0,0 +1,40 @@
+package server
+
+import (
+	"encoding/base64"
+	"filestation/internal/fileops"
+	"net/http"
+)
+
+// e2eFilename is stored in place of the name of an end-to-end encrypted
+// upload, which only the holders of its link can read
+const e2eFilename = "encrypted.bin"
+
+// maxE2EMetadata bounds the sealed name and description of an upload
+const maxE2EMetadata = 64 << 10
+
+// validE2EMetadata reports whether sealed looks like metadata sealed by
+// static/js/e2e.js: unpadded base64url of at least a GCM tag
+func validE2EMetadata(sealed string) bool {
+	if len(sealed) > maxE2EMetadata {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	return err == nil && len(data) >= 16
+}
+
+// serveE2E answers a download of an end-to-end encrypted file. Browsers
+// get a page that fetches the ciphertext with ?blob and decrypts it with
+// the key from the link's #fragment, which never reaches the server.
+// It reports whether the file was sent completely.
+func (s *Server) serveE2E(w http.ResponseWriter, r *http.Request, meta *fileops.FileMetadata) bool {
+	if r.URL.Query().Has("blob") {
+		w.Header().Set("Cache-Control", "no-store")
+		return s.serveFile(w, r, meta, e2eFilename, "", nil)
+	}
+	s.templates.Render(w, "e2e.html", map[string]interface{}{
+		"SiteTitle": s.config.SiteTitle,
+		"Metadata":  meta.E2E,
+	})
+	return false
+}
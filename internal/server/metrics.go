@@ -0,0 +1,117 @@
+package server
+
+import (
+	"crypto/subtle"
+	"filestation/internal/fileops"
+	"filestation/internal/metrics"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type serverMetrics struct {
+	registry        *metrics.Registry
+	uploads         *metrics.Vec
+	uploadBytes     *metrics.Vec
+	downloads       *metrics.Vec
+	downloadBytes   *metrics.Vec
+	activeTransfers *metrics.Vec
+	filesExpired    *metrics.Vec
+	requestDuration *metrics.HistogramVec
+}
+
+func (s *Server) newMetrics() *serverMetrics {
+	reg := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry:        reg,
+		uploads:         reg.NewCounter("filestation_uploads_total", "Completed uploads."),
+		uploadBytes:     reg.NewCounter("filestation_upload_bytes_total", "Bytes received in completed uploads."),
+		downloads:       reg.NewCounter("filestation_downloads_total", "File downloads served."),
+		downloadBytes:   reg.NewCounter("filestation_download_bytes_total", "Bytes sent for file downloads."),
+		activeTransfers: reg.NewGauge("filestation_active_transfers", "Uploads and downloads in progress.", "direction"),
+		filesExpired:    reg.NewCounter("filestation_files_expired_total", "Files removed by the expiry cleanup."),
+		requestDuration: reg.NewHistogram("filestation_http_request_duration_seconds", "HTTP request latency by route.", metrics.DefBuckets, "route"),
+	}
+	m.activeTransfers.Add(0, "upload")
+	m.activeTransfers.Add(0, "download")
+
+	reg.NewGaugeFunc("filestation_stored_files", "Files currently in the upload directory.", func() float64 {
+		count, _, _ := fileops.Usage(s.config.UploadDir)
+		return float64(count)
+	})
+	reg.NewGaugeFunc("filestation_stored_bytes", "Total size of files in the upload directory.", func() float64 {
+		_, total, _ := fileops.Usage(s.config.UploadDir)
+		return float64(total)
+	})
+	reg.NewGaugeFunc("filestation_disk_free_bytes", "Free space on the upload volume.", func() float64 {
+		free, _ := fileops.DiskFree(s.config.UploadDir)
+		return float64(free)
+	})
+	reg.NewCounterFunc("filestation_admin_login_failures_total", "Failed admin login attempts.", func() float64 {
+		return float64(s.auth.FailedLogins())
+	})
+
+	return m
+}
+
+// handleMetrics serves /metrics, requiring the configured bearer token if
+// there is one
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if s.config.MetricsToken != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.MetricsToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	s.metrics.registry.Handler()(w, r)
+}
+
+// observeRequest records the latency of a request under the route pattern
+// the mux matched it to
+func (s *Server) observeRequest(r *http.Request, start time.Time) {
+	route := r.Pattern
+	if route == "" {
+		route = "unmatched"
+	}
+	s.metrics.requestDuration.Observe(time.Since(start).Seconds(), route)
+}
+
+// responseRecorder captures the status code and body size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the sendfile fast path of the underlying writer for
+// http.ServeFile.
+func (rr *responseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := rr.ResponseWriter.(io.ReaderFrom); ok {
+		n, err := rf.ReadFrom(src)
+		rr.bytes += n
+		return n, err
+	}
+	return io.Copy(struct{ io.Writer }{rr}, src)
+}
+
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
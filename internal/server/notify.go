@@ -0,0 +1,109 @@
+package server
+
+import (
+	"filestation/internal/auth"
+	"filestation/internal/fileops"
+	"filestation/internal/mailer"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// expiryWarningWindow is how long before expiry uploaders are warned. Files
+// with a shorter lifetime are warned when a quarter of it remains.
+const expiryWarningWindow = 24 * time.Hour
+
+// baseURL returns the public URL of the site, preferring the configured
+// one over what the request claims. Only pages shown to the requester may
+// use the latter; emailed links use mailLink.
+func (s *Server) baseURL(r *http.Request) string {
+	if s.config.BaseURL != "" {
+		return strings.TrimSuffix(s.config.BaseURL, "/")
+	}
+	return auth.Scheme(r) + "://" + r.Host
+}
+
+// mailLink returns the download link of filename for emails. Mail is only
+// enabled along with a base URL, so links never point to a host taken
+// from a request.
+func (s *Server) mailLink(filename string) string {
+	return strings.TrimSuffix(s.config.BaseURL, "/") + "/download/" + url.PathEscape(filename)
+}
+
+// sendMail delivers a notification in the background so handlers don't
+// wait on the SMTP server
+func (s *Server) sendMail(to, kind, locale string, data mailer.Data) {
+	if !s.mailer.Enabled() {
+		return
+	}
+	data.SiteTitle = s.config.SiteTitle
+	go func() {
+		if err := s.mailer.Send(to, kind, locale, data); err != nil {
+			slog.Error("Failed to send email", "kind", kind, "to", to, "err", err)
+			return
+		}
+		slog.Info("Email sent", "kind", kind, "to", to)
+	}()
+}
+
+// mailData fills the file fields of a message from its metadata
+func (s *Server) mailData(meta *fileops.FileMetadata) mailer.Data {
+	return mailer.Data{
+		Filename:    meta.OriginalFilename,
+		Description: meta.Description,
+		Link:        s.mailLink(meta.Filename),
+		Expiration:  meta.ExpirationTime,
+		Time:        time.Now(),
+	}
+}
+
+// notifyDownloaded tells the uploader their file was downloaded, if they
+// asked to be notified
+func (s *Server) notifyDownloaded(r *http.Request, meta *fileops.FileMetadata) {
+	if meta.NotifyEmail == "" {
+		return
+	}
+	data := s.mailData(meta)
+	data.IP = auth.ClientIP(r)
+	s.sendMail(meta.NotifyEmail, mailer.KindDownloaded, meta.NotifyLocale, data)
+}
+
+// warnExpiringFiles emails uploaders whose files are about to expire. It
+// runs with the cleanup task and warns each file at most once.
+func (s *Server) warnExpiringFiles() {
+	if !s.mailer.Enabled() {
+		return
+	}
+	files, err := fileops.GetFiles(s.config.UploadDir)
+	if err != nil {
+		slog.Error("Failed to list files for expiry warnings", "err", err)
+		return
+	}
+
+	now := time.Now()
+	for i := range files {
+		meta := &files[i]
+		if meta.NotifyEmail == "" || meta.ExpiryWarned || meta.ExpirationTime.IsZero() {
+			continue
+		}
+		window := expiryWarningWindow
+		if lifetime := meta.ExpirationTime.Sub(meta.UploadTime); lifetime/4 < window {
+			window = lifetime / 4
+		}
+		if meta.ExpirationTime.Sub(now) > window {
+			continue
+		}
+
+		err := fileops.UpdateMetadata(s.config.UploadDir, meta.Filename, func(m *fileops.FileMetadata) error {
+			m.ExpiryWarned = true
+			return nil
+		})
+		if err != nil {
+			slog.Error("Failed to mark expiry warning", "file", meta.Filename, "err", err)
+			continue
+		}
+		s.sendMail(meta.NotifyEmail, mailer.KindExpiring, meta.NotifyLocale, s.mailData(meta))
+	}
+}
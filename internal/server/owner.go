@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"filestation/internal/fileops"
+	"net/http"
+)
+
+// ownerCookie identifies the browser that uploaded a file. There are no
+// user accounts, so this token is what makes someone a file's owner.
+const ownerCookie = "owner_token"
+
+// ownerID returns the owner ID of the visitor, or "" if they have never
+// uploaded anything. Only the hash of the token is stored in metadata.
+func (s *Server) ownerID(r *http.Request) string {
+	cookie, err := r.Cookie(ownerCookie)
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(cookie.Value))
+	return hex.EncodeToString(sum[:])
+}
+
+// ensureOwnerID returns the visitor's owner ID, issuing a token cookie
+// first if they don't have one
+func (s *Server) ensureOwnerID(w http.ResponseWriter, r *http.Request) string {
+	if id := s.ownerID(r); id != "" {
+		return id
+	}
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     ownerCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// isOwner reports whether the visitor uploaded meta
+func (s *Server) isOwner(r *http.Request, meta *fileops.FileMetadata) bool {
+	id := s.ownerID(r)
+	return id != "" && id == meta.Owner
+}
+
+// canAccess reports whether the visitor may see the file at all. Private
+// files are limited to their owner and the admin; everything else is
+// reachable by link. Nobody gets files that are still being scanned.
+func (s *Server) canAccess(r *http.Request, meta *fileops.FileMetadata) bool {
+	if meta.Blocked() {
+		return false
+	}
+	if meta.Visibility != fileops.VisibilityPrivate {
+		return true
+	}
+	return s.isOwner(r, meta) || s.auth.IsAdmin(r)
+}
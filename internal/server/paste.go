@@ -0,0 +1,301 @@
+package server
+
+import (
+	"filestation/internal/audit"
+	"filestation/internal/auth"
+	"filestation/internal/encryption"
+	"filestation/internal/fileops"
+	"filestation/internal/highlight"
+	"filestation/internal/webhook"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxSnippetSize limits pasted text; anything larger should be uploaded
+const maxSnippetSize = 1 << 20
+
+func (s *Server) renderPastePage(w http.ResponseWriter, r *http.Request, errMsg string) {
+	s.templates.Render(w, "paste.html", map[string]interface{}{
+		"SiteTitle": s.config.SiteTitle,
+		"Languages": highlight.Languages,
+		"Error":     errMsg,
+		"Form":      r.PostForm,
+	})
+}
+
+func (s *Server) handlePastePage(w http.ResponseWriter, r *http.Request) {
+	s.renderPastePage(w, r, "")
+}
+
+// handlePaste stores pasted text as a file marked with its language, so it
+// expires, is password protected and burns like any upload
+func (s *Server) handlePaste(w http.ResponseWriter, r *http.Request) {
+	if !s.beginUpload() {
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "服务器正在重启，请稍后重试", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.uploads.Done()
+	s.metrics.activeTransfers.Inc("upload")
+	defer s.metrics.activeTransfers.Dec("upload")
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxSnippetSize+64<<10)
+	if err := r.ParseForm(); err != nil {
+		s.renderPastePage(w, r, "文本过长，最多 1 MB")
+		return
+	}
+
+	content := r.PostFormValue("content")
+	if strings.TrimSpace(content) == "" {
+		s.renderPastePage(w, r, "请输入文本内容")
+		return
+	}
+	if len(content) > maxSnippetSize {
+		s.renderPastePage(w, r, "文本过长，最多 1 MB")
+		return
+	}
+	if !utf8.ValidString(content) {
+		s.renderPastePage(w, r, "文本不是有效的 UTF-8")
+		return
+	}
+	language := r.PostFormValue("language")
+	if !highlight.Known(language) {
+		language = "plaintext"
+	}
+	expirationHours, visibility, maxDownloads, errMsg := sharingOptions(r)
+	if errMsg != "" {
+		s.renderPastePage(w, r, errMsg)
+		return
+	}
+
+	name := "snippet"
+	if title := strings.TrimSpace(r.PostFormValue("title")); title != "" {
+		name = fileops.SanitizeFilename(title)
+	}
+	if filepath.Ext(name) == "" {
+		name += highlight.Extension(language)
+	}
+	desc := strings.TrimSpace(r.PostFormValue("description"))
+	if desc == "" {
+		desc = "粘贴的文本"
+	}
+	password := r.PostFormValue("password")
+
+	meta := fileops.FileMetadata{
+		Description:      desc,
+		Uploader:         fileops.ClientInfo{IP: auth.ClientIP(r), Device: r.UserAgent()},
+		UploadTime:       time.Now(),
+		ExpirationTime:   time.Now().Add(time.Duration(expirationHours) * time.Hour),
+		OriginalFilename: name,
+		MaxDownloads:     maxDownloads,
+		Visibility:       visibility,
+		Owner:            s.ensureOwnerID(w, r),
+		Language:         language,
+		Scan:             s.pendingScan(),
+	}
+	if password != "" {
+		meta.PasswordHash = s.auth.HashPassword(password)
+	}
+	key, err := passwordKey(&meta, password)
+	if err != nil {
+		http.Error(w, "Failed to save snippet", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := s.quota.Reserve(meta.Owner, auth.ClientIP(r), int64(len(content)))
+	if err != nil {
+		_, msg := s.quotaFailed(r, err)
+		s.renderPastePage(w, r, msg)
+		return
+	}
+	opts := s.saveOptions(key)
+	opts.Quota = res
+	storedName, err := fileops.SaveFile(strings.NewReader(content), name, s.config.UploadDir, meta, opts)
+	res.Release(err == nil)
+	if err != nil {
+		if status, msg := s.saveFailed(r, name, err); status != http.StatusInternalServerError {
+			s.renderPastePage(w, r, msg)
+			return
+		}
+		http.Error(w, "Failed to save snippet", http.StatusInternalServerError)
+		return
+	}
+	if verdict := s.scanUpload(r, storedName, key); verdict != nil && verdict.Status == fileops.ScanInfected {
+		s.renderPastePage(w, r, infectedMessage(verdict))
+		return
+	}
+	slog.Info("Snippet pasted", "filename", name, "size", len(content), "language", language, "ip", auth.ClientIP(r))
+	s.recordAudit(r, audit.Record{
+		Action:  audit.ActionUpload,
+		File:    storedName,
+		Detail:  fmt.Sprintf("snippet language=%s size=%d expiration=%dh password=%t max_downloads=%d visibility=%s", language, len(content), expirationHours, password != "", maxDownloads, visibility),
+		Success: true,
+	})
+	s.metrics.uploads.Inc()
+	s.metrics.uploadBytes.Add(float64(len(content)))
+	if stored, err := fileops.GetFile(s.config.UploadDir, storedName); err == nil {
+		s.webhooks.Enqueue(webhook.EventFileUploaded, fileEventData(stored))
+	}
+
+	http.Redirect(w, r, "/paste/"+url.PathEscape(storedName), http.StatusSeeOther)
+}
+
+// snippet looks up the snippet named in the request, writing an error
+// response if it can't be shown
+func (s *Server) snippet(w http.ResponseWriter, r *http.Request) (*fileops.FileMetadata, bool) {
+	filename := r.PathValue("filename")
+	meta, err := fileops.GetFile(s.config.UploadDir, filename)
+	if err != nil || !s.canAccess(r, meta) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return nil, false
+	}
+	if meta.Language == "" {
+		http.Redirect(w, r, "/download/"+url.PathEscape(filename), http.StatusSeeOther)
+		return nil, false
+	}
+	if meta.DownloadsExhausted() {
+		http.Error(w, "File has reached its download limit", http.StatusGone)
+		return nil, false
+	}
+	return meta, true
+}
+
+// unlockFile checks the password of a protected file shown in a page. A
+// GET shows the password form, which posts back to the same URL.
+func (s *Server) unlockFile(w http.ResponseWriter, r *http.Request, meta *fileops.FileMetadata) (string, *encryption.Key, bool) {
+	if !meta.HasPassword {
+		return "", nil, true
+	}
+	data := map[string]interface{}{
+		"SiteTitle":    s.config.SiteTitle,
+		"Filename":     meta.OriginalFilename,
+		"RealFilename": meta.Filename,
+		"Error":        false,
+		"Action":       "解锁并查看",
+	}
+	if r.Method != http.MethodPost {
+		s.templates.Render(w, "password.html", data)
+		return "", nil, false
+	}
+	password := r.FormValue("password")
+	if !s.auth.CheckPassword(meta.PasswordHash, password) {
+		slog.Warn("Wrong download password", "file", meta.Filename, "ip", auth.ClientIP(r))
+		s.recordAudit(r, audit.Record{Action: audit.ActionPasswordFailed, File: meta.Filename})
+		data["Error"] = true
+		s.templates.Render(w, "password.html", data)
+		return "", nil, false
+	}
+	key, err := fileKey(meta, password)
+	if err != nil {
+		slog.Error("Failed to derive file key", "file", meta.Filename, "err", err)
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return "", nil, false
+	}
+	return password, key, true
+}
+
+// recordView counts showing a file in a page as the completed download
+// reserved in slot and returns the updated metadata
+func (s *Server) recordView(r *http.Request, meta *fileops.FileMetadata, slot *fileops.DownloadSlot, size int, variant string) *fileops.FileMetadata {
+	if r.Method == http.MethodHead {
+		return meta
+	}
+	s.metrics.downloads.Inc()
+	s.metrics.downloadBytes.Add(float64(size))
+	slog.Info("File viewed", "file", meta.Filename, "variant", variant, "ip", auth.ClientIP(r))
+	s.recordAudit(r, audit.Record{
+		Action:  audit.ActionDownload,
+		File:    meta.Filename,
+		Detail:  fmt.Sprintf("variant=%s bytes=%d", variant, size),
+		Success: true,
+	})
+	event := fileops.DownloadEvent{
+		Time:      time.Now(),
+		IP:        auth.ClientIP(r),
+		UserAgent: r.UserAgent(),
+		Bytes:     int64(size),
+		Completed: true,
+	}
+	if err := fileops.AppendDownloadEvent(s.config.UploadDir, meta.Filename, event); err != nil {
+		slog.Error("Failed to record download event", "file", meta.Filename, "err", err)
+	}
+	if updated := s.recordCompletedDownload(r, slot); updated != nil {
+		return updated
+	}
+	return meta
+}
+
+func (s *Server) handleSnippet(w http.ResponseWriter, r *http.Request) {
+	meta, ok := s.snippet(w, r)
+	if !ok {
+		return
+	}
+	password, key, ok := s.unlockFile(w, r, meta)
+	if !ok {
+		return
+	}
+	slot, ok := s.reserveDownload(w, meta.Filename)
+	if !ok {
+		return
+	}
+	defer slot.Release()
+	content, err := fileops.ReadFile(s.config.UploadDir, meta, key)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	code, err := highlight.Highlight(string(content), meta.Language, meta.OriginalFilename)
+	if err != nil {
+		slog.Error("Failed to highlight snippet", "file", meta.Filename, "err", err)
+		http.Error(w, "Failed to render snippet", http.StatusInternalServerError)
+		return
+	}
+
+	meta = s.recordView(r, meta, slot, len(content), "view")
+	w.Header().Set("Cache-Control", "no-store")
+	s.templates.Render(w, "snippet.html", map[string]interface{}{
+		"SiteTitle": s.config.SiteTitle,
+		"File":      meta,
+		"Code":      code,
+		"CSS":       highlight.CSS(),
+		"Lines":     strings.Count(strings.TrimSuffix(string(content), "\n"), "\n") + 1,
+		"Password":  password,
+		"Burned":    meta.DownloadsExhausted(),
+	})
+}
+
+func (s *Server) handleSnippetRaw(w http.ResponseWriter, r *http.Request) {
+	meta, ok := s.snippet(w, r)
+	if !ok {
+		return
+	}
+	_, key, ok := s.unlockFile(w, r, meta)
+	if !ok {
+		return
+	}
+	slot, ok := s.reserveDownload(w, meta.Filename)
+	if !ok {
+		return
+	}
+	defer slot.Release()
+	content, err := fileops.ReadFile(s.config.UploadDir, meta, key)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(content)
+	s.recordView(r, meta, slot, len(content), "raw")
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/binary"
+	"filestation/internal/clamav"
+	"filestation/internal/fileops"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd answers INSTREAM scans, finding streams containing "EICAR"
+// infected
+func fakeClamd(t *testing.T) *clamav.Scanner {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				cmd := make([]byte, len("zINSTREAM\x00"))
+				if _, err := io.ReadFull(conn, cmd); err != nil {
+					return
+				}
+				var data []byte
+				for {
+					var size uint32
+					if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					chunk := make([]byte, size)
+					if _, err := io.ReadFull(conn, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+				}
+				if strings.Contains(string(data), "EICAR") {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+					return
+				}
+				conn.Write([]byte("stream: OK\x00"))
+			}()
+		}
+	}()
+	scanner, err := clamav.New("tcp://"+ln.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scanner
+}
+
+func paste(s *Server, content string) *httptest.ResponseRecorder {
+	form := url.Values{"content": {content}, "expiration": {"24"}}
+	req := httptest.NewRequest(http.MethodPost, "/paste", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPasteScanned(t *testing.T) {
+	s := newTestServer(t)
+	s.scanner = fakeClamd(t)
+	s.config.QuarantineDir = t.TempDir()
+
+	rec := paste(s, "X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*")
+	if !strings.Contains(rec.Body.String(), "病毒扫描") {
+		t.Errorf("infected paste: %d %s", rec.Code, rec.Body)
+	}
+	if files, _ := fileops.GetFiles(s.config.UploadDir); len(files) != 0 {
+		t.Errorf("infected paste left %d files to download", len(files))
+	}
+
+	rec = paste(s, "clean text")
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("clean paste: %d %s", rec.Code, rec.Body)
+	}
+	name := strings.TrimPrefix(rec.Header().Get("Location"), "/paste/")
+	meta, err := fileops.GetFile(s.config.UploadDir, name)
+	if err != nil || meta.Scan == nil || meta.Scan.Status != fileops.ScanClean {
+		t.Errorf("clean paste scan state: %+v, %v", meta, err)
+	}
+}
+
+func TestPasteWhileDraining(t *testing.T) {
+	s := newTestServer(t)
+	s.Drain()
+	if rec := paste(s, "text"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("paste while draining: %d, want 503", rec.Code)
+	}
+}
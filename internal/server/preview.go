@@ -0,0 +1,195 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"filestation/internal/encryption"
+	"filestation/internal/fileops"
+	"filestation/internal/highlight"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// maxPreviewText limits text rendered into the preview page
+const maxPreviewText = 1 << 20
+
+// unlockTTL is how long unlocking a protected file for preview lasts
+const unlockTTL = time.Hour
+
+// unlockGrants remembers password protected files unlocked on the preview
+// page, so the images and media it embeds can load without the password.
+// Grants only live in memory; after a restart the password is asked again.
+// For files encrypted with their password the grant holds the derived key.
+type unlockGrants struct {
+	mu     sync.Mutex
+	grants map[string]unlockGrant
+}
+
+type unlockGrant struct {
+	filename string
+	key      *encryption.Key
+	expires  time.Time
+}
+
+func newUnlockGrants() *unlockGrants {
+	return &unlockGrants{grants: make(map[string]unlockGrant)}
+}
+
+// Issue returns a token that unlocks filename, and its key if it has one,
+// for unlockTTL.
+func (g *unlockGrants) Issue(filename string, key *encryption.Key) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	for token, grant := range g.grants {
+		if now.After(grant.expires) {
+			delete(g.grants, token)
+		}
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	g.grants[token] = unlockGrant{filename: filename, key: key, expires: now.Add(unlockTTL)}
+	return token
+}
+
+// Valid reports whether token unlocks filename and returns the key it
+// grants.
+func (g *unlockGrants) Valid(token, filename string) (*encryption.Key, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	grant, ok := g.grants[token]
+	if !ok || grant.filename != filename || time.Now().After(grant.expires) {
+		return nil, false
+	}
+	return grant.key, true
+}
+
+// requestedFile looks up the file named in the request for a page that
+// shows its content, writing an error response if it can't be shown
+func (s *Server) requestedFile(w http.ResponseWriter, r *http.Request) (*fileops.FileMetadata, bool) {
+	meta, err := fileops.GetFile(s.config.UploadDir, r.PathValue("filename"))
+	if err != nil || !s.canAccess(r, meta) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return nil, false
+	}
+	if meta.DownloadsExhausted() {
+		http.Error(w, "File has reached its download limit", http.StatusGone)
+		return nil, false
+	}
+	return meta, true
+}
+
+// handlePreview shows a file in the browser. Text and markdown are
+// rendered into the page; images, PDFs and media are embedded from
+// handlePreviewRaw. Protected files ask for the password first.
+func (s *Server) handlePreview(w http.ResponseWriter, r *http.Request) {
+	meta, ok := s.requestedFile(w, r)
+	if !ok {
+		return
+	}
+	if meta.Language != "" {
+		http.Redirect(w, r, "/paste/"+url.PathEscape(meta.Filename), http.StatusSeeOther)
+		return
+	}
+	password, key, ok := s.unlockFile(w, r, meta)
+	if !ok {
+		return
+	}
+	kind, _, err := fileops.SniffFile(s.config.UploadDir, meta, key)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	data := map[string]interface{}{
+		"SiteTitle": s.config.SiteTitle,
+		"Password":  password,
+	}
+	switch kind {
+	case fileops.PreviewText, fileops.PreviewMarkdown:
+		if meta.Size > maxPreviewText {
+			kind = ""
+			data["TooLarge"] = true
+			break
+		}
+		slot, ok := s.reserveDownload(w, meta.Filename)
+		if !ok {
+			return
+		}
+		defer slot.Release()
+		content, err := fileops.ReadFile(s.config.UploadDir, meta, key)
+		if err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if !utf8.Valid(content) {
+			kind = ""
+			break
+		}
+		var rendered template.HTML
+		if kind == fileops.PreviewMarkdown {
+			rendered, err = highlight.Markdown(string(content))
+		} else {
+			rendered, err = highlight.Highlight(string(content), "", meta.OriginalFilename)
+			data["CSS"] = highlight.CSS()
+		}
+		if err != nil {
+			slog.Error("Failed to render preview", "file", meta.Filename, "err", err)
+			http.Error(w, "Failed to render preview", http.StatusInternalServerError)
+			return
+		}
+		data["Content"] = rendered
+		meta = s.recordView(r, meta, slot, len(content), "preview")
+	case "":
+	default:
+		raw := "/preview/" + url.PathEscape(meta.Filename) + "/raw"
+		if meta.HasPassword {
+			raw += "?unlock=" + s.unlocks.Issue(meta.Filename, key)
+		}
+		data["Raw"] = raw
+	}
+	data["File"] = meta
+	data["Kind"] = kind
+	data["Burned"] = meta.DownloadsExhausted()
+
+	w.Header().Set("Cache-Control", "no-store")
+	// Rendered markdown may link to images elsewhere; don't let it load them
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; img-src 'self' data:; style-src 'self' 'unsafe-inline'; script-src 'none'; object-src 'none'")
+	s.templates.Render(w, "preview.html", data)
+}
+
+// handlePreviewRaw serves an image, PDF or media file inline with a
+// sniffed, safe Content-Type. Range requests work, so media can seek.
+// Anything else is sent as an attachment by /download instead.
+func (s *Server) handlePreviewRaw(w http.ResponseWriter, r *http.Request) {
+	meta, ok := s.requestedFile(w, r)
+	if !ok {
+		return
+	}
+	var key *encryption.Key
+	if meta.HasPassword {
+		var ok bool
+		if key, ok = s.unlocks.Valid(r.URL.Query().Get("unlock"), meta.Filename); !ok {
+			http.Redirect(w, r, "/preview/"+url.PathEscape(meta.Filename), http.StatusSeeOther)
+			return
+		}
+	}
+	kind, contentType, err := fileops.SniffFile(s.config.UploadDir, meta, key)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	switch kind {
+	case fileops.PreviewImage, fileops.PreviewPDF, fileops.PreviewAudio, fileops.PreviewVideo:
+		s.serveFile(w, r, meta, meta.OriginalFilename, contentType, key)
+	default:
+		http.Redirect(w, r, "/download/"+url.PathEscape(meta.Filename), http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"filestation/internal/auth"
+	"filestation/internal/quota"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// reserveUpload sets aside the space for an upload by user before its
+// body is read, sized by its Content-Length, and refuses it when that is
+// already more than the quotas allow. The file written from the body
+// grows the reservation, which must be released once the upload is done.
+func (s *Server) reserveUpload(w http.ResponseWriter, r *http.Request, user string) (*quota.Reservation, bool) {
+	if r.ContentLength < 0 && s.quota.Limits().Enabled() {
+		// Without a length the whole body would be received before its
+		// size could be checked
+		w.Header().Set("Connection", "close")
+		s.jsonError(w, http.StatusLengthRequired, "上传请求缺少 Content-Length")
+		return nil, false
+	}
+	res, err := s.quota.Reserve(user, auth.ClientIP(r), max(r.ContentLength, 0))
+	if err != nil {
+		status, msg := s.quotaFailed(r, err)
+		// The rest of the body is not read
+		w.Header().Set("Connection", "close")
+		s.jsonError(w, status, msg)
+		return nil, false
+	}
+	return res, true
+}
+
+// quotaFailed logs a refused or failed quota check and returns the status
+// and message to answer with
+func (s *Server) quotaFailed(r *http.Request, err error) (int, string) {
+	var exceeded *quota.ExceededError
+	if errors.As(err, &exceeded) {
+		slog.Warn("Upload refused by quota", "scope", exceeded.Scope, "used", exceeded.Used, "limit", exceeded.Limit, "ip", auth.ClientIP(r))
+		return http.StatusInsufficientStorage, exceeded.Message()
+	}
+	slog.Error("Failed to check storage quota", "err", err)
+	return http.StatusInternalServerError, "保存文件失败"
+}
+
+// handleQuotaCheck lets the upload page ask whether a file of the given
+// size fits before sending it; a refused upload is otherwise only noticed
+// once the browser has sent the whole body.
+func (s *Server) handleQuotaCheck(w http.ResponseWriter, r *http.Request) {
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil || size < 0 {
+		s.jsonError(w, http.StatusBadRequest, "无效的文件大小")
+		return
+	}
+	if err := s.quota.Check(s.ownerID(r), auth.ClientIP(r), size); err != nil {
+		status, msg := s.quotaFailed(r, err)
+		s.jsonError(w, status, msg)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
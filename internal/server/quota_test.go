@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bytes"
+	"filestation/internal/quota"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func uploadRequest(content string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "notes.txt")
+	fw.Write([]byte(content))
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+// Uploads are refused by their declared length before the body is read
+func TestUploadQuotaBeforeBody(t *testing.T) {
+	s := newTestServer(t)
+	s.quota = quota.New(s.config.UploadDir, quota.Limits{PerIP: 1000})
+
+	// A body of unknown length can't be checked up front
+	req := uploadRequest("short")
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusLengthRequired {
+		t.Errorf("upload without Content-Length: %d, want 411", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, uploadRequest(strings.Repeat("x", 2000)))
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Errorf("upload over the quota: %d, want 507", rec.Code)
+	}
+
+	// An upload in progress holds its declared size
+	res, err := s.quota.Reserve("someone", "192.0.2.1", 700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, uploadRequest(strings.Repeat("x", 400)))
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Errorf("upload alongside another: %d, want 507", rec.Code)
+	}
+	res.Release(false)
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, uploadRequest(strings.Repeat("x", 400)))
+	if rec.Code != http.StatusOK {
+		t.Errorf("upload within the quota: %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"errors"
+	"filestation/internal/audit"
+	"filestation/internal/auth"
+	"filestation/internal/ratelimit"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// limitRequest applies the rate limits to a request, answering it with
+// 429 when one is exceeded. Otherwise it returns the writer to serve the
+// request with, which cuts the response off once a byte limit is reached,
+// and the function to call once the request has been served.
+func (s *Server) limitRequest(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func(), bool) {
+	// Admins are never limited, so they can always reach the unblock page
+	if !s.limiter.Enabled() || s.auth.IsAdmin(r) {
+		return w, func() {}, true
+	}
+	_, pattern := s.mux.Handler(r)
+	ip := auth.ClientIP(r)
+	ticket, err := s.limiter.Acquire(pattern, ip)
+	if err != nil {
+		var limited *ratelimit.LimitedError
+		if !errors.As(err, &limited) {
+			s.jsonError(w, http.StatusInternalServerError, "Internal error")
+			return nil, nil, false
+		}
+		// Refused requests are still logged under their route
+		r.Pattern = pattern
+		slog.Warn("Request rate limited", "rule", limited.Rule.String(), "retry_after", limited.RetryAfter.Round(time.Second), "ip", ip)
+		s.rateLimited(w, r, limited)
+		return nil, nil, false
+	}
+
+	r.Body = &limitedReader{ReadCloser: r.Body, ticket: ticket}
+	done := func() {
+		if limited := ticket.Limited(); limited != nil {
+			slog.Warn("Transfer cut off by rate limit", "rule", limited.Rule.String(), "retry_after", limited.RetryAfter.Round(time.Second), "ip", ip)
+		}
+		ticket.Done()
+	}
+	return &limitedWriter{ResponseWriter: w, ticket: ticket}, done, true
+}
+
+// rateLimited answers a request refused by a rate limit
+func (s *Server) rateLimited(w http.ResponseWriter, r *http.Request, limited *ratelimit.LimitedError) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((limited.RetryAfter+time.Second-1)/time.Second)))
+	if r.ContentLength != 0 {
+		// The upload body is not read
+		w.Header().Set("Connection", "close")
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Error(w, limited.Message(), http.StatusTooManyRequests)
+	} else {
+		s.jsonError(w, http.StatusTooManyRequests, limited.Message())
+	}
+}
+
+// uploadLimited answers an upload whose body was cut off by a byte limit
+// while the form was parsed, reporting whether it was
+func (s *Server) uploadLimited(w http.ResponseWriter, r *http.Request, err error) bool {
+	var limited *ratelimit.LimitedError
+	if !errors.As(err, &limited) {
+		return false
+	}
+	s.rateLimited(w, r, limited)
+	return true
+}
+
+// limitedReader counts a request body against the byte limits as the
+// handler reads it, failing with a *ratelimit.LimitedError once one is
+// reached
+type limitedReader struct {
+	io.ReadCloser
+	ticket *ratelimit.Ticket
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.ReadCloser.Read(p)
+	if allowed, limitErr := l.ticket.Transfer(int64(n)); limitErr != nil {
+		return int(allowed), limitErr
+	}
+	return n, err
+}
+
+// limitedWriter counts a response against the byte limits as it is
+// written, cutting it off once one is reached
+type limitedWriter struct {
+	http.ResponseWriter
+	ticket *ratelimit.Ticket
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	allowed, limitErr := l.ticket.Transfer(int64(len(p)))
+	n, err := l.ResponseWriter.Write(p[:allowed])
+	if err == nil {
+		err = limitErr
+	}
+	return n, err
+}
+
+func (s *Server) handleAdminRateLimits(w http.ResponseWriter, r *http.Request) {
+	s.templates.Render(w, "admin/ratelimits.html", map[string]interface{}{
+		"SiteTitle": s.config.SiteTitle,
+		"Rules":     s.limiter.Rules(),
+		"Counters":  s.limiter.Counters(),
+		"Proxies":   s.config.TrustedProxies,
+		"Unblocked": r.FormValue("unblocked"),
+	})
+}
+
+func (s *Server) handleAdminRateUnblock(w http.ResponseWriter, r *http.Request) {
+	ip := strings.TrimSpace(r.FormValue("ip"))
+	if ip == "" {
+		http.Error(w, "Missing IP", http.StatusBadRequest)
+		return
+	}
+	found := s.limiter.Unblock(ip)
+	slog.Info("Rate limits reset", "client", ip, "found", found, "ip", auth.ClientIP(r))
+	s.recordAudit(r, audit.Record{
+		Action:  audit.ActionRateUnblock,
+		Detail:  "client=" + ip,
+		Success: found,
+	})
+	http.Redirect(w, r, "/admin/ratelimits?unblocked="+url.QueryEscape(ip), http.StatusSeeOther)
+}
+
+func (l *limitedWriter) Unwrap() http.ResponseWriter {
+	return l.ResponseWriter
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"bytes"
+	"filestation/internal/fileops"
+	"filestation/internal/ratelimit"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A download larger than the byte limit is cut off at the limit rather
+// than counted once it has finished
+func TestDownloadByteLimit(t *testing.T) {
+	s := newTestServer(t)
+	name := upload(t, s, strings.Repeat("x", 3000), nil)
+	s.limiter = ratelimit.New([]ratelimit.Rule{
+		{Pattern: "GET /download/{filename}", Kind: ratelimit.KindBytes, Limit: 1000, Window: time.Hour},
+	})
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/download/"+name, nil))
+	if rec.Body.Len() != 1000 {
+		t.Errorf("download sent %d bytes, want it cut off at 1000", rec.Body.Len())
+	}
+	if meta, err := fileops.GetFile(s.config.UploadDir, name); err != nil || meta.Downloads != 0 {
+		t.Errorf("cut off download counted: %v, %v", meta, err)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/download/"+name, nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("download over the limit: %d, want 429", rec.Code)
+	}
+}
+
+func TestUploadByteLimit(t *testing.T) {
+	s := newTestServer(t)
+	s.limiter = ratelimit.New([]ratelimit.Rule{
+		{Pattern: "POST /upload", Kind: ratelimit.KindBytes, Limit: 1000, Window: time.Hour},
+	})
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "notes.txt")
+	fw.Write([]byte(strings.Repeat("x", 3000)))
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("upload over the limit: %d %s, want 429", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"filestation/internal/audit"
+	"filestation/internal/auth"
+	"filestation/internal/fileops"
+	"filestation/internal/mailer"
+	"filestation/internal/uploadrequest"
+	"filestation/internal/webhook"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// requestView is an upload request with its link and the received files
+// that still exist
+type requestView struct {
+	*uploadrequest.Request
+	URL      string
+	MaxSize  string
+	Received []*fileops.FileMetadata
+}
+
+// canManageRequest reports whether the visitor created the request or is
+// the admin
+func (s *Server) canManageRequest(r *http.Request, req *uploadrequest.Request) bool {
+	id := s.ownerID(r)
+	return (id != "" && id == req.Owner) || s.auth.IsAdmin(r)
+}
+
+func (s *Server) renderRequestsPage(w http.ResponseWriter, r *http.Request, errMsg string) {
+	var list []*uploadrequest.Request
+	if s.auth.IsAdmin(r) {
+		list = s.requests.List("")
+	} else if owner := s.ownerID(r); owner != "" {
+		list = s.requests.List(owner)
+	}
+
+	views := make([]requestView, len(list))
+	for i, req := range list {
+		views[i] = requestView{Request: req, URL: s.baseURL(r) + "/r/" + req.ID, MaxSize: formatLimit(req.MaxFileSize)}
+		for _, name := range req.Files {
+			if meta, err := fileops.GetFile(s.config.UploadDir, name); err == nil {
+				views[i].Received = append(views[i].Received, meta)
+			}
+		}
+	}
+
+	s.templates.Render(w, "requests.html", map[string]interface{}{
+		"SiteTitle":   s.config.SiteTitle,
+		"Requests":    views,
+		"MailEnabled": s.mailer.Enabled(),
+		"Error":       errMsg,
+	})
+}
+
+func (s *Server) handleRequestsPage(w http.ResponseWriter, r *http.Request) {
+	s.renderRequestsPage(w, r, "")
+}
+
+func (s *Server) handleRequestCreate(w http.ResponseWriter, r *http.Request) {
+	title := strings.TrimSpace(r.FormValue("title"))
+	if title == "" || utf8.RuneCountInString(title) > 200 {
+		s.renderRequestsPage(w, r, "请填写标题（不超过 200 字）")
+		return
+	}
+	deadlineHours, err := strconv.Atoi(r.FormValue("deadline"))
+	if err != nil || deadlineHours < 1 || deadlineHours > 8760 {
+		s.renderRequestsPage(w, r, "截止时间无效")
+		return
+	}
+	retention, err := strconv.Atoi(r.FormValue("retention"))
+	if err != nil || retention < 1 || retention > 8760 {
+		s.renderRequestsPage(w, r, "文件保存时间无效")
+		return
+	}
+	maxSizeMB, _ := strconv.ParseInt(r.FormValue("max_file_size"), 10, 64)
+	maxFiles, _ := strconv.Atoi(r.FormValue("max_files"))
+	if maxSizeMB < 0 || maxFiles < 0 {
+		s.renderRequestsPage(w, r, "大小或数量限制无效")
+		return
+	}
+	notifyEmail := strings.TrimSpace(r.FormValue("notify_email"))
+	if notifyEmail != "" && (!s.mailer.Enabled() || !mailer.ValidAddress(notifyEmail)) {
+		s.renderRequestsPage(w, r, "邮箱地址无效")
+		return
+	}
+
+	req := uploadrequest.Request{
+		Title:        title,
+		MaxFileSize:  maxSizeMB << 20,
+		MaxFiles:     maxFiles,
+		Extensions:   uploadrequest.ParseExtensions(r.FormValue("extensions")),
+		Deadline:     time.Now().Add(time.Duration(deadlineHours) * time.Hour),
+		Retention:    retention,
+		Owner:        s.ensureOwnerID(w, r),
+		NotifyEmail:  notifyEmail,
+		NotifyLocale: mailer.Locale(r.Header.Get("Accept-Language")),
+		CreatedBy:    s.actor(r),
+	}
+	if password := r.FormValue("password"); password != "" {
+		req.PasswordHash = s.auth.HashPassword(password)
+	}
+
+	created, err := s.requests.Create(req)
+	if err != nil {
+		slog.Error("Failed to create upload request", "err", err)
+		http.Error(w, "Failed to create upload request", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Upload request created", "request", created.ID, "title", title, "ip", auth.ClientIP(r))
+	s.recordAudit(r, audit.Record{
+		Action:  audit.ActionRequestCreate,
+		Actor:   s.actor(r),
+		Detail:  fmt.Sprintf("request=%s title=%s deadline=%s max_files=%d max_file_size=%d", created.ID, title, created.Deadline.Format(time.RFC3339), maxFiles, created.MaxFileSize),
+		Success: true,
+	})
+	http.Redirect(w, r, "/requests", http.StatusSeeOther)
+}
+
+func (s *Server) handleRequestClose(w http.ResponseWriter, r *http.Request) {
+	req, err := s.requests.Get(r.PathValue("id"))
+	if err != nil || !s.canManageRequest(r, req) {
+		http.Error(w, "Upload request not found", http.StatusNotFound)
+		return
+	}
+	err = s.requests.Close(req.ID)
+	if err != nil {
+		slog.Error("Failed to close upload request", "request", req.ID, "err", err)
+	}
+	s.recordAudit(r, audit.Record{
+		Action:  audit.ActionRequestClose,
+		Actor:   s.actor(r),
+		Detail:  "request=" + req.ID,
+		Success: err == nil,
+	})
+	http.Redirect(w, r, "/requests", http.StatusSeeOther)
+}
+
+// handleRequestPage is the page visitors of an upload request link see.
+// It only offers uploading; nothing else on the site is exposed.
+func (s *Server) handleRequestPage(w http.ResponseWriter, r *http.Request) {
+	req, err := s.requests.Get(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Upload request not found", http.StatusNotFound)
+		return
+	}
+	s.templates.Render(w, "request.html", map[string]interface{}{
+		"SiteTitle": s.config.SiteTitle,
+		"Request":   req,
+		"MaxSize":   formatLimit(req.MaxFileSize),
+		"Remaining": req.MaxFiles - len(req.Files),
+	})
+}
+
+// checkRequestPassword checks the password of an upload request before
+// the body is read. It comes URL-encoded in the X-Request-Password header,
+// and wrong guesses count towards the login failure limit.
+func (s *Server) checkRequestPassword(w http.ResponseWriter, r *http.Request, req *uploadrequest.Request) bool {
+	password, err := url.QueryUnescape(r.Header.Get("X-Request-Password"))
+	ok, limited := false, false
+	if err == nil {
+		ok, limited = s.auth.CheckLimitedPassword(req.PasswordHash, password, auth.ClientIP(r))
+	}
+	if ok {
+		return true
+	}
+	// The body is not read
+	w.Header().Set("Connection", "close")
+	if limited {
+		slog.Warn("Upload request password attempts limited", "request", req.ID, "ip", auth.ClientIP(r))
+		s.jsonError(w, http.StatusTooManyRequests, "密码错误次数过多，请稍后重试")
+		return false
+	}
+	slog.Warn("Wrong upload request password", "request", req.ID, "ip", auth.ClientIP(r))
+	s.jsonError(w, http.StatusForbidden, "密码错误")
+	return false
+}
+
+func (s *Server) handleRequestUpload(w http.ResponseWriter, r *http.Request) {
+	if !s.beginUpload() {
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Retry-After", "30")
+		s.jsonError(w, http.StatusServiceUnavailable, "服务器正在重启，请稍后重试")
+		return
+	}
+	defer s.uploads.Done()
+	s.metrics.activeTransfers.Inc("upload")
+	defer s.metrics.activeTransfers.Dec("upload")
+
+	req, err := s.requests.Get(r.PathValue("id"))
+	if err != nil {
+		s.jsonError(w, http.StatusNotFound, "上传请求不存在")
+		return
+	}
+	if !req.Open() {
+		s.jsonError(w, http.StatusGone, "上传请求已关闭")
+		return
+	}
+	if req.HasPassword && !s.checkRequestPassword(w, r, req) {
+		return
+	}
+	// Files uploaded into a request count against its owner's quota
+	res, ok := s.reserveUpload(w, r, req.Owner)
+	if !ok {
+		return
+	}
+	defer res.Release(false)
+
+	// Leave room for the multipart framing and form fields
+	limit := int64(10 << 30)
+	if req.MaxFileSize > 0 {
+		limit = req.MaxFileSize + 1<<20
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		if !s.uploadLimited(w, r, err) {
+			s.jsonError(w, http.StatusRequestEntityTooLarge, "文件过大")
+		}
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		s.jsonError(w, http.StatusBadRequest, "未选择文件")
+		return
+	}
+	defer file.Close()
+	name := fileops.SanitizeFilename(header.Filename)
+	if !req.Allows(name) {
+		s.jsonError(w, http.StatusBadRequest, "不允许的文件类型，仅接受："+strings.Join(req.Extensions, " "))
+		return
+	}
+	if req.MaxFileSize > 0 && header.Size > req.MaxFileSize {
+		s.jsonError(w, http.StatusRequestEntityTooLarge, "文件超过大小限制 "+formatLimit(req.MaxFileSize))
+		return
+	}
+
+	message := strings.TrimSpace(r.FormValue("message"))
+	desc := message
+	if desc == "" {
+		desc = fmt.Sprintf("通过上传请求「%s」上传", req.Title)
+	}
+	meta := fileops.FileMetadata{
+		Description:      desc,
+		Uploader:         fileops.ClientInfo{IP: auth.ClientIP(r), Device: r.UserAgent()},
+		UploadTime:       time.Now(),
+		ExpirationTime:   time.Now().Add(time.Duration(req.Retention) * time.Hour),
+		OriginalFilename: name,
+		Visibility:       fileops.VisibilityPrivate,
+		Owner:            req.Owner,
+		Scan:             s.pendingScan(),
+	}
+	opts := s.saveOptions(nil)
+	opts.Quota = res
+	storedName, err := fileops.SaveFile(file, name, s.config.UploadDir, meta, opts)
+	res.Release(err == nil)
+	if err != nil {
+		status, msg := s.saveFailed(r, name, err)
+		s.jsonError(w, status, msg)
+		return
+	}
+	if verdict := s.scanUpload(r, storedName, nil); verdict != nil && verdict.Status == fileops.ScanInfected {
+		s.jsonError(w, http.StatusUnprocessableEntity, infectedMessage(verdict))
+		return
+	}
+	// The request may have filled up or closed during the upload
+	if err := s.requests.AddFile(req.ID, storedName); err != nil {
+		fileops.DeleteFile(s.config.UploadDir, storedName)
+		if errors.Is(err, uploadrequest.ErrFull) || errors.Is(err, uploadrequest.ErrClosed) {
+			s.jsonError(w, http.StatusGone, "上传请求已关闭")
+			return
+		}
+		slog.Error("Failed to record upload request file", "request", req.ID, "err", err)
+		s.jsonError(w, http.StatusInternalServerError, "保存文件失败")
+		return
+	}
+
+	slog.Info("File uploaded", "filename", name, "size", header.Size, "request", req.ID, "ip", auth.ClientIP(r))
+	s.recordAudit(r, audit.Record{
+		Action:  audit.ActionUpload,
+		File:    storedName,
+		Detail:  fmt.Sprintf("original_filename=%s size=%d request=%s", name, header.Size, req.ID),
+		Success: true,
+	})
+	s.metrics.uploads.Inc()
+	s.metrics.uploadBytes.Add(float64(header.Size))
+	if stored, err := fileops.GetFile(s.config.UploadDir, storedName); err == nil {
+		s.webhooks.Enqueue(webhook.EventFileUploaded, fileEventData(stored))
+		s.queueThumbnail(stored)
+		if req.NotifyEmail != "" {
+			data := s.mailData(stored)
+			data.IP = auth.ClientIP(r)
+			data.Request = req.Title
+			data.Description = message
+			s.sendMail(req.NotifyEmail, mailer.KindReceived, req.NotifyLocale, data)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "文件已发送",
+	})
+}
+
+// formatLimit formats a size limit for display, with 0 meaning no limit
+func formatLimit(size int64) string {
+	if size == 0 {
+		return "不限"
+	}
+	return fmt.Sprintf("%d MB", size>>20)
+}
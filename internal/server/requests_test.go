@@ -0,0 +1,73 @@
+package server
+
+import (
+	"filestation/internal/uploadrequest"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// trackedBody records whether a handler read the request body
+type trackedBody struct {
+	io.Reader
+	read bool
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	b.read = true
+	return b.Reader.Read(p)
+}
+
+// The password of an upload request is checked before the file is read,
+// and wrong guesses are limited like logins
+func TestRequestPassword(t *testing.T) {
+	s := newTestServer(t)
+	req, err := s.requests.Create(uploadrequest.Request{
+		Title:        "contracts",
+		PasswordHash: s.auth.HashPassword("secret"),
+		Deadline:     time.Now().Add(time.Hour),
+		Retention:    24,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(password string) (*httptest.ResponseRecorder, *trackedBody) {
+		r := uploadRequest("signed")
+		body := &trackedBody{Reader: r.Body}
+		r.Body = io.NopCloser(body)
+		r.URL.Path = "/r/" + req.ID
+		if password != "" {
+			r.Header.Set("X-Request-Password", password)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+		return rec, body
+	}
+
+	for _, password := range []string{"", "wrong"} {
+		rec, body := post(password)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("password %q: %d, want 403", password, rec.Code)
+		}
+		if body.read {
+			t.Errorf("password %q: body read before the password was checked", password)
+		}
+	}
+	rec, _ := post("secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("right password: %d %s", rec.Code, rec.Body)
+	}
+
+	for i := 0; i < 3; i++ {
+		post("wrong")
+	}
+	rec, body := post("secret")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("right password after 5 failures: %d, want 429", rec.Code)
+	}
+	if body.read {
+		t.Error("body read from a limited client")
+	}
+}
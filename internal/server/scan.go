@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"filestation/internal/audit"
+	"filestation/internal/auth"
+	"filestation/internal/encryption"
+	"filestation/internal/fileops"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// pendingScan is the scan state new uploads start in: pending when a
+// scanner is configured, nothing otherwise
+func (s *Server) pendingScan() *fileops.ScanResult {
+	if s.scanner == nil {
+		return nil
+	}
+	return &fileops.ScanResult{Status: fileops.ScanPending}
+}
+
+// scanUpload scans a just saved upload before anyone can download it,
+// quarantining it if it is infected. key is the key of a file encrypted
+// with its password. It returns nil when scanning is off.
+func (s *Server) scanUpload(r *http.Request, filename string, key *encryption.Key) *fileops.ScanResult {
+	if s.scanner == nil {
+		return nil
+	}
+	verdict := s.scanFile(r.Context(), filename, key)
+	if verdict.Status == fileops.ScanInfected {
+		s.recordAudit(r, audit.Record{
+			Action:  audit.ActionQuarantine,
+			Actor:   "system",
+			File:    filename,
+			Detail:  "signature=" + verdict.Signature + " ip=" + auth.ClientIP(r),
+			Success: true,
+		})
+	}
+	return verdict
+}
+
+// scanFile streams a stored file to clamd and records the verdict in its
+// metadata. Infected files are moved to the quarantine directory. A failed
+// scan leaves the file available, marked as unscanned.
+func (s *Server) scanFile(ctx context.Context, filename string, key *encryption.Key) *fileops.ScanResult {
+	verdict := &fileops.ScanResult{Status: fileops.ScanClean, Time: time.Now()}
+	meta, err := fileops.GetFile(s.config.UploadDir, filename)
+	var f *fileops.File
+	if err == nil {
+		f, err = fileops.OpenFile(s.config.UploadDir, meta, key)
+	}
+	if err != nil {
+		verdict.Status, verdict.Error = fileops.ScanFailed, err.Error()
+	} else {
+		// The upload may be cancelled right after the body arrived; the
+		// scan has to finish regardless
+		result, err := s.scanner.Scan(context.WithoutCancel(ctx), f)
+		f.Close()
+		switch {
+		case err != nil:
+			verdict.Status, verdict.Error = fileops.ScanFailed, err.Error()
+			slog.Error("Failed to scan upload", "file", filename, "err", err)
+		case result.Infected:
+			verdict.Status, verdict.Signature = fileops.ScanInfected, result.Signature
+		}
+	}
+
+	err = fileops.UpdateMetadata(s.config.UploadDir, filename, func(meta *fileops.FileMetadata) error {
+		meta.Scan = verdict
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to record scan result", "file", filename, "err", err)
+	}
+	if verdict.Status == fileops.ScanInfected {
+		if err := fileops.Quarantine(s.config.UploadDir, s.config.QuarantineDir, filename); err != nil {
+			slog.Error("Failed to quarantine infected upload", "file", filename, "signature", verdict.Signature, "err", err)
+		} else {
+			slog.Warn("Infected upload quarantined", "file", filename, "signature", verdict.Signature)
+		}
+	}
+	return verdict
+}
+
+// rescanPending finishes scans interrupted by a restart. Without a scanner,
+// or for files encrypted with their password, they are marked failed so
+// the files don't stay blocked.
+func (s *Server) rescanPending(ctx context.Context) {
+	files, err := fileops.GetFiles(s.config.UploadDir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if ctx.Err() != nil {
+			return
+		}
+		if f.Scan == nil || f.Scan.Status != fileops.ScanPending {
+			continue
+		}
+		if s.scanner != nil && f.PasswordKDF == nil {
+			if verdict := s.scanFile(ctx, f.Filename, nil); verdict.Status == fileops.ScanInfected {
+				rec := audit.Record{
+					Action:  audit.ActionQuarantine,
+					Actor:   "system",
+					File:    f.Filename,
+					Detail:  "signature=" + verdict.Signature,
+					Success: true,
+				}
+				if err := s.audit.Append(rec); err != nil {
+					slog.Error("Failed to write audit record", "action", rec.Action, "err", err)
+				}
+			}
+			continue
+		}
+		reason := "scanning is disabled"
+		if s.scanner != nil {
+			reason = "encrypted with its download password"
+		}
+		fileops.UpdateMetadata(s.config.UploadDir, f.Filename, func(meta *fileops.FileMetadata) error {
+			meta.Scan = &fileops.ScanResult{Status: fileops.ScanFailed, Error: reason, Time: time.Now()}
+			return nil
+		})
+	}
+}
+
+// infectedMessage tells the uploader why their file was refused
+func infectedMessage(verdict *fileops.ScanResult) string {
+	return "文件未通过病毒扫描（" + verdict.Signature + "），已被隔离"
+}
@@ -1,15 +1,32 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"filestation/internal/audit"
 	"filestation/internal/auth"
+	"filestation/internal/clamav"
+	"filestation/internal/encryption"
 	"filestation/internal/fileops"
+	"filestation/internal/mailer"
+	"filestation/internal/quota"
+	"filestation/internal/ratelimit"
+	"filestation/internal/sharelink"
+	"filestation/internal/shortlink"
 	"filestation/internal/templates"
+	"filestation/internal/uploadrequest"
+	"filestation/internal/webhook"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,37 +34,228 @@ type Config struct {
 	Port      int
 	SiteTitle string
 	UploadDir string
+	// DataDir holds server state such as the audit log
+	DataDir string
+
+	// BaseURL is the public address of the site. Pages derive it from the
+	// request when empty; it is required for mail.
+	BaseURL string
+
+	// Mail configures the SMTP server; mail is disabled without a host.
+	// Emailed links use BaseURL.
+	Mail mailer.Config
+
+	// Webhooks are notified of file lifecycle events
+	Webhooks []webhook.Hook
+
+	// MetricsToken, if set, is required as a bearer token on /metrics
+	MetricsToken string
+
+	// TypePolicy limits the extensions and content types of uploads
+	TypePolicy fileops.TypePolicy
+
+	// ClamAV is the clamd address uploads are scanned with, e.g.
+	// "tcp://localhost:3310" or "unix:///run/clamav/clamd.ctl". Scanning
+	// is off when empty.
+	ClamAV      string
+	ScanTimeout time.Duration
+	// QuarantineDir receives uploads found infected
+	QuarantineDir string
+
+	// AllowE2E accepts uploads encrypted in the browser, which the type
+	// policy and the scanner can't inspect
+	AllowE2E bool
+
+	// Compress stores text-like uploads zstd compressed
+	Compress bool
+
+	// Quota limits the space stored files may take
+	Quota quota.Limits
+
+	// RateLimits limit the requests per client IP to the routes they
+	// name. TrustedProxies are the proxies whose X-Forwarded-For header
+	// gives the client IP; shown on the admin page.
+	RateLimits     []ratelimit.Rule
+	TrustedProxies []string
 }
 
 type Server struct {
-	config    Config
-	mux       *http.ServeMux
-	auth      *auth.AuthManager
-	templates *templates.TemplateManager
+	config     Config
+	mux        *http.ServeMux
+	auth       *auth.AuthManager
+	templates  *templates.TemplateManager
+	metrics    *serverMetrics
+	audit      *audit.Log
+	webhooks   *webhook.Dispatcher
+	mailer     *mailer.Mailer
+	shares     *sharelink.Manager
+	shortLinks *shortlink.Store
+	requests   *uploadrequest.Store
+	unlocks    *unlockGrants
+	thumbnails chan string // Stored names waiting for a thumbnail
+	scanner    *clamav.Scanner
+	quota      *quota.Manager
+	limiter    *ratelimit.Limiter
+
+	// Drain state: once draining is set no new uploads are accepted and
+	// uploads tracks the ones still in flight
+	drainMu  sync.Mutex
+	draining bool
+	uploads  sync.WaitGroup
 }
 
-func New(config Config) *Server {
+// New creates the server. Background tasks run until ctx is cancelled.
+func New(ctx context.Context, config Config) *Server {
 	tmpl, err := templates.New()
 	if err != nil {
-		log.Fatalf("Failed to load templates: %v", err)
+		slog.Error("Failed to load templates", "err", err)
+		os.Exit(1)
 	}
 
 	s := &Server{
-		config:    config,
-		mux:       http.NewServeMux(),
-		auth:      auth.New(),
-		templates: tmpl,
+		config:     config,
+		mux:        http.NewServeMux(),
+		auth:       auth.New(ctx),
+		templates:  tmpl,
+		unlocks:    newUnlockGrants(),
+		thumbnails: make(chan string, 256),
+		quota:      quota.New(config.UploadDir, config.Quota),
+		limiter:    ratelimit.New(config.RateLimits),
+	}
+	auditLog, err := audit.Open(filepath.Join(config.DataDir, "audit.log"))
+	if err != nil {
+		slog.Error("Failed to open audit log", "err", err)
+		os.Exit(1)
+	}
+	s.audit = auditLog
+
+	s.webhooks, err = webhook.New(filepath.Join(config.DataDir, "webhooks.json"), config.Webhooks)
+	if err != nil {
+		slog.Error("Failed to load webhook queue", "err", err)
+		os.Exit(1)
+	}
+	go s.webhooks.Run(ctx)
+
+	s.shares, err = sharelink.Open(filepath.Join(config.DataDir, "sharelinks.json"))
+	if err != nil {
+		slog.Error("Failed to load share links", "err", err)
+		os.Exit(1)
+	}
+
+	s.shortLinks, err = shortlink.Open(filepath.Join(config.DataDir, "shortlinks.json"))
+	if err != nil {
+		slog.Error("Failed to load short links", "err", err)
+		os.Exit(1)
+	}
+
+	s.requests, err = uploadrequest.Open(filepath.Join(config.DataDir, "upload_requests.json"))
+	if err != nil {
+		slog.Error("Failed to load upload requests", "err", err)
+		os.Exit(1)
+	}
+
+	if config.ClamAV != "" {
+		s.scanner, err = clamav.New(config.ClamAV, config.ScanTimeout)
+		if err != nil {
+			slog.Error("Invalid clamd address", "err", err)
+			os.Exit(1)
+		}
+		if err := s.scanner.Ping(ctx); err != nil {
+			// Uploads are still accepted and marked as unscanned
+			slog.Warn("clamd is not reachable", "address", s.scanner.Address(), "err", err)
+		} else {
+			slog.Info("Scanning uploads with clamd", "address", s.scanner.Address())
+		}
 	}
+	go s.rescanPending(ctx)
+
+	s.mailer, err = mailer.New(config.Mail)
+	if err == nil && s.mailer.Enabled() && config.BaseURL == "" {
+		// Links derived from the Host header of a request would let anyone
+		// make the site email links to their own server
+		err = errors.New("a base URL is required to send email")
+	}
+	if err != nil {
+		slog.Error("Invalid mail configuration", "err", err)
+		os.Exit(1)
+	}
+
+	s.metrics = s.newMetrics()
 	s.routes()
 
+	// Remove uploads interrupted by a previous crash or kill
+	if err := fileops.RemovePartials(config.UploadDir); err != nil {
+		slog.Error("Error removing incomplete uploads", "err", err)
+	}
+
 	// Start cleanup task
-	go s.cleanupTask()
+	go s.cleanupTask(ctx)
+	go s.thumbnailWorker(ctx)
 
 	return s
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	s.mux.ServeHTTP(w, r)
+	start := time.Now()
+	rec := newResponseRecorder(w)
+	if lw, done, ok := s.limitRequest(rec, r); ok {
+		s.mux.ServeHTTP(lw, r)
+		done()
+	}
+
+	s.observeRequest(r, start)
+	s.logRequest(r, rec, start)
+}
+
+// logRequest writes the access log entry for a finished request
+func (s *Server) logRequest(r *http.Request, rec *responseRecorder, start time.Time) {
+	user := ""
+	if s.auth.IsAdmin(r) {
+		user = "admin"
+	}
+	level := slog.LevelInfo
+	if rec.status >= 500 {
+		level = slog.LevelError
+	}
+	slog.LogAttrs(r.Context(), level, "request",
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("route", r.Pattern),
+		slog.Int("status", rec.status),
+		slog.Int64("bytes", rec.bytes),
+		slog.Duration("duration", time.Since(start)),
+		slog.String("ip", auth.ClientIP(r)),
+		slog.String("user", user),
+	)
+}
+
+// Drain stops accepting new uploads. Transfers already in progress are
+// unaffected and are left to http.Server.Shutdown to wait for.
+func (s *Server) Drain() {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	s.draining = true
+}
+
+// Close waits for in-flight upload handlers to return and removes any
+// incomplete upload files they left behind. Call it after the HTTP server
+// has been shut down.
+func (s *Server) Close() error {
+	s.Drain()
+	s.uploads.Wait()
+	return fileops.RemovePartials(s.config.UploadDir)
+}
+
+// beginUpload registers an upload with the drain tracker, reporting false
+// if the server is shutting down.
+func (s *Server) beginUpload() bool {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.uploads.Add(1)
+	return true
 }
 
 func (s *Server) routes() {
@@ -58,6 +266,8 @@ func (s *Server) routes() {
 		staticHandler.ServeHTTP(w, r)
 	})
 
+	s.mux.HandleFunc("GET /metrics", s.handleMetrics)
+
 	// Admin routes (more specific routes first)
 	s.mux.HandleFunc("GET /admin/login", s.handleAdminLogin)
 	s.mux.HandleFunc("POST /admin/login", s.handleAdminLoginPost)
@@ -65,71 +275,173 @@ func (s *Server) routes() {
 	s.mux.HandleFunc("GET /admin/password", s.auth.Middleware(s.handleAdminPasswordPage))
 	s.mux.HandleFunc("POST /admin/password", s.auth.Middleware(s.handleAdminPasswordPost))
 	s.mux.HandleFunc("POST /admin/delete/{filename}", s.auth.Middleware(s.handleAdminDeleteFile))
+	s.mux.HandleFunc("GET /admin/files/{filename}", s.auth.Middleware(s.handleAdminFileDetail))
+	s.mux.HandleFunc("GET /admin/audit", s.auth.Middleware(s.handleAdminAudit))
+	s.mux.HandleFunc("GET /admin/audit/export", s.auth.Middleware(s.handleAdminAuditExport))
+	s.mux.HandleFunc("GET /admin/webhooks", s.auth.Middleware(s.handleAdminWebhooks))
+	s.mux.HandleFunc("POST /admin/webhooks/{id}/redeliver", s.auth.Middleware(s.handleAdminWebhookRedeliver))
+	s.mux.HandleFunc("GET /admin/shares", s.auth.Middleware(s.handleAdminShares))
+	s.mux.HandleFunc("POST /admin/shares/rotate", s.auth.Middleware(s.handleAdminShareRotate))
+	s.mux.HandleFunc("GET /admin/ratelimits", s.auth.Middleware(s.handleAdminRateLimits))
+	s.mux.HandleFunc("POST /admin/ratelimits/unblock", s.auth.Middleware(s.handleAdminRateUnblock))
 	s.mux.HandleFunc("GET /admin", s.auth.Middleware(s.handleAdminDashboard))
 
 	// Main routes
 	s.mux.HandleFunc("GET /upload", s.handleUploadPage)
 	s.mux.HandleFunc("POST /upload", s.handleUpload)
+	s.mux.HandleFunc("GET /upload/quota", s.handleQuotaCheck)
 	s.mux.HandleFunc("GET /download/{filename}", s.handleDownload)
 	s.mux.HandleFunc("POST /download/{filename}", s.handleDownloadPost)
+	s.mux.HandleFunc("GET /files/{filename}/share", s.handleSharePage)
+	s.mux.HandleFunc("POST /files/{filename}/share", s.handleShareCreate)
+	s.mux.HandleFunc("POST /files/{filename}/share/{id}/revoke", s.handleShareRevoke)
+	s.mux.HandleFunc("POST /files/{filename}/shortlink", s.handleCreateShortLink)
+	s.mux.HandleFunc("GET /s/{code}", s.handleShortLink)
+	s.mux.HandleFunc("GET /qr/{format}", s.handleQRCode)
+	s.mux.HandleFunc("GET /paste", s.handlePastePage)
+	s.mux.HandleFunc("POST /paste", s.handlePaste)
+	s.mux.HandleFunc("GET /paste/{filename}", s.handleSnippet)
+	s.mux.HandleFunc("POST /paste/{filename}", s.handleSnippet)
+	s.mux.HandleFunc("GET /paste/{filename}/raw", s.handleSnippetRaw)
+	s.mux.HandleFunc("POST /paste/{filename}/raw", s.handleSnippetRaw)
+	s.mux.HandleFunc("GET /thumbnails/{filename}", s.handleThumbnail)
+	s.mux.HandleFunc("GET /preview/{filename}", s.handlePreview)
+	s.mux.HandleFunc("POST /preview/{filename}", s.handlePreview)
+	s.mux.HandleFunc("GET /preview/{filename}/raw", s.handlePreviewRaw)
+	s.mux.HandleFunc("GET /archive/{filename}", s.handleArchive)
+	s.mux.HandleFunc("POST /archive/{filename}", s.handleArchive)
+	s.mux.HandleFunc("GET /archive/{filename}/entry", s.handleArchiveEntry)
+	s.mux.HandleFunc("POST /archive/{filename}/entry", s.handleArchiveEntry)
+	s.mux.HandleFunc("GET /requests", s.handleRequestsPage)
+	s.mux.HandleFunc("POST /requests", s.handleRequestCreate)
+	s.mux.HandleFunc("POST /requests/{id}/close", s.handleRequestClose)
+	s.mux.HandleFunc("GET /r/{id}", s.handleRequestPage)
+	s.mux.HandleFunc("POST /r/{id}", s.handleRequestUpload)
 
 	// Root route (must be registered last)
 	s.mux.HandleFunc("GET /", s.handleIndex)
 }
 
 func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
-	files, err := fileops.GetFiles(s.config.UploadDir)
+	owner := s.ownerID(r)
+	files, err := fileops.ListedFiles(s.config.UploadDir, owner)
 	if err != nil {
 		http.Error(w, "Failed to list files", http.StatusInternalServerError)
 		return
 	}
 
 	data := map[string]interface{}{
-		"SiteTitle": s.config.SiteTitle,
-		"TempFiles": files,
-		"Now":       time.Now,
+		"SiteTitle":   s.config.SiteTitle,
+		"TempFiles":   files,
+		"OwnerID":     owner,
+		"Now":         time.Now,
+		"MailEnabled": s.mailer.Enabled(),
+		"AllowE2E":    s.config.AllowE2E,
 	}
 	s.templates.Render(w, "index.html", data)
 }
 
 func (s *Server) handleUploadPage(w http.ResponseWriter, r *http.Request) {
 	data := map[string]interface{}{
-		"SiteTitle": s.config.SiteTitle,
+		"SiteTitle":   s.config.SiteTitle,
+		"MailEnabled": s.mailer.Enabled(),
+		"AllowE2E":    s.config.AllowE2E,
 	}
 	s.templates.Render(w, "upload.html", data)
 }
 
 func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
-	// 10GB limit
+	if !s.beginUpload() {
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Retry-After", "30")
+		s.jsonError(w, http.StatusServiceUnavailable, "服务器正在重启，请稍后重试")
+		return
+	}
+	defer s.uploads.Done()
+	s.metrics.activeTransfers.Inc("upload")
+	defer s.metrics.activeTransfers.Dec("upload")
+
+	owner := s.ensureOwnerID(w, r)
+	res, ok := s.reserveUpload(w, r, owner)
+	if !ok {
+		return
+	}
+	defer res.Release(false)
+	// 10GB limit. Files above 32MB are buffered on disk rather than in
+	// memory while the form is parsed.
 	r.Body = http.MaxBytesReader(w, r.Body, 10<<30)
-	if err := r.ParseMultipartForm(10 << 30); err != nil {
-		http.Error(w, "File too large", http.StatusBadRequest)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		if !s.uploadLimited(w, r, err) {
+			s.jsonError(w, http.StatusBadRequest, "文件过大")
+		}
 		return
 	}
 
 	file, header, err := r.FormFile("file")
 	if err != nil {
-		http.Error(w, "No file uploaded", http.StatusBadRequest)
+		s.jsonError(w, http.StatusBadRequest, "未选择文件")
 		return
 	}
 	defer file.Close()
+	name := fileops.SanitizeFilename(header.Filename)
 
 	desc := r.FormValue("description")
 	if desc == "" {
 		desc = "上传者没有提供描述信息"
 	}
 	password := r.FormValue("password")
-	expirationHours, _ := strconv.Atoi(r.FormValue("expiration"))
-	if expirationHours == 0 {
-		expirationHours = 24
+	// End-to-end encrypted uploads carry their real name and description
+	// sealed in the e2e field; never take them from the request, where a
+	// client might have left them
+	sealed := r.FormValue("e2e")
+	if sealed != "" {
+		switch {
+		case !s.config.AllowE2E:
+			s.jsonError(w, http.StatusForbidden, "服务器不接受端到端加密的文件")
+			return
+		case !validE2EMetadata(sealed):
+			s.jsonError(w, http.StatusBadRequest, "加密的文件信息无效")
+			return
+		case password != "":
+			s.jsonError(w, http.StatusBadRequest, "端到端加密的文件无需下载密码，链接中已包含密钥")
+			return
+		}
+		name, desc = e2eFilename, "端到端加密，名称和描述仅持有链接者可见"
+	}
+	expirationHours, visibility, maxDownloads, errMsg := sharingOptions(r)
+	if errMsg != "" {
+		s.jsonError(w, http.StatusBadRequest, errMsg)
+		return
+	}
+	notifyEmail := strings.TrimSpace(r.FormValue("notify_email"))
+	sendTo := strings.TrimSpace(r.FormValue("send_to"))
+	if (notifyEmail != "" || sendTo != "") && !s.mailer.Enabled() {
+		s.jsonError(w, http.StatusBadRequest, "服务器未配置邮件服务")
+		return
+	}
+	if (notifyEmail != "" && !mailer.ValidAddress(notifyEmail)) || (sendTo != "" && !mailer.ValidAddress(sendTo)) {
+		s.jsonError(w, http.StatusBadRequest, "邮箱地址无效")
+		return
 	}
 
 	meta := fileops.FileMetadata{
 		Description:      desc,
-		Uploader:         fileops.ClientInfo{IP: r.RemoteAddr, Device: r.UserAgent()}, // Simplified
+		Uploader:         fileops.ClientInfo{IP: auth.ClientIP(r), Device: r.UserAgent()},
 		UploadTime:       time.Now(),
 		ExpirationTime:   time.Now().Add(time.Duration(expirationHours) * time.Hour),
-		OriginalFilename: header.Filename,
+		OriginalFilename: name,
+		NotifyEmail:      notifyEmail,
+		MaxDownloads:     maxDownloads,
+		Visibility:       visibility,
+		Owner:            owner,
+		NotifyLocale:     mailer.Locale(r.Header.Get("Accept-Language")),
+		Scan:             s.pendingScan(),
+		E2E:              sealed,
+	}
+	if sealed != "" {
+		// Neither the scanner nor the type policy can see through the
+		// encryption; -e2e=false turns these uploads off
+		meta.Scan = nil
 	}
 
 	if password != "" {
@@ -143,14 +455,136 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 		// Let's add HashPassword to auth.
 		meta.PasswordHash = s.auth.HashPassword(password)
 	}
+	key, err := passwordKey(&meta, password)
+	if err != nil {
+		s.jsonError(w, http.StatusInternalServerError, "保存文件失败")
+		return
+	}
 
-	if err := fileops.SaveFile(file, header, s.config.UploadDir, meta); err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+	opts := s.saveOptions(key)
+	opts.Quota = res
+	if sealed != "" {
+		opts.Policy = nil
+	}
+	storedName, err := fileops.SaveFile(file, name, s.config.UploadDir, meta, opts)
+	res.Release(err == nil)
+	if err != nil {
+		status, msg := s.saveFailed(r, name, err)
+		s.jsonError(w, status, msg)
 		return
 	}
+	if meta.Scan != nil {
+		if verdict := s.scanUpload(r, storedName, key); verdict != nil && verdict.Status == fileops.ScanInfected {
+			s.jsonError(w, http.StatusUnprocessableEntity, infectedMessage(verdict))
+			return
+		}
+	}
+	slog.Info("File uploaded",
+		"filename", name,
+		"size", header.Size,
+		"password", password != "",
+		"e2e", sealed != "",
+		"expiration_hours", expirationHours,
+		"ip", auth.ClientIP(r),
+	)
+	s.recordAudit(r, audit.Record{
+		Action:  audit.ActionUpload,
+		File:    storedName,
+		Detail:  fmt.Sprintf("original_filename=%s size=%d expiration=%dh password=%t max_downloads=%d visibility=%s e2e=%t", name, header.Size, expirationHours, password != "", maxDownloads, visibility, sealed != ""),
+		Success: true,
+	})
+	s.metrics.uploads.Inc()
+	s.metrics.uploadBytes.Add(float64(header.Size))
+	if stored, err := fileops.GetFile(s.config.UploadDir, storedName); err == nil {
+		s.webhooks.Enqueue(webhook.EventFileUploaded, fileEventData(stored))
+		s.queueThumbnail(stored)
+		if sendTo != "" {
+			s.sendMail(sendTo, mailer.KindShare, stored.NotifyLocale, s.mailData(stored))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"message":    "File uploaded successfully!",
+		"url":        "/download/" + url.PathEscape(storedName),
+		"visibility": visibility,
+	})
+}
+
+// sharingOptions reads the expiration, visibility and download limit
+// fields shared by uploads and pasted text. errMsg is set for invalid input.
+func sharingOptions(r *http.Request) (expirationHours int, visibility string, maxDownloads int, errMsg string) {
+	expirationHours, _ = strconv.Atoi(r.FormValue("expiration"))
+	if expirationHours <= 0 {
+		expirationHours = 24
+	}
+	visibility = r.FormValue("visibility")
+	switch visibility {
+	case "", fileops.VisibilityPublic:
+		visibility = fileops.VisibilityPublic
+	case fileops.VisibilityUnlisted, fileops.VisibilityPrivate:
+	default:
+		return 0, "", 0, "无效的可见性设置"
+	}
+	maxDownloads, _ = strconv.Atoi(r.FormValue("max_downloads"))
+	if maxDownloads < 0 {
+		maxDownloads = 0
+	}
+	return expirationHours, visibility, maxDownloads, ""
+}
 
+// jsonError writes a JSON failure response that the UI displays
+// to the user.
+func (s *Server) jsonError(w http.ResponseWriter, status int, message string) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(`{"success": true, "message": "File uploaded successfully!"}`))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"message": message,
+	})
+}
+
+// saveOptions are the options every upload is stored with
+func (s *Server) saveOptions(key *encryption.Key) fileops.SaveOptions {
+	return fileops.SaveOptions{Policy: &s.config.TypePolicy, Key: key, Compress: s.config.Compress}
+}
+
+// passwordKey sets meta up to be encrypted with a key derived from its
+// download password and returns that key. Without a password it returns
+// nil and the file is stored as usual.
+func passwordKey(meta *fileops.FileMetadata, password string) (*encryption.Key, error) {
+	if password == "" {
+		return nil, nil
+	}
+	meta.PasswordKDF = encryption.NewKDF()
+	return meta.PasswordKDF.Key(password)
+}
+
+// fileKey derives the key of a file encrypted with its download password,
+// which the caller must have checked. Other files need no key.
+func fileKey(meta *fileops.FileMetadata, password string) (*encryption.Key, error) {
+	if meta.PasswordKDF == nil {
+		return nil, nil
+	}
+	return meta.PasswordKDF.Key(password)
+}
+
+// saveFailed logs and audits a failed SaveFile and returns the status and
+// message to answer the uploader with
+func (s *Server) saveFailed(r *http.Request, filename string, err error) (int, string) {
+	s.recordAudit(r, audit.Record{Action: audit.ActionUpload, File: filename, Detail: err.Error()})
+	var policyErr *fileops.PolicyError
+	if errors.As(err, &policyErr) {
+		slog.Warn("Upload rejected by type policy", "filename", filename, "ip", auth.ClientIP(r), "reason", policyErr.Message)
+		return http.StatusUnsupportedMediaType, policyErr.Message
+	}
+	var quotaErr *quota.ExceededError
+	if errors.As(err, &quotaErr) {
+		return s.quotaFailed(r, err)
+	}
+	slog.Error("Failed to save upload", "filename", filename, "ip", auth.ClientIP(r), "err", err)
+	return http.StatusInternalServerError, "保存文件失败"
 }
 
 func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
@@ -160,6 +594,22 @@ func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
+	if sharelink.IsSigned(r.URL.Query()) {
+		s.serveShared(w, r, meta)
+		return
+	}
+	if !s.canAccess(r, meta) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if meta.DownloadsExhausted() {
+		http.Error(w, "File has reached its download limit", http.StatusGone)
+		return
+	}
+	if meta.E2E != "" {
+		s.serveE2E(w, r, meta)
+		return
+	}
 
 	if meta.HasPassword {
 		data := map[string]interface{}{
@@ -172,7 +622,7 @@ func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.serveFile(w, r, filename, meta.OriginalFilename)
+	s.serveFile(w, r, meta, meta.OriginalFilename, "", nil)
 }
 
 func (s *Server) handleDownloadPost(w http.ResponseWriter, r *http.Request) {
@@ -184,8 +634,23 @@ func (s *Server) handleDownloadPost(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
+	// The password form of a share link posts back to the link
+	if sharelink.IsSigned(r.URL.Query()) {
+		s.serveShared(w, r, meta)
+		return
+	}
+	if !s.canAccess(r, meta) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if meta.DownloadsExhausted() {
+		http.Error(w, "File has reached its download limit", http.StatusGone)
+		return
+	}
 
 	if !s.auth.CheckPassword(meta.PasswordHash, password) {
+		slog.Warn("Wrong download password", "file", filename, "ip", auth.ClientIP(r))
+		s.recordAudit(r, audit.Record{Action: audit.ActionPasswordFailed, File: filename})
 		data := map[string]interface{}{
 			"SiteTitle":    s.config.SiteTitle,
 			"Filename":     meta.OriginalFilename,
@@ -195,14 +660,175 @@ func (s *Server) handleDownloadPost(w http.ResponseWriter, r *http.Request) {
 		s.templates.Render(w, "password.html", data)
 		return
 	}
+	key, err := fileKey(meta, password)
+	if err != nil {
+		slog.Error("Failed to derive file key", "file", filename, "err", err)
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+
+	s.serveFile(w, r, meta, meta.OriginalFilename, "", key)
+}
+
+// serveFile sends a stored file and reports whether the client received
+// it completely. With an inlineType the file is shown in the browser as
+// that type rather than downloaded. key is needed for files encrypted with
+// their password.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, meta *fileops.FileMetadata, originalName, inlineType string, key *encryption.Key) bool {
+	filename := meta.Filename
+	var slot *fileops.DownloadSlot
+	if r.Method != http.MethodHead {
+		var ok bool
+		if slot, ok = s.reserveDownload(w, filename); !ok {
+			return false
+		}
+		// Given back unless the transfer completes
+		defer slot.Release()
+	}
+
+	s.metrics.activeTransfers.Inc("download")
+	defer s.metrics.activeTransfers.Dec("download")
+
+	f, err := fileops.OpenFile(s.config.UploadDir, meta, key)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Failed to open file", "file", filename, "err", err)
+		}
+		http.Error(w, "File not found", http.StatusNotFound)
+		return false
+	}
+	defer f.Close()
+	var content io.ReadSeeker = f
+	size := f.Size()
+
+	if inlineType != "" {
+		w.Header().Set("Content-Type", inlineType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Disposition", contentDisposition("inline", originalName))
+	} else {
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", originalName))
+	}
+	if z := f.Zstd(); z != nil {
+		w.Header().Add("Vary", "Accept-Encoding")
+		// Ranges would apply to the compressed bytes, which resuming
+		// clients don't expect, so those get the content decompressed
+		if r.Header.Get("Range") == "" && acceptsEncoding(r, "zstd") {
+			if inlineType == "" {
+				w.Header().Set("Content-Type", contentType(filename))
+			}
+			w.Header().Set("Content-Encoding", "zstd")
+			w.Header().Set("Content-Length", strconv.FormatInt(z.Size(), 10))
+			content, size = z, z.Size()
+		}
+	}
+	// A multipart/byteranges response has no single Content-Range to tell
+	// whether the end of the file was delivered, so several ranges get the
+	// whole file, which RFC 9110 allows
+	if strings.Contains(r.Header.Get("Range"), ",") {
+		r.Header.Del("Range")
+	}
+	rec := newResponseRecorder(w)
+	http.ServeContent(rec, r, filename, f.ModTime(), content)
+
+	slog.Info("File downloaded", "file", filename, "bytes", rec.bytes, "status", rec.status, "ip", auth.ClientIP(r))
+	s.recordAudit(r, audit.Record{
+		Action:  audit.ActionDownload,
+		File:    filename,
+		Detail:  fmt.Sprintf("status=%d bytes=%d", rec.status, rec.bytes),
+		Success: rec.status < 400,
+	})
+
+	// HEAD requests, revalidations, missing files and bad ranges aren't
+	// downloads; only full (200) and partial (206) responses are counted
+	if r.Method == http.MethodHead || (rec.status != http.StatusOK && rec.status != http.StatusPartialContent) {
+		return false
+	}
+	s.metrics.downloads.Inc()
+	s.metrics.downloadBytes.Add(float64(rec.bytes))
+	complete := transferComplete(rec, size)
+	event := fileops.DownloadEvent{
+		Time:      time.Now(),
+		IP:        auth.ClientIP(r),
+		UserAgent: r.UserAgent(),
+		Bytes:     rec.bytes,
+		Completed: complete,
+	}
+	if err := fileops.AppendDownloadEvent(s.config.UploadDir, filename, event); err != nil {
+		slog.Error("Failed to record download event", "file", filename, "err", err)
+	}
+
+	// Only a transfer that delivered the end of the file counts, so that
+	// aborted downloads and revalidations don't use up the limit while a
+	// client resuming with a range request does complete it
+	if !complete {
+		return false
+	}
+	s.recordCompletedDownload(r, slot)
+	return true
+}
+
+// reserveDownload sets a download of filename aside before its content is
+// sent, answering 410 when the downloads in progress use up its limit
+func (s *Server) reserveDownload(w http.ResponseWriter, filename string) (*fileops.DownloadSlot, bool) {
+	slot, err := fileops.ReserveDownload(s.config.UploadDir, filename)
+	if err != nil {
+		if errors.Is(err, fileops.ErrDownloadLimit) {
+			http.Error(w, "File has reached its download limit", http.StatusGone)
+		} else {
+			http.Error(w, "File not found", http.StatusNotFound)
+		}
+		return nil, false
+	}
+	return slot, true
+}
 
-	s.serveFile(w, r, filename, meta.OriginalFilename)
+// recordCompletedDownload counts the reserved download as one that
+// delivered the whole file, sends the notifications for it and deletes the
+// file once its download limit is reached. It returns the updated
+// metadata, or nil on error.
+func (s *Server) recordCompletedDownload(r *http.Request, slot *fileops.DownloadSlot) *fileops.FileMetadata {
+	filename := slot.Filename()
+	meta, err := slot.Complete()
+	if err != nil {
+		slog.Error("Failed to record download", "file", filename, "err", err)
+		return nil
+	}
+	if meta.Downloads == 1 {
+		s.webhooks.Enqueue(webhook.EventFileFirstDownload, fileEventData(meta))
+	}
+	s.notifyDownloaded(r, meta)
+
+	if meta.DownloadsExhausted() {
+		err := fileops.DeleteFile(s.config.UploadDir, filename)
+		slog.Info("File reached its download limit", "file", filename, "downloads", meta.Downloads, "err", err)
+		s.recordAudit(r, audit.Record{
+			Action:  audit.ActionDelete,
+			Actor:   "system",
+			File:    filename,
+			Detail:  fmt.Sprintf("download limit of %d reached", meta.MaxDownloads),
+			Success: err == nil,
+		})
+		if err == nil {
+			s.webhooks.Enqueue(webhook.EventFileDeleted, fileEventData(meta))
+		}
+	}
+	return meta
 }
 
-func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, filename, originalName string) {
-	path := filepath.Join(s.config.UploadDir, filename)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", originalName))
-	http.ServeFile(w, r, path)
+// transferComplete reports whether a file response sent everything up to
+// and including the last byte of the file
+func transferComplete(rec *responseRecorder, size int64) bool {
+	switch rec.status {
+	case http.StatusOK:
+		return rec.bytes == size
+	case http.StatusPartialContent:
+		var start, end, total int64
+		if _, err := fmt.Sscanf(rec.Header().Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil {
+			return false
+		}
+		return end == total-1 && rec.bytes == end-start+1
+	}
+	return false
 }
 
 func (s *Server) handleAdminLogin(w http.ResponseWriter, r *http.Request) {
@@ -211,7 +837,9 @@ func (s *Server) handleAdminLogin(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleAdminLoginPost(w http.ResponseWriter, r *http.Request) {
 	password := r.FormValue("password")
-	if token, ok := s.auth.Login(password); ok {
+	if token, ok := s.auth.Login(password, auth.ClientIP(r)); ok {
+		slog.Info("Admin logged in", "ip", auth.ClientIP(r))
+		s.recordAudit(r, audit.Record{Action: audit.ActionLogin, Actor: "admin", Success: true})
 		http.SetCookie(w, &http.Cookie{
 			Name:  "session_token",
 			Value: token,
@@ -220,6 +848,8 @@ func (s *Server) handleAdminLoginPost(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/admin", http.StatusSeeOther)
 		return
 	}
+	slog.Warn("Admin login failed", "ip", auth.ClientIP(r))
+	s.recordAudit(r, audit.Record{Action: audit.ActionLoginFailed})
 	s.templates.Render(w, "admin/login.html", map[string]interface{}{
 		"SiteTitle": s.config.SiteTitle,
 		"Error":     true,
@@ -238,9 +868,46 @@ func (s *Server) handleAdminLogout(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleAdminDashboard(w http.ResponseWriter, r *http.Request) {
 	files, _ := fileops.GetFiles(s.config.UploadDir)
+	usage, err := s.quota.Usage()
+	if err != nil {
+		slog.Error("Failed to read storage usage", "err", err)
+	}
 	s.templates.Render(w, "admin/dashboard.html", map[string]interface{}{
 		"SiteTitle": s.config.SiteTitle,
 		"Files":     files,
+		"Usage":     usage,
+		"Limits":    s.config.Quota,
+	})
+}
+
+func (s *Server) handleAdminFileDetail(w http.ResponseWriter, r *http.Request) {
+	filename := r.PathValue("filename")
+	meta, err := fileops.GetFile(s.config.UploadDir, filename)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	events, err := fileops.GetDownloadEvents(s.config.UploadDir, filename)
+	if err != nil {
+		http.Error(w, "Failed to read download history", http.StatusInternalServerError)
+		return
+	}
+
+	// Scale the chart to the busiest day
+	daily := fileops.DownloadsPerDay(events, 14)
+	peak := 1
+	for _, d := range daily {
+		if d.Completed+d.Aborted > peak {
+			peak = d.Completed + d.Aborted
+		}
+	}
+
+	s.templates.Render(w, "admin/file.html", map[string]interface{}{
+		"SiteTitle": s.config.SiteTitle,
+		"File":      meta,
+		"Events":    events,
+		"Daily":     daily,
+		"Peak":      peak,
 	})
 }
 
@@ -252,28 +919,68 @@ func (s *Server) handleAdminPasswordPost(w http.ResponseWriter, r *http.Request)
 	oldPass := r.FormValue("old_password")
 	newPass := r.FormValue("new_password")
 
-	if s.auth.ChangePassword(oldPass, newPass) {
+	if ok, msg := s.auth.ChangePassword(oldPass, newPass); ok {
+		slog.Info("Admin password changed", "ip", auth.ClientIP(r))
+		s.recordAudit(r, audit.Record{Action: audit.ActionPasswordChange, Success: true})
 		http.Redirect(w, r, "/admin", http.StatusSeeOther)
 	} else {
+		s.recordAudit(r, audit.Record{Action: audit.ActionPasswordChange, Detail: msg})
 		s.templates.Render(w, "admin/change_password.html", map[string]interface{}{
 			"SiteTitle": s.config.SiteTitle,
-			"Error":     true,
+			"Error":     msg,
 		})
 	}
 }
 
 func (s *Server) handleAdminDeleteFile(w http.ResponseWriter, r *http.Request) {
 	filename := r.PathValue("filename")
-	os.Remove(fmt.Sprintf("%s/%s", s.config.UploadDir, filename))
-	os.Remove(fmt.Sprintf("%s/.%s.json", s.config.UploadDir, filename))
+	detail := ""
+	meta, metaErr := fileops.GetFile(s.config.UploadDir, filename)
+	if metaErr == nil {
+		detail = "original_filename=" + meta.OriginalFilename
+	}
+	err := fileops.DeleteFile(s.config.UploadDir, filename)
+	slog.Info("File deleted by admin", "file", filename, "ip", auth.ClientIP(r))
+	s.recordAudit(r, audit.Record{Action: audit.ActionDelete, File: filename, Detail: detail, Success: err == nil})
+	if err == nil && metaErr == nil {
+		s.webhooks.Enqueue(webhook.EventFileDeleted, fileEventData(meta))
+	}
 	http.Redirect(w, r, "/admin", http.StatusSeeOther)
 }
 
-func (s *Server) cleanupTask() {
+func (s *Server) cleanupTask(ctx context.Context) {
 	ticker := time.NewTicker(1 * time.Hour)
-	for range ticker.C {
-		if err := fileops.Cleanup(s.config.UploadDir); err != nil {
-			log.Printf("Error cleaning up files: %v", err)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.warnExpiringFiles()
+			removed, err := fileops.Cleanup(s.config.UploadDir)
+			if err != nil {
+				slog.Error("Error cleaning up files", "err", err)
+			}
+			if len(removed) > 0 {
+				slog.Info("Expired files removed", "count", len(removed))
+			}
+			s.metrics.filesExpired.Add(float64(len(removed)))
+			for i := range removed {
+				s.webhooks.Enqueue(webhook.EventFileExpired, fileEventData(&removed[i]))
+			}
+			if err := s.shares.Prune(); err != nil {
+				slog.Error("Error pruning share links", "err", err)
+			}
+			err = s.shortLinks.Prune(func(filename string) bool {
+				_, err := fileops.GetFile(s.config.UploadDir, filename)
+				return err == nil
+			})
+			if err != nil {
+				slog.Error("Error pruning short links", "err", err)
+			}
+			if err := s.requests.Prune(); err != nil {
+				slog.Error("Error pruning upload requests", "err", err)
+			}
 		}
 	}
 }
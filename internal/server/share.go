@@ -0,0 +1,262 @@
+package server
+
+import (
+	"errors"
+	"filestation/internal/audit"
+	"filestation/internal/auth"
+	"filestation/internal/encryption"
+	"filestation/internal/fileops"
+	"filestation/internal/sharelink"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// maxShareLifetime caps how long a signed link may stay valid
+const maxShareLifetime = 365 * 24 * time.Hour
+
+// shareLinkView is an issued link together with its full URL
+type shareLinkView struct {
+	sharelink.Link
+	URL    string
+	Active bool
+}
+
+// canManage reports whether the visitor may issue and revoke share links
+// for the file
+func (s *Server) canManage(r *http.Request, meta *fileops.FileMetadata) bool {
+	return s.isOwner(r, meta) || s.auth.IsAdmin(r)
+}
+
+// shareURL returns the signed download URL of link, or "" if the key that
+// signed it has been retired
+func (s *Server) shareURL(r *http.Request, link *sharelink.Link) string {
+	query := s.shares.Query(link)
+	if query == "" {
+		return ""
+	}
+	return s.baseURL(r) + "/download/" + url.PathEscape(link.Filename) + "?" + query
+}
+
+func (s *Server) shareLinkViews(r *http.Request, links []sharelink.Link) []shareLinkView {
+	views := make([]shareLinkView, len(links))
+	for i := range links {
+		link := &links[i]
+		views[i] = shareLinkView{Link: *link, URL: s.shareURL(r, link)}
+		views[i].Active = link.Active() && views[i].URL != ""
+	}
+	return views
+}
+
+// actor names who created a share link or upload request, for the stores
+// and the audit log
+func (s *Server) actor(r *http.Request) string {
+	if s.auth.IsAdmin(r) {
+		return "admin"
+	}
+	return "owner"
+}
+
+func (s *Server) renderSharePage(w http.ResponseWriter, r *http.Request, meta *fileops.FileMetadata, errMsg string) {
+	s.templates.Render(w, "share.html", map[string]interface{}{
+		"SiteTitle": s.config.SiteTitle,
+		"File":      meta,
+		"Links":     s.shareLinkViews(r, s.shares.Links(meta.Filename)),
+		"ClientIP":  auth.ClientIP(r),
+		"Error":     errMsg,
+	})
+}
+
+func (s *Server) handleSharePage(w http.ResponseWriter, r *http.Request) {
+	meta, err := fileops.GetFile(s.config.UploadDir, r.PathValue("filename"))
+	if err != nil || !s.canManage(r, meta) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	s.renderSharePage(w, r, meta, "")
+}
+
+func (s *Server) handleShareCreate(w http.ResponseWriter, r *http.Request) {
+	meta, err := fileops.GetFile(s.config.UploadDir, r.PathValue("filename"))
+	if err != nil || !s.canManage(r, meta) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	hours, err := strconv.Atoi(r.FormValue("hours"))
+	if err != nil || hours < 1 || time.Duration(hours)*time.Hour > maxShareLifetime {
+		s.renderSharePage(w, r, meta, "有效期无效")
+		return
+	}
+	expires := time.Now().Add(time.Duration(hours) * time.Hour)
+	// A link never outlives the file it points to
+	if !meta.ExpirationTime.IsZero() && expires.After(meta.ExpirationTime) {
+		expires = meta.ExpirationTime
+	}
+
+	maxUses := 0
+	if v := r.FormValue("max_uses"); v != "" {
+		maxUses, err = strconv.Atoi(v)
+		if err != nil || maxUses < 0 {
+			s.renderSharePage(w, r, meta, "下载次数无效")
+			return
+		}
+	}
+
+	ip := ""
+	if r.FormValue("bind_ip") != "" {
+		ip = auth.ClientIP(r)
+		if v := r.FormValue("ip"); v != "" {
+			ip = v
+		}
+	}
+
+	link, err := s.shares.Create(meta.Filename, expires, ip, maxUses, s.actor(r))
+	if err != nil {
+		slog.Error("Failed to create share link", "file", meta.Filename, "err", err)
+		http.Error(w, "Failed to create share link", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Share link created", "file", meta.Filename, "link", link.ID, "expires", link.Expires, "ip", auth.ClientIP(r))
+	s.recordAudit(r, audit.Record{
+		Action:  audit.ActionShareCreate,
+		Actor:   s.actor(r),
+		File:    meta.Filename,
+		Detail:  fmt.Sprintf("link=%s expires=%s bind_ip=%s max_uses=%d", link.ID, link.Expires.Format(time.RFC3339), link.IP, link.MaxUses),
+		Success: true,
+	})
+	http.Redirect(w, r, "/files/"+url.PathEscape(meta.Filename)+"/share", http.StatusSeeOther)
+}
+
+func (s *Server) handleShareRevoke(w http.ResponseWriter, r *http.Request) {
+	meta, err := fileops.GetFile(s.config.UploadDir, r.PathValue("filename"))
+	if err != nil || !s.canManage(r, meta) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	link, ok := s.shares.Get(r.PathValue("id"))
+	if !ok || link.Filename != meta.Filename {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	s.revokeShare(r, link)
+
+	redirect := "/files/" + url.PathEscape(meta.Filename) + "/share"
+	if r.FormValue("from") == "admin" && s.auth.IsAdmin(r) {
+		redirect = "/admin/shares"
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+func (s *Server) revokeShare(r *http.Request, link *sharelink.Link) {
+	err := s.shares.Revoke(link.ID)
+	if err != nil {
+		slog.Error("Failed to revoke share link", "link", link.ID, "err", err)
+	}
+	s.recordAudit(r, audit.Record{
+		Action:  audit.ActionShareRevoke,
+		Actor:   s.actor(r),
+		File:    link.Filename,
+		Detail:  "link=" + link.ID,
+		Success: err == nil,
+	})
+}
+
+func (s *Server) handleAdminShares(w http.ResponseWriter, r *http.Request) {
+	s.templates.Render(w, "admin/shares.html", map[string]interface{}{
+		"SiteTitle": s.config.SiteTitle,
+		"Links":     s.shareLinkViews(r, s.shares.Links("")),
+		"Keys":      s.shares.Keys(),
+	})
+}
+
+func (s *Server) handleAdminShareRotate(w http.ResponseWriter, r *http.Request) {
+	retireOld := r.FormValue("retire_old") != ""
+	err := s.shares.Rotate(retireOld)
+	if err != nil {
+		slog.Error("Failed to rotate share link key", "err", err)
+	}
+	slog.Info("Share link key rotated", "retire_old", retireOld, "ip", auth.ClientIP(r))
+	s.recordAudit(r, audit.Record{
+		Action:  audit.ActionKeyRotate,
+		Detail:  fmt.Sprintf("retire_old=%t", retireOld),
+		Success: err == nil,
+	})
+	http.Redirect(w, r, "/admin/shares", http.StatusSeeOther)
+}
+
+// shareLinkError is the message shown for a share link that fails to verify
+func shareLinkError(err error) string {
+	switch {
+	case errors.Is(err, sharelink.ErrExpired):
+		return "Share link has expired"
+	case errors.Is(err, sharelink.ErrRevoked):
+		return "Share link has been revoked"
+	case errors.Is(err, sharelink.ErrWrongIP):
+		return "Share link is not valid from this address"
+	case errors.Is(err, sharelink.ErrExhausted):
+		return "Share link has reached its download limit"
+	}
+	return "Invalid share link"
+}
+
+// serveShared serves a download made through a signed share link. The link
+// stands in for the file password and visibility check, except for files
+// encrypted with their password, which can't be read without it.
+func (s *Server) serveShared(w http.ResponseWriter, r *http.Request, meta *fileops.FileMetadata) {
+	use, err := s.shares.Verify(meta.Filename, r.URL.Query(), auth.ClientIP(r))
+	if err != nil {
+		slog.Warn("Share link rejected", "file", meta.Filename, "link", r.URL.Query().Get("link"), "err", err, "ip", auth.ClientIP(r))
+		http.Error(w, shareLinkError(err), http.StatusForbidden)
+		return
+	}
+	defer use.Release()
+	link := use.Link
+	if meta.Blocked() {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if meta.DownloadsExhausted() {
+		http.Error(w, "File has reached its download limit", http.StatusGone)
+		return
+	}
+	if meta.E2E != "" {
+		if s.serveE2E(w, r, meta) {
+			if err := use.Complete(); err != nil {
+				slog.Error("Failed to record share link use", "link", link.ID, "err", err)
+			}
+		}
+		return
+	}
+	var key *encryption.Key
+	if meta.PasswordKDF != nil {
+		password := r.PostFormValue("password")
+		if r.Method != http.MethodPost || !s.auth.CheckPassword(meta.PasswordHash, password) {
+			if r.Method == http.MethodPost {
+				slog.Warn("Wrong download password", "file", meta.Filename, "link", link.ID, "ip", auth.ClientIP(r))
+				s.recordAudit(r, audit.Record{Action: audit.ActionPasswordFailed, File: meta.Filename})
+			}
+			s.templates.Render(w, "password.html", map[string]interface{}{
+				"SiteTitle":    s.config.SiteTitle,
+				"Filename":     meta.OriginalFilename,
+				"RealFilename": meta.Filename,
+				"Error":        r.Method == http.MethodPost,
+			})
+			return
+		}
+		if key, err = fileKey(meta, password); err != nil {
+			slog.Error("Failed to derive file key", "file", meta.Filename, "err", err)
+			http.Error(w, "Failed to read file", http.StatusInternalServerError)
+			return
+		}
+	}
+	slog.Info("Share link used", "file", meta.Filename, "link", link.ID, "ip", auth.ClientIP(r))
+	if s.serveFile(w, r, meta, meta.OriginalFilename, "", key) {
+		if err := use.Complete(); err != nil {
+			slog.Error("Failed to record share link use", "link", link.ID, "err", err)
+		}
+	}
+}
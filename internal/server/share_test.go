@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParallelShareLinkDownloads(t *testing.T) {
+	s := newTestServer(t)
+	const content = "shared once"
+	name := upload(t, s, content, nil)
+	link, err := s.shares.Create(name, time.Now().Add(time.Hour), "", 1, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "/download/" + name + "?" + s.shares.Query(link)
+	query, _ := url.ParseQuery(s.shares.Query(link))
+
+	// A download in progress holds the only use left
+	use, err := s.shares.Verify(name, query, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("download while another is in progress: %d %q", rec.Code, rec.Body)
+	}
+
+	// Once it fails the use is available again
+	use.Release()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	served := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			if rec.Body.String() == content {
+				mu.Lock()
+				served++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if served != 1 {
+		t.Fatalf("single-use share link was served %d times", served)
+	}
+	if link, _ := s.shares.Get(link.ID); link.Uses != 1 {
+		t.Errorf("link uses = %d, want 1", link.Uses)
+	}
+}
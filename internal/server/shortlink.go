@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"filestation/internal/fileops"
+	"filestation/internal/shortlink"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// qrQuietZone is the white border around a QR code, in modules
+const qrQuietZone = 4
+
+// handleCreateShortLink returns the short link for a file's download URL,
+// or for one of its signed share links when target is given
+func (s *Server) handleCreateShortLink(w http.ResponseWriter, r *http.Request) {
+	filename := r.PathValue("filename")
+	meta, err := fileops.GetFile(s.config.UploadDir, filename)
+	if err != nil || !s.canAccess(r, meta) {
+		s.jsonError(w, http.StatusNotFound, "File not found")
+		return
+	}
+
+	path := "/download/" + url.PathEscape(filename)
+	target := path
+	if v := r.FormValue("target"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || u.EscapedPath() != path {
+			s.jsonError(w, http.StatusBadRequest, "Link does not belong to this file")
+			return
+		}
+		target = path
+		if u.RawQuery != "" {
+			target += "?" + u.RawQuery
+		}
+	}
+
+	code, err := s.shortLinks.Shorten(filename, target, secretLink(meta, target))
+	if err != nil {
+		slog.Error("Failed to create short link", "file", filename, "err", err)
+		s.jsonError(w, http.StatusInternalServerError, "Failed to create short link")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"code":      code,
+		"url":       s.baseURL(r) + target,
+		"short_url": s.baseURL(r) + "/s/" + code,
+	})
+}
+
+// handleShortLink redirects a short code to the URL it stands for
+func (s *Server) handleShortLink(w http.ResponseWriter, r *http.Request) {
+	link, err := s.shortLinks.Resolve(r.PathValue("code"))
+	if err != nil {
+		http.Error(w, "Link not found", http.StatusNotFound)
+		return
+	}
+	meta, err := fileops.GetFile(s.config.UploadDir, link.Filename)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	// Codes made before the file was hidden are too short to keep it so
+	if secretLink(meta, link.Target) && len(link.Code) < shortlink.SecretCodeLength {
+		http.Error(w, "Link not found", http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, link.Target, http.StatusFound)
+}
+
+// secretLink reports whether a short link to target must be as hard to
+// guess as the target itself: the download of a file off the public
+// index, or a signed share link
+func secretLink(meta *fileops.FileMetadata, target string) bool {
+	return !meta.IsPublic() || strings.Contains(target, "?")
+}
+
+// handleQRCode renders a link on this site as a QR code image. Other
+// content is refused so the endpoint can't be used as a generic encoder.
+func (s *Server) handleQRCode(w http.ResponseWriter, r *http.Request) {
+	text := r.FormValue("url")
+	if !strings.HasPrefix(text, s.baseURL(r)+"/") {
+		http.Error(w, "Only links to this site can be encoded", http.StatusBadRequest)
+		return
+	}
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		http.Error(w, "Link too long for a QR code", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if r.FormValue("download") != "" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"qrcode.%s\"", r.PathValue("format")))
+	}
+	switch r.PathValue("format") {
+	case "png":
+		code.Scale = 8
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(code.PNG())
+	case "svg":
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(qrSVG(code))
+	default:
+		http.Error(w, "Unsupported format", http.StatusNotFound)
+	}
+}
+
+// qrSVG draws each dark module as a unit square of a single path
+func qrSVG(code *qr.Code) []byte {
+	size := code.Size + 2*qrQuietZone
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Black(x, y) {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x+qrQuietZone, y+qrQuietZone)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return []byte(b.String())
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/json"
+	"filestation/internal/shortlink"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestShortLinkLength(t *testing.T) {
+	s := newTestServer(t)
+	for _, tt := range []struct {
+		visibility string
+		length     int
+	}{
+		{"public", shortlink.CodeLength},
+		{"unlisted", shortlink.SecretCodeLength},
+	} {
+		name := upload(t, s, "content", map[string]string{"visibility": tt.visibility})
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/files/"+name+"/shortlink", nil))
+		var result struct{ Code string }
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil || len(result.Code) != tt.length {
+			t.Fatalf("%s short link: %d %s, want a code of %d characters", tt.visibility, rec.Code, rec.Body, tt.length)
+		}
+		rec = httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/s/"+result.Code, nil))
+		if rec.Code != http.StatusFound {
+			t.Errorf("%s short link redirect: %d", tt.visibility, rec.Code)
+		}
+	}
+}
+
+// A code made while a file was public doesn't reach it once it is hidden
+func TestShortCodeOfHiddenFile(t *testing.T) {
+	s := newTestServer(t)
+	name := upload(t, s, "content", map[string]string{"visibility": "unlisted"})
+	code, err := s.shortLinks.Shorten(name, "/download/"+url.PathEscape(name), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/s/"+code, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("short code of an unlisted file: %d, want 404", rec.Code)
+	}
+}
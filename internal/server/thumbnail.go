@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"filestation/internal/fileops"
+	"filestation/internal/thumbnail"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// queueThumbnail asks the thumbnail worker to make a thumbnail of an
+// uploaded image. Password protected files never get one.
+func (s *Server) queueThumbnail(meta *fileops.FileMetadata) {
+	if meta.HasPassword || meta.Thumbnail || !thumbnail.Supported(meta.OriginalFilename) {
+		return
+	}
+	select {
+	case s.thumbnails <- meta.Filename:
+	default:
+		// The worker catches up on missed files when it next starts
+		slog.Warn("Thumbnail queue full", "file", meta.Filename)
+	}
+}
+
+// thumbnailWorker makes thumbnails one at a time so that a burst of
+// uploads doesn't decode many large images at once
+func (s *Server) thumbnailWorker(ctx context.Context) {
+	// Images uploaded while the server was down or the queue was full
+	if files, err := fileops.GetFiles(s.config.UploadDir); err == nil {
+		for _, f := range files {
+			if ctx.Err() != nil {
+				return
+			}
+			if !f.IsTemp && !f.HasPassword && !f.Thumbnail && thumbnail.Supported(f.OriginalFilename) {
+				s.makeThumbnail(f.Filename)
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case filename := <-s.thumbnails:
+			s.makeThumbnail(filename)
+		}
+	}
+}
+
+func (s *Server) makeThumbnail(filename string) {
+	meta, err := fileops.GetFile(s.config.UploadDir, filename)
+	if err != nil || meta.HasPassword || meta.Thumbnail || meta.Blocked() {
+		return
+	}
+	src, err := fileops.OpenFile(s.config.UploadDir, meta, nil)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	err = fileops.WriteThumbnail(s.config.UploadDir, filename, func(dst io.Writer) error {
+		return thumbnail.Generate(src, dst)
+	})
+	if err != nil {
+		// Not an image after all, or a broken one; the card keeps its icon
+		slog.Warn("Failed to make thumbnail", "file", filename, "err", err)
+		return
+	}
+
+	err = fileops.UpdateMetadata(s.config.UploadDir, filename, func(meta *fileops.FileMetadata) error {
+		if meta.HasPassword {
+			return errors.New("file is password protected")
+		}
+		meta.Thumbnail = true
+		return nil
+	})
+	if err != nil {
+		// Deleted while the thumbnail was made
+		os.Remove(fileops.ThumbnailPath(s.config.UploadDir, filename))
+		return
+	}
+	slog.Info("Thumbnail created", "file", filename)
+}
+
+// handleThumbnail serves the thumbnail of a file the visitor can access.
+// Thumbnails don't change, so browsers may keep them for a day.
+func (s *Server) handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	meta, err := fileops.GetFile(s.config.UploadDir, r.PathValue("filename"))
+	if err != nil || !s.canAccess(r, meta) || meta.HasPassword || !meta.Thumbnail {
+		http.Error(w, "Thumbnail not found", http.StatusNotFound)
+		return
+	}
+	f, err := fileops.OpenThumbnail(s.config.UploadDir, meta.Filename)
+	if err != nil {
+		http.Error(w, "Thumbnail not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	if meta.IsPublic() {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+	} else {
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", f.ModTime(), f)
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"filestation/internal/fileops"
+	"net/http"
+	"time"
+)
+
+// fileEventData is the "data" object sent with file webhooks. The password
+// hash and uploader device are deliberately left out.
+func fileEventData(meta *fileops.FileMetadata) map[string]interface{} {
+	data := map[string]interface{}{
+		"filename":          meta.Filename,
+		"original_filename": meta.OriginalFilename,
+		"description":       meta.Description,
+		"size":              meta.Size,
+		"upload_time":       meta.UploadTime,
+		"has_password":      meta.HasPassword,
+		"visibility":        meta.Visibility,
+		"uploader_ip":       meta.Uploader.IP,
+	}
+	if !meta.ExpirationTime.IsZero() {
+		data["expiration_time"] = meta.ExpirationTime
+	}
+	if !meta.FirstDownload.IsZero() {
+		data["first_download"] = meta.FirstDownload
+	}
+	if meta.MaxDownloads > 0 {
+		data["max_downloads"] = meta.MaxDownloads
+	}
+	data["downloads"] = meta.Downloads
+	return data
+}
+
+func (s *Server) handleAdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	s.templates.Render(w, "admin/webhooks.html", map[string]interface{}{
+		"SiteTitle":  s.config.SiteTitle,
+		"Enabled":    s.webhooks.Enabled(),
+		"Deliveries": s.webhooks.Deliveries(),
+		"Now":        time.Now(),
+	})
+}
+
+func (s *Server) handleAdminWebhookRedeliver(w http.ResponseWriter, r *http.Request) {
+	if err := s.webhooks.Redeliver(r.PathValue("id")); err != nil {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
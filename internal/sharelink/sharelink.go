@@ -0,0 +1,365 @@
+// Package sharelink issues HMAC-signed, expiring download links. The link
+// parameters are covered by the signature; issued links are also kept in
+// a store so they can be listed, counted and revoked.
+package sharelink
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalid   = errors.New("invalid share link")
+	ErrExpired   = errors.New("share link expired")
+	ErrRevoked   = errors.New("share link revoked")
+	ErrWrongIP   = errors.New("share link bound to another IP")
+	ErrExhausted = errors.New("share link download limit reached")
+)
+
+// Key is a signing secret. The newest key signs new links; older keys keep
+// verifying the links they signed until they are retired.
+type Key struct {
+	ID      string    `json:"id"`
+	Secret  string    `json:"secret"`
+	Created time.Time `json:"created"`
+}
+
+type Link struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	Expires   time.Time `json:"expires"`
+	IP        string    `json:"ip,omitempty"`
+	MaxUses   int       `json:"max_uses,omitempty"` // 0 means unlimited
+	Uses      int       `json:"uses"`
+	KeyID     string    `json:"key_id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by"`
+	Revoked   bool      `json:"revoked,omitempty"`
+}
+
+// Active reports whether the link can still be used.
+func (l *Link) Active() bool {
+	return !l.Revoked && time.Now().Before(l.Expires) && (l.MaxUses == 0 || l.Uses < l.MaxUses)
+}
+
+type state struct {
+	Keys  []Key   `json:"keys"`
+	Links []*Link `json:"links"`
+}
+
+type Manager struct {
+	mu    sync.Mutex
+	path  string
+	state state
+	// pending counts the downloads in progress per link, which Verify
+	// reserves against MaxUses
+	pending map[string]int
+}
+
+// Open loads the key and link store at path, creating a first key if the
+// store is new.
+func Open(path string) (*Manager, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	m := &Manager{path: path, pending: make(map[string]int)}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &m.state); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	if len(m.state.Keys) == 0 {
+		m.state.Keys = append(m.state.Keys, newKey())
+		if err := m.saveLocked(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func newKey() Key {
+	return Key{ID: randomString(4), Secret: randomString(32), Created: time.Now()}
+}
+
+func (m *Manager) currentKeyLocked() Key {
+	return m.state.Keys[len(m.state.Keys)-1]
+}
+
+func (m *Manager) keyLocked(id string) (Key, bool) {
+	for _, k := range m.state.Keys {
+		if k.ID == id {
+			return k, true
+		}
+	}
+	return Key{}, false
+}
+
+// Create issues a link for filename valid until expires. ip binds the link
+// to one client address and maxUses limits completed downloads; both are
+// optional.
+func (m *Manager) Create(filename string, expires time.Time, ip string, maxUses int, createdBy string) (*Link, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	link := &Link{
+		ID:        randomString(9),
+		Filename:  filename,
+		Expires:   expires.Truncate(time.Second),
+		IP:        ip,
+		MaxUses:   maxUses,
+		KeyID:     m.currentKeyLocked().ID,
+		CreatedAt: time.Now(),
+		CreatedBy: createdBy,
+	}
+	m.state.Links = append(m.state.Links, link)
+	if err := m.saveLocked(); err != nil {
+		return nil, err
+	}
+	copied := *link
+	return &copied, nil
+}
+
+// Query returns the signed query string for link.
+func (m *Manager) Query(link *Link) string {
+	m.mu.Lock()
+	key, ok := m.keyLocked(link.KeyID)
+	m.mu.Unlock()
+	if !ok {
+		return ""
+	}
+
+	v := url.Values{}
+	v.Set("link", link.ID)
+	v.Set("exp", strconv.FormatInt(link.Expires.Unix(), 10))
+	if link.IP != "" {
+		v.Set("ip", link.IP)
+	}
+	if link.MaxUses > 0 {
+		v.Set("max", strconv.Itoa(link.MaxUses))
+	}
+	v.Set("kid", key.ID)
+	v.Set("sig", sign(key.Secret, link.Filename, v))
+	return v.Encode()
+}
+
+// sign covers the filename and every link parameter except the signature.
+func sign(secret, filename string, v url.Values) string {
+	msg := fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n%s", v.Get("link"), filename, v.Get("exp"), v.Get("ip"), v.Get("max"), v.Get("kid"))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(msg))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// IsSigned reports whether a request query carries share link parameters.
+func IsSigned(v url.Values) bool {
+	return v.Get("sig") != ""
+}
+
+// Verify checks the signed parameters in v for a download of filename by
+// clientIP and reserves a use of the link they belong to. The use must be
+// completed or released once the transfer ends.
+func (m *Manager) Verify(filename string, v url.Values, clientIP string) (*Use, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, ok := m.keyLocked(v.Get("kid"))
+	if !ok {
+		return nil, ErrInvalid
+	}
+	expected := sign(key.Secret, filename, v)
+	if !hmac.Equal([]byte(expected), []byte(v.Get("sig"))) {
+		return nil, ErrInvalid
+	}
+
+	exp, err := strconv.ParseInt(v.Get("exp"), 10, 64)
+	if err != nil || time.Now().After(time.Unix(exp, 0)) {
+		return nil, ErrExpired
+	}
+	if ip := v.Get("ip"); ip != "" && ip != clientIP {
+		return nil, ErrWrongIP
+	}
+
+	link := m.findLocked(v.Get("link"))
+	if link == nil || link.Filename != filename {
+		return nil, ErrInvalid
+	}
+	if link.Revoked {
+		return nil, ErrRevoked
+	}
+	if link.MaxUses > 0 && link.Uses+m.pending[link.ID] >= link.MaxUses {
+		return nil, ErrExhausted
+	}
+	m.pending[link.ID]++
+	copied := *link
+	return &Use{Link: &copied, m: m}, nil
+}
+
+// Use is a download through a link set aside by Verify while the file is
+// transferred, so that parallel requests can't together go past MaxUses.
+type Use struct {
+	Link *Link // A copy of the link as it was verified
+
+	m    *Manager
+	done bool // Guarded by m.mu
+}
+
+// Complete counts the reserved use as a completed download.
+func (u *Use) Complete() error {
+	m := u.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u.releaseLocked()
+	link := m.findLocked(u.Link.ID)
+	if link == nil {
+		return ErrInvalid
+	}
+	link.Uses++
+	return m.saveLocked()
+}
+
+// Release gives back a use whose download didn't complete. It does
+// nothing after Complete.
+func (u *Use) Release() {
+	u.m.mu.Lock()
+	defer u.m.mu.Unlock()
+	u.releaseLocked()
+}
+
+func (u *Use) releaseLocked() {
+	if u.done {
+		return
+	}
+	u.done = true
+	if u.m.pending[u.Link.ID]--; u.m.pending[u.Link.ID] <= 0 {
+		delete(u.m.pending, u.Link.ID)
+	}
+}
+
+// Revoke disables a link.
+func (m *Manager) Revoke(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	link := m.findLocked(id)
+	if link == nil {
+		return ErrInvalid
+	}
+	link.Revoked = true
+	return m.saveLocked()
+}
+
+// Get returns a copy of the link with id.
+func (m *Manager) Get(id string) (*Link, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	link := m.findLocked(id)
+	if link == nil {
+		return nil, false
+	}
+	copied := *link
+	return &copied, true
+}
+
+// Links returns issued links, newest first. An empty filename returns the
+// links of all files.
+func (m *Manager) Links(filename string) []Link {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var links []Link
+	for _, l := range m.state.Links {
+		if filename == "" || l.Filename == filename {
+			links = append(links, *l)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].CreatedAt.After(links[j].CreatedAt)
+	})
+	return links
+}
+
+// Rotate makes a new key the signing key. With retireOld, all previous
+// keys are dropped and every link they signed stops working.
+func (m *Manager) Rotate(retireOld bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := newKey()
+	if retireOld {
+		m.state.Keys = []Key{key}
+	} else {
+		m.state.Keys = append(m.state.Keys, key)
+	}
+	return m.saveLocked()
+}
+
+// Keys returns the signing keys without their secrets, oldest first.
+func (m *Manager) Keys() []Key {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]Key, len(m.state.Keys))
+	for i, k := range m.state.Keys {
+		keys[i] = Key{ID: k.ID, Created: k.Created}
+	}
+	return keys
+}
+
+// Prune forgets links that expired more than a week ago.
+func (m *Manager) Prune() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := time.Now().Add(-7 * 24 * time.Hour)
+	kept := m.state.Links[:0]
+	for _, l := range m.state.Links {
+		if l.Expires.After(cutoff) {
+			kept = append(kept, l)
+		}
+	}
+	m.state.Links = kept
+	return m.saveLocked()
+}
+
+func (m *Manager) findLocked(id string) *Link {
+	for _, l := range m.state.Links {
+		if l.ID == id {
+			return l
+		}
+	}
+	return nil
+}
+
+func (m *Manager) saveLocked() error {
+	data, err := json.MarshalIndent(m.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
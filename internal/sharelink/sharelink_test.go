@@ -0,0 +1,183 @@
+package sharelink
+
+import (
+	"errors"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func openManager(t *testing.T) *Manager {
+	t.Helper()
+	m, err := Open(filepath.Join(t.TempDir(), "sharelinks.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func createLink(t *testing.T, m *Manager, ip string, maxUses int) (*Link, url.Values) {
+	t.Helper()
+	link, err := m.Create("abc_report.pdf", time.Now().Add(time.Hour), ip, maxUses, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := url.ParseQuery(m.Query(link))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link, v
+}
+
+func verify(m *Manager, filename string, v url.Values, ip string) error {
+	use, err := m.Verify(filename, v, ip)
+	if err == nil {
+		use.Release()
+	}
+	return err
+}
+
+func TestVerify(t *testing.T) {
+	m := openManager(t)
+	link, v := createLink(t, m, "192.0.2.1", 0)
+	if !IsSigned(v) {
+		t.Fatal("query is not signed")
+	}
+	use, err := m.Verify("abc_report.pdf", v, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if use.Link.ID != link.ID {
+		t.Errorf("Verify returned link %s, want %s", use.Link.ID, link.ID)
+	}
+	use.Release()
+
+	tampered := func(key, value string) url.Values {
+		c := url.Values{}
+		for k, vs := range v {
+			c[k] = append([]string(nil), vs...)
+		}
+		c.Set(key, value)
+		return c
+	}
+	for _, tt := range []struct {
+		name     string
+		filename string
+		v        url.Values
+		ip       string
+		want     error
+	}{
+		{"other file", "abc_other.pdf", v, "192.0.2.1", ErrInvalid},
+		{"extended expiry", "abc_report.pdf", tampered("exp", strconv.FormatInt(time.Now().Add(time.Hour*24).Unix(), 10)), "192.0.2.1", ErrInvalid},
+		{"dropped IP", "abc_report.pdf", tampered("ip", ""), "192.0.2.2", ErrInvalid},
+		{"raised limit", "abc_report.pdf", tampered("max", "100"), "192.0.2.1", ErrInvalid},
+		{"forged signature", "abc_report.pdf", tampered("sig", "AAAA"), "192.0.2.1", ErrInvalid},
+		{"unknown key", "abc_report.pdf", tampered("kid", "nope"), "192.0.2.1", ErrInvalid},
+		{"other IP", "abc_report.pdf", v, "192.0.2.2", ErrWrongIP},
+	} {
+		if err := verify(m, tt.filename, tt.v, tt.ip); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	m := openManager(t)
+	link, err := m.Create("abc_report.pdf", time.Now().Add(-time.Minute), "", 0, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := url.ParseQuery(m.Query(link))
+	if err := verify(m, "abc_report.pdf", v, ""); !errors.Is(err, ErrExpired) {
+		t.Errorf("expired link: got %v, want ErrExpired", err)
+	}
+}
+
+func TestUses(t *testing.T) {
+	m := openManager(t)
+	link, v := createLink(t, m, "", 2)
+
+	first, err := m.Verify("abc_report.pdf", v, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := m.Verify("abc_report.pdf", v, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both uses are reserved while their downloads run
+	if err := verify(m, "abc_report.pdf", v, ""); !errors.Is(err, ErrExhausted) {
+		t.Fatalf("third parallel use: got %v, want ErrExhausted", err)
+	}
+	if err := first.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	first.Release()
+	second.Release()
+	second.Release()
+
+	// The released use can be taken again, the completed one can't
+	third, err := m.Verify("abc_report.pdf", v, "")
+	if err != nil {
+		t.Fatalf("use after a release: %v", err)
+	}
+	if err := third.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(m, "abc_report.pdf", v, ""); !errors.Is(err, ErrExhausted) {
+		t.Errorf("use after the limit: got %v, want ErrExhausted", err)
+	}
+
+	// Uses are kept across restarts
+	reopened, err := Open(m.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := reopened.Get(link.ID); got.Uses != 2 || got.Active() {
+		t.Errorf("reopened link: uses %d, active %t", got.Uses, got.Active())
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	m := openManager(t)
+	link, v := createLink(t, m, "", 0)
+	if err := m.Revoke(link.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(m, "abc_report.pdf", v, ""); !errors.Is(err, ErrRevoked) {
+		t.Errorf("revoked link: got %v, want ErrRevoked", err)
+	}
+	if err := m.Revoke("missing"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("revoking an unknown link: got %v, want ErrInvalid", err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	m := openManager(t)
+	_, old := createLink(t, m, "", 0)
+	if err := m.Rotate(false); err != nil {
+		t.Fatal(err)
+	}
+	newLink, current := createLink(t, m, "", 0)
+	if newLink.KeyID == old.Get("kid") {
+		t.Fatal("Rotate did not change the signing key")
+	}
+	if len(m.Keys()) != 2 || m.Keys()[0].Secret != "" {
+		t.Errorf("Keys = %+v, want two keys without secrets", m.Keys())
+	}
+	// Older keys keep verifying their links until retired
+	if err := verify(m, "abc_report.pdf", old, ""); err != nil {
+		t.Errorf("link signed with the previous key: %v", err)
+	}
+
+	if err := m.Rotate(true); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []url.Values{old, current} {
+		if err := verify(m, "abc_report.pdf", v, ""); !errors.Is(err, ErrInvalid) {
+			t.Errorf("link signed with a retired key: got %v, want ErrInvalid", err)
+		}
+	}
+}
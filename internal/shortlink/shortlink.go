@@ -0,0 +1,157 @@
+// Package shortlink maps short codes to download URLs on this site, so
+// that links stay readable and fit in a small QR code.
+package shortlink
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("short link not found")
+
+// codeAlphabet leaves out characters that are easily confused when a code
+// is read aloud or typed from paper: 0/O, 1/l/I
+const codeAlphabet = "23456789abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ"
+
+const (
+	// CodeLength is the length of codes for links anyone can find anyway,
+	// such as downloads of files on the public index
+	CodeLength = 6
+	// SecretCodeLength is the length of codes for links that must not be
+	// guessed, about 128 bits, as long as the random names they stand for
+	SecretCodeLength = 22
+)
+
+type Link struct {
+	Code     string    `json:"code"`
+	Filename string    `json:"filename"`
+	Target   string    `json:"target"` // Path and query on this site
+	Created  time.Time `json:"created"`
+}
+
+type Store struct {
+	mu    sync.Mutex
+	path  string
+	links map[string]*Link
+}
+
+// Open loads the store at path, starting empty if it does not exist.
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	s := &Store{path: path, links: make(map[string]*Link)}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		var links []*Link
+		if err := json.Unmarshal(data, &links); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		for _, l := range links {
+			s.links[l.Code] = l
+		}
+	}
+	return s, nil
+}
+
+// Shorten returns the code for target, creating one if target has none yet.
+// filename is the stored file the target belongs to, used by Prune. Secret
+// targets get codes of SecretCodeLength, and never reuse a shorter code
+// made before the target became secret.
+func (s *Store) Shorten(filename, target string, secret bool) (string, error) {
+	length := CodeLength
+	if secret {
+		length = SecretCodeLength
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, l := range s.links {
+		if l.Target == target && len(l.Code) >= length {
+			return l.Code, nil
+		}
+	}
+	code := newCode(length)
+	for s.links[code] != nil {
+		code = newCode(length)
+	}
+	s.links[code] = &Link{Code: code, Filename: filename, Target: target, Created: time.Now()}
+	if err := s.saveLocked(); err != nil {
+		delete(s.links, code)
+		return "", err
+	}
+	return code, nil
+}
+
+// Resolve returns the link with code.
+func (s *Store) Resolve(code string) (*Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.links[code]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	copied := *l
+	return &copied, nil
+}
+
+// Prune removes the codes of files for which exists reports false.
+func (s *Store) Prune(exists func(filename string) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := false
+	for code, l := range s.links {
+		if !exists(l.Filename) {
+			delete(s.links, code)
+			removed = true
+		}
+	}
+	if !removed {
+		return nil
+	}
+	return s.saveLocked()
+}
+
+func (s *Store) saveLocked() error {
+	links := make([]*Link, 0, len(s.links))
+	for _, l := range s.links {
+		links = append(links, l)
+	}
+	data, err := json.MarshalIndent(links, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// newCode draws length characters uniformly from codeAlphabet
+func newCode(length int) string {
+	// Bytes at or above the largest multiple of the alphabet size are
+	// dropped, so every character is equally likely
+	limit := 256 - 256%len(codeAlphabet)
+	code := make([]byte, 0, length)
+	b := make([]byte, length)
+	for len(code) < length {
+		rand.Read(b)
+		for _, c := range b {
+			if int(c) < limit && len(code) < length {
+				code = append(code, codeAlphabet[int(c)%len(codeAlphabet)])
+			}
+		}
+	}
+	return string(code)
+}
@@ -2,8 +2,10 @@ package templates
 
 import (
 	"embed"
+	"filestation/internal/fileops"
 	"html/template"
 	"io"
+	iofs "io/fs"
 	"time"
 )
 
@@ -25,11 +27,42 @@ func New() (*TemplateManager, error) {
 		"year": func() int {
 			return time.Now().Year()
 		},
+		"percent": func(part, whole int) int {
+			if whole == 0 {
+				return 0
+			}
+			return part * 100 / whole
+		},
+		// percent64 is percent for byte counts, capped at 100 for bars
+		"percent64": func(part, whole int64) int64 {
+			if whole <= 0 {
+				return 0
+			}
+			return min(part*100/whole, 100)
+		},
+		"add": func(a, b int) int {
+			return a + b
+		},
+		"formatSize": fileops.FormatSize,
 	}
 
-	tmpl, err := template.New("").Funcs(funcMap).ParseFS(fs, "*.html", "admin/*.html")
-	if err != nil {
-		return nil, err
+	// Templates are named by their path (e.g. "admin/login.html") so pages
+	// in subdirectories don't collide with top-level ones
+	tmpl := template.New("").Funcs(funcMap)
+	for _, pattern := range []string{"*.html", "admin/*.html"} {
+		paths, err := iofs.Glob(fs, pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			content, err := fs.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := tmpl.New(path).Parse(string(content)); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return &TemplateManager{
@@ -0,0 +1,70 @@
+// Package thumbnail makes small JPEG previews of uploaded images.
+package thumbnail
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"path/filepath"
+	"strings"
+
+	_ "image/gif"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Size is the longest side of a thumbnail in pixels, enough for the cards
+// on high density screens
+const Size = 256
+
+// maxPixels refuses images that would take too much memory to decode
+const maxPixels = 50_000_000
+
+var ErrTooLarge = errors.New("image too large for a thumbnail")
+
+// Supported reports whether a thumbnail can be made of a file called name.
+func Supported(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+		return true
+	}
+	return false
+}
+
+// Generate decodes a JPEG, PNG, GIF or WebP image from src and writes a
+// JPEG thumbnail of it to dst. Transparent areas become white. Only the
+// first frame of an animated GIF is used.
+func Generate(src io.ReadSeeker, dst io.Writer) error {
+	config, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return err
+	}
+	if config.Width*config.Height > maxPixels {
+		return ErrTooLarge
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w > Size || h > Size {
+		if w > h {
+			w, h = Size, max(1, h*Size/w)
+		} else {
+			w, h = max(1, w*Size/h), Size
+		}
+	}
+	thumb := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(thumb, thumb.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), img, bounds, draw.Over, nil)
+	return jpeg.Encode(dst, thumb, &jpeg.Options{Quality: 80})
+}
@@ -0,0 +1,226 @@
+// Package uploadrequest stores upload request links: pages where people
+// without access to the site can send files to whoever created the link.
+package uploadrequest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("upload request not found")
+	ErrClosed   = errors.New("upload request is closed")
+	ErrFull     = errors.New("upload request has received all files")
+)
+
+type Request struct {
+	ID           string    `json:"id"`
+	Title        string    `json:"title"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+	MaxFileSize  int64     `json:"max_file_size,omitempty"` // Bytes, 0 means unlimited
+	MaxFiles     int       `json:"max_files,omitempty"`     // 0 means unlimited
+	Extensions   []string  `json:"extensions,omitempty"`    // Lower case with dot, empty allows all
+	Deadline     time.Time `json:"deadline"`
+	Retention    int       `json:"retention"` // Hours received files are kept
+	Owner        string    `json:"owner"`     // Owner ID the received files are private to
+	NotifyEmail  string    `json:"notify_email,omitempty"`
+	NotifyLocale string    `json:"notify_locale,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	CreatedBy    string    `json:"created_by"`
+	Closed       bool      `json:"closed,omitempty"`
+	Files        []string  `json:"files,omitempty"` // Stored names of received files
+
+	HasPassword bool `json:"-"`
+}
+
+// Open reports whether the request still accepts uploads.
+func (r *Request) Open() bool {
+	return !r.Closed && time.Now().Before(r.Deadline) && (r.MaxFiles == 0 || len(r.Files) < r.MaxFiles)
+}
+
+// Allows reports whether a file called name may be uploaded.
+func (r *Request) Allows(name string) bool {
+	if len(r.Extensions) == 0 {
+		return true
+	}
+	lower := strings.ToLower(name)
+	for _, ext := range r.Extensions {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseExtensions turns a list such as "pdf, .docx  zip" into the form
+// stored in Request.Extensions.
+func ParseExtensions(list string) []string {
+	var exts []string
+	for _, f := range strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '，'
+	}) {
+		f = strings.ToLower(strings.TrimPrefix(f, "."))
+		if f != "" {
+			exts = append(exts, "."+f)
+		}
+	}
+	return exts
+}
+
+type Store struct {
+	mu       sync.Mutex
+	path     string
+	requests []*Request
+}
+
+// Open reads the store at path, starting empty if it does not exist.
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	s := &Store{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.requests); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	return s, nil
+}
+
+// Create stores req under a new random ID.
+func (s *Store) Create(req Request) (*Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := make([]byte, 12)
+	rand.Read(b)
+	req.ID = hex.EncodeToString(b)
+	req.CreatedAt = time.Now()
+	s.requests = append(s.requests, &req)
+	if err := s.saveLocked(); err != nil {
+		s.requests = s.requests[:len(s.requests)-1]
+		return nil, err
+	}
+	return copyRequest(&req), nil
+}
+
+// Get returns the request with id.
+func (s *Store) Get(id string) (*Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req := s.findLocked(id)
+	if req == nil {
+		return nil, ErrNotFound
+	}
+	return copyRequest(req), nil
+}
+
+// List returns the requests created by owner, newest first. An empty owner
+// returns all requests.
+func (s *Store) List(owner string) []*Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []*Request
+	for _, req := range s.requests {
+		if owner == "" || req.Owner == owner {
+			list = append(list, copyRequest(req))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	return list
+}
+
+// AddFile records a received file, failing if the request closed or filled
+// up while the file was being uploaded.
+func (s *Store) AddFile(id, filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req := s.findLocked(id)
+	if req == nil {
+		return ErrNotFound
+	}
+	if req.Closed || !time.Now().Before(req.Deadline) {
+		return ErrClosed
+	}
+	if req.MaxFiles > 0 && len(req.Files) >= req.MaxFiles {
+		return ErrFull
+	}
+	req.Files = append(req.Files, filename)
+	return s.saveLocked()
+}
+
+// Close stops a request from accepting further uploads.
+func (s *Store) Close(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req := s.findLocked(id)
+	if req == nil {
+		return ErrNotFound
+	}
+	req.Closed = true
+	return s.saveLocked()
+}
+
+// Prune forgets requests whose deadline passed more than 30 days ago.
+func (s *Store) Prune() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().AddDate(0, 0, -30)
+	kept := s.requests[:0]
+	for _, req := range s.requests {
+		if req.Deadline.After(cutoff) {
+			kept = append(kept, req)
+		}
+	}
+	if len(kept) == len(s.requests) {
+		return nil
+	}
+	s.requests = kept
+	return s.saveLocked()
+}
+
+func (s *Store) findLocked(id string) *Request {
+	for _, req := range s.requests {
+		if req.ID == id {
+			return req
+		}
+	}
+	return nil
+}
+
+func (s *Store) saveLocked() error {
+	data, err := json.MarshalIndent(s.requests, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func copyRequest(req *Request) *Request {
+	copied := *req
+	copied.Extensions = append([]string(nil), req.Extensions...)
+	copied.Files = append([]string(nil), req.Files...)
+	copied.HasPassword = req.PasswordHash != ""
+	return &copied
+}
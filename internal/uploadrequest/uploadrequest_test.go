@@ -0,0 +1,131 @@
+package uploadrequest
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "upload_requests.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestParseExtensions(t *testing.T) {
+	got := ParseExtensions("pdf, .DOCX  zip，tar.gz,,")
+	want := []string{".pdf", ".docx", ".zip", ".tar.gz"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseExtensions = %q, want %q", got, want)
+	}
+	if got := ParseExtensions(" , "); got != nil {
+		t.Errorf("ParseExtensions of separators = %q, want nil", got)
+	}
+}
+
+func TestAllows(t *testing.T) {
+	req := &Request{Extensions: []string{".pdf", ".tar.gz"}}
+	for name, want := range map[string]bool{
+		"report.pdf":     true,
+		"REPORT.PDF":     true,
+		"backup.tar.gz":  true,
+		"backup.gz":      false,
+		"report.pdf.exe": false,
+		"pdf":            false,
+	} {
+		if got := req.Allows(name); got != want {
+			t.Errorf("Allows(%q) = %t, want %t", name, got, want)
+		}
+	}
+	if !(&Request{}).Allows("anything.exe") {
+		t.Error("a request without extensions refused a file")
+	}
+}
+
+func TestAddFile(t *testing.T) {
+	s := openStore(t)
+	req, err := s.Create(Request{Title: "photos", MaxFiles: 3, Deadline: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Parallel uploads can't go past the file limit
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	added, full := 0, 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.AddFile(req.ID, "file")
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				added++
+			case errors.Is(err, ErrFull):
+				full++
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if added != 3 || full != 7 {
+		t.Errorf("added %d files and refused %d as full, want 3 and 7", added, full)
+	}
+	if got, _ := s.Get(req.ID); got.Open() {
+		t.Error("full request is still open")
+	}
+
+	open, err := s.Create(Request{Title: "docs", Deadline: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(open.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddFile(open.ID, "file"); !errors.Is(err, ErrClosed) {
+		t.Errorf("AddFile to a closed request: got %v, want ErrClosed", err)
+	}
+	late, err := s.Create(Request{Title: "late", Deadline: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddFile(late.ID, "file"); !errors.Is(err, ErrClosed) {
+		t.Errorf("AddFile after the deadline: got %v, want ErrClosed", err)
+	}
+	if err := s.AddFile("missing", "file"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("AddFile to an unknown request: got %v, want ErrNotFound", err)
+	}
+
+	// Received files are kept across restarts
+	reopened, err := Open(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := reopened.Get(req.ID); err != nil || len(got.Files) != 3 {
+		t.Errorf("reopened request: %+v, %v", got, err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	s := openStore(t)
+	old, _ := s.Create(Request{Title: "old", Deadline: time.Now().AddDate(0, 0, -31)})
+	recent, _ := s.Create(Request{Title: "recent", Deadline: time.Now().AddDate(0, 0, -29)})
+	if err := s.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(old.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("request past its deadline by 31 days: got %v, want ErrNotFound", err)
+	}
+	if _, err := s.Get(recent.ID); err != nil {
+		t.Errorf("request past its deadline by 29 days: %v", err)
+	}
+}
@@ -0,0 +1,392 @@
+// Package webhook delivers signed JSON event notifications to configured
+// endpoints. Deliveries are kept in a file-backed queue so pending retries
+// survive a restart, and finished ones form the delivery log shown to admins.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Events
+const (
+	EventFileUploaded      = "file.uploaded"
+	EventFileFirstDownload = "file.first_download"
+	EventFileExpired       = "file.expired"
+	EventFileDeleted       = "file.deleted"
+)
+
+// Delivery states
+const (
+	StatePending   = "pending"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+)
+
+const (
+	maxAttempts     = 8
+	baseBackoff     = 10 * time.Second
+	maxBackoff      = time.Hour
+	requestTimeout  = 10 * time.Second
+	pollInterval    = 5 * time.Second
+	keepDeliveries  = 500
+	signatureHeader = "X-Filestation-Signature"
+)
+
+// Hook is one configured endpoint. An empty Events list subscribes to all
+// events.
+type Hook struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+func (h Hook) wants(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadHooks reads a JSON array of hooks from path.
+func LoadHooks(path string) ([]Hook, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []Hook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, h := range hooks {
+		if h.URL == "" {
+			return nil, fmt.Errorf("parse %s: hook %d has no url", path, i)
+		}
+	}
+	return hooks, nil
+}
+
+type Delivery struct {
+	ID          string          `json:"id"`
+	Event       string          `json:"event"`
+	URL         string          `json:"url"`
+	Payload     json.RawMessage `json:"payload"`
+	State       string          `json:"state"`
+	Attempts    int             `json:"attempts"`
+	CreatedAt   time.Time       `json:"created_at"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastStatus  int             `json:"last_status,omitempty"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+type Dispatcher struct {
+	mu         sync.Mutex
+	hooks      []Hook
+	path       string
+	deliveries []*Delivery
+	client     *http.Client
+	wake       chan struct{}
+}
+
+// New creates a dispatcher that persists its queue at path.
+func New(path string, hooks []Hook) (*Dispatcher, error) {
+	d := &Dispatcher{
+		hooks:  hooks,
+		path:   path,
+		client: &http.Client{Timeout: requestTimeout},
+		wake:   make(chan struct{}, 1),
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &d.deliveries); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	return d, nil
+}
+
+// Enabled reports whether any hooks are configured.
+func (d *Dispatcher) Enabled() bool {
+	return len(d.hooks) > 0
+}
+
+// Enqueue queues event for every hook subscribed to it. data becomes the
+// "data" field of the payload.
+func (d *Dispatcher) Enqueue(event string, data interface{}) {
+	if !d.Enabled() {
+		return
+	}
+
+	now := time.Now()
+	payload, err := json.Marshal(map[string]interface{}{
+		"event": event,
+		"time":  now,
+		"data":  data,
+	})
+	if err != nil {
+		slog.Error("Failed to encode webhook payload", "event", event, "err", err)
+		return
+	}
+
+	d.mu.Lock()
+	for _, h := range d.hooks {
+		if !h.wants(event) {
+			continue
+		}
+		d.deliveries = append(d.deliveries, &Delivery{
+			ID:          newID(),
+			Event:       event,
+			URL:         h.URL,
+			Payload:     payload,
+			State:       StatePending,
+			CreatedAt:   now,
+			NextAttempt: now,
+		})
+	}
+	d.saveLocked()
+	d.mu.Unlock()
+
+	d.notify()
+}
+
+func (d *Dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends due deliveries until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		d.processDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+func (d *Dispatcher) processDue(ctx context.Context) {
+	d.mu.Lock()
+	now := time.Now()
+	due := make(map[string][]Delivery)
+	for _, del := range d.deliveries {
+		if del.State == StatePending && !del.NextAttempt.After(now) {
+			due[del.URL] = append(due[del.URL], *del)
+		}
+	}
+	d.mu.Unlock()
+
+	// Endpoints are sent to concurrently so a slow one doesn't hold up
+	// the others; each still gets its deliveries in order.
+	var wg sync.WaitGroup
+	for _, dels := range due {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, del := range dels {
+				if ctx.Err() != nil {
+					return
+				}
+				status, err := d.send(ctx, del)
+				// An attempt cut short by shutdown is retried after restart
+				if ctx.Err() != nil {
+					return
+				}
+				d.finishAttempt(del.ID, status, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (d *Dispatcher) send(ctx context.Context, del Delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, del.URL, bytes.NewReader(del.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "filestation-webhook")
+	req.Header.Set("X-Filestation-Event", del.Event)
+	req.Header.Set("X-Filestation-Delivery", del.ID)
+	if secret := d.secretFor(del.URL); secret != "" {
+		req.Header.Set(signatureHeader, "sha256="+Sign(secret, del.Payload))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *Dispatcher) secretFor(url string) string {
+	for _, h := range d.hooks {
+		if h.URL == url {
+			return h.Secret
+		}
+	}
+	return ""
+}
+
+func (d *Dispatcher) finishAttempt(id string, status int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	del := d.findLocked(id)
+	if del == nil {
+		return
+	}
+	del.Attempts++
+	del.LastStatus = status
+	del.LastError = ""
+	switch {
+	case err == nil:
+		del.State = StateSucceeded
+	case del.Attempts >= maxAttempts:
+		del.State = StateFailed
+		del.LastError = err.Error()
+	default:
+		del.LastError = err.Error()
+		del.NextAttempt = time.Now().Add(backoff(del.Attempts))
+	}
+	if err != nil {
+		slog.Warn("Webhook delivery failed", "id", id, "url", del.URL, "attempt", del.Attempts, "err", err)
+	}
+	d.pruneLocked()
+	d.saveLocked()
+}
+
+// backoff doubles the wait after each failed attempt.
+func backoff(attempts int) time.Duration {
+	wait := baseBackoff << (attempts - 1)
+	if wait > maxBackoff || wait <= 0 {
+		return maxBackoff
+	}
+	return wait
+}
+
+// Deliveries returns a snapshot of the delivery log, newest first.
+func (d *Dispatcher) Deliveries() []Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	list := make([]Delivery, len(d.deliveries))
+	for i, del := range d.deliveries {
+		list[i] = *del
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	return list
+}
+
+// Redeliver puts a delivery back in the queue for immediate sending.
+func (d *Dispatcher) Redeliver(id string) error {
+	d.mu.Lock()
+	del := d.findLocked(id)
+	if del == nil {
+		d.mu.Unlock()
+		return fmt.Errorf("delivery %s not found", id)
+	}
+	del.State = StatePending
+	del.Attempts = 0
+	del.NextAttempt = time.Now()
+	d.saveLocked()
+	d.mu.Unlock()
+
+	d.notify()
+	return nil
+}
+
+func (d *Dispatcher) findLocked(id string) *Delivery {
+	for _, del := range d.deliveries {
+		if del.ID == id {
+			return del
+		}
+	}
+	return nil
+}
+
+// pruneLocked drops the oldest finished deliveries beyond keepDeliveries.
+func (d *Dispatcher) pruneLocked() {
+	excess := len(d.deliveries) - keepDeliveries
+	if excess <= 0 {
+		return
+	}
+	kept := d.deliveries[:0]
+	for _, del := range d.deliveries {
+		if excess > 0 && del.State != StatePending {
+			excess--
+			continue
+		}
+		kept = append(kept, del)
+	}
+	d.deliveries = kept
+}
+
+func (d *Dispatcher) saveLocked() {
+	data, err := json.MarshalIndent(d.deliveries, "", "  ")
+	if err != nil {
+		slog.Error("Failed to encode webhook queue", "err", err)
+		return
+	}
+	tmp := d.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		slog.Error("Failed to save webhook queue", "err", err)
+		return
+	}
+	if err := os.Rename(tmp, d.path); err != nil {
+		slog.Error("Failed to save webhook queue", "err", err)
+	}
+}
+
+// Sign returns the hex HMAC-SHA256 of body, as sent in the
+// X-Filestation-Signature header after "sha256=".
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,60 @@
+package webhook
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A slow endpoint doesn't hold up deliveries to the others
+func TestProcessDueConcurrent(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+
+	d, err := New(filepath.Join(t.TempDir(), "webhooks.json"), []Hook{{URL: slow.URL}, {URL: fast.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Enqueue(EventFileUploaded, map[string]string{"file": "a.txt"})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.processDue(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for state(d, fast.URL) != StateSucceeded {
+		if time.Now().After(deadline) {
+			t.Fatal("delivery to the fast endpoint waited for the slow one")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Shutting down mid-send doesn't count as an attempt
+	cancel()
+	<-done
+	for _, del := range d.Deliveries() {
+		if del.URL == slow.URL && (del.State != StatePending || del.Attempts != 0) {
+			t.Errorf("interrupted delivery: state %s after %d attempts, want pending after 0", del.State, del.Attempts)
+		}
+	}
+}
+
+func state(d *Dispatcher, url string) string {
+	for _, del := range d.Deliveries() {
+		if del.URL == url {
+			return del.State
+		}
+	}
+	return ""
+}
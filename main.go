@@ -1,34 +1,258 @@
 package main
 
 import (
+	"context"
+	"filestation/internal/auth"
+	"filestation/internal/encryption"
+	"filestation/internal/fileops"
+	"filestation/internal/logging"
+	"filestation/internal/mailer"
+	"filestation/internal/quota"
+	"filestation/internal/ratelimit"
 	"filestation/internal/server"
+	"filestation/internal/webhook"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
 	port := flag.Int("port", 8080, "Port to run the server on")
+	drainTimeout := flag.Duration("drain-timeout", 5*time.Minute, "How long to wait for in-flight transfers on shutdown")
+	metricsToken := flag.String("metrics-token", os.Getenv("FILESTATION_METRICS_TOKEN"), "Bearer token required to read /metrics (default from FILESTATION_METRICS_TOKEN)")
+	baseURL := flag.String("base-url", "", "Public URL of the site, e.g. https://files.example.com; required with -smtp-host for emailed links")
+	smtpHost := flag.String("smtp-host", "", "SMTP server host; email notifications are disabled when empty")
+	smtpPort := flag.Int("smtp-port", 587, "SMTP server port")
+	smtpUser := flag.String("smtp-user", "", "SMTP username")
+	smtpPassword := flag.String("smtp-password", os.Getenv("FILESTATION_SMTP_PASSWORD"), "SMTP password (default from FILESTATION_SMTP_PASSWORD)")
+	smtpFrom := flag.String("smtp-from", "", "Sender address of notification emails")
+	smtpStartTLS := flag.Bool("smtp-starttls", true, "Use STARTTLS; disable only for a local SMTP sink")
+	webhooksFile := flag.String("webhooks", "", "JSON file listing webhook endpoints")
+	allowExt := flag.String("allow-ext", "", "Comma separated extensions uploads must have, e.g. pdf,docx,xlsx; empty allows all")
+	denyExt := flag.String("deny-ext", "", "Comma separated extensions to refuse, e.g. exe,msi,bat")
+	allowTypes := flag.String("allow-types", "", "Comma separated content types uploads must have, e.g. application/pdf,image/*; empty allows all")
+	denyTypes := flag.String("deny-types", "", "Comma separated content types to refuse, e.g. application/x-msdownload,application/x-executable")
+	clamd := flag.String("clamd", "", "clamd address to scan uploads with, e.g. tcp://localhost:3310 or unix:///run/clamav/clamd.ctl; scanning is off when empty")
+	scanTimeout := flag.Duration("scan-timeout", 5*time.Minute, "How long a single malware scan may take")
+	allowE2E := flag.Bool("e2e", true, "Accept uploads encrypted end to end in the browser; the type policy and malware scanner can't inspect them")
+	compress := flag.Bool("compress", false, "Store text-like uploads such as logs, CSV files and SQL dumps zstd compressed")
+	quotaTotal := flag.String("quota-total", "", "Space all stored files may take, e.g. 500GB; empty means unlimited")
+	quotaUser := flag.String("quota-user", "", "Space the files of one uploader may take, e.g. 10GB; empty means unlimited")
+	quotaIP := flag.String("quota-ip", "", "Space the files uploaded from one IP may take, e.g. 20GB; empty means unlimited")
+	minFree := flag.String("min-free", "", "Free disk space uploads must leave, e.g. 5GB; empty disables the check")
+	var rateLimits rateLimitFlags
+	flag.Var(&rateLimits, "rate-limit", `Limit per client IP for a route, e.g. "POST /upload=20/hour", "GET /download/{filename}=10GB/day" or "GET /download/{filename}=3 concurrent"; may be repeated`)
+	trustedProxies := flag.String("trusted-proxies", "", "Comma separated addresses or CIDR networks of reverse proxies, e.g. 127.0.0.1,10.0.0.0/8; only their X-Forwarded-For, X-Real-IP and X-Forwarded-Proto headers are believed. When empty the client IP is always the connection's address, so set it when running behind a proxy")
+	keyFile := flag.String("key-file", "", "File holding the 32 byte master key (hex or base64) that encrypts stored files; the key may also be given in FILESTATION_MASTER_KEY; encryption is off when neither is set")
+	rotateKey := flag.String("rotate-key", "", "Rewrap all stored files from the current master key to the key in this file, then exit; run it while the server is stopped")
+	logFormat := flag.String("log-format", "text", "Log output format: text or json")
+	logLevel := flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
+	logFile := flag.String("log-file", "", "Write logs to this file instead of stderr")
+	logMaxSize := flag.Int64("log-max-size", 100, "Rotate the log file after this many megabytes (0 disables)")
+	logMaxAge := flag.Duration("log-max-age", 24*time.Hour, "Rotate the log file after this long (0 disables)")
+	logMaxBackups := flag.Int("log-max-backups", 7, "Number of rotated log files to keep (0 keeps all)")
 	flag.Parse()
 
+	logger, logCloser, err := logging.New(logging.Options{
+		Format:     *logFormat,
+		Level:      *logLevel,
+		File:       *logFile,
+		MaxSize:    *logMaxSize << 20,
+		MaxAge:     *logMaxAge,
+		MaxBackups: *logMaxBackups,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up logging: %v\n", err)
+		os.Exit(2)
+	}
+	defer logCloser.Close()
+	slog.SetDefault(logger)
+
+	masterKey, err := loadMasterKey(*keyFile)
+	if err != nil {
+		fatal("Failed to load master key", err)
+	}
+
+	var limits quota.Limits
+	for _, q := range []struct {
+		flag  string
+		value string
+		dst   *int64
+	}{
+		{"quota-total", *quotaTotal, &limits.Total},
+		{"quota-user", *quotaUser, &limits.PerUser},
+		{"quota-ip", *quotaIP, &limits.PerIP},
+		{"min-free", *minFree, &limits.MinFree},
+	} {
+		if *q.dst, err = quota.ParseSize(q.value); err != nil {
+			fatal("Invalid -"+q.flag, err)
+		}
+	}
+
+	proxies := fileops.ParseList(*trustedProxies, false)
+	if err := auth.TrustProxies(proxies); err != nil {
+		fatal("Invalid -trusted-proxies", err)
+	}
+
+	var hooks []webhook.Hook
+	if *webhooksFile != "" {
+		if hooks, err = webhook.LoadHooks(*webhooksFile); err != nil {
+			fatal("Failed to load webhooks", err)
+		}
+	}
+
 	// Hardcoded configuration
 	config := server.Config{
 		Port:      *port,
 		SiteTitle: "文件中转站",
 		UploadDir: "uploads",
+		DataDir:   "data",
+
+		BaseURL: *baseURL,
+		Mail: mailer.Config{
+			Host:     *smtpHost,
+			Port:     *smtpPort,
+			Username: *smtpUser,
+			Password: *smtpPassword,
+			From:     *smtpFrom,
+			StartTLS: *smtpStartTLS,
+		},
+		Webhooks:     hooks,
+		MetricsToken: *metricsToken,
+		TypePolicy: fileops.TypePolicy{
+			AllowExtensions: fileops.ParseList(*allowExt, true),
+			DenyExtensions:  fileops.ParseList(*denyExt, true),
+			AllowTypes:      fileops.ParseList(*allowTypes, false),
+			DenyTypes:       fileops.ParseList(*denyTypes, false),
+		},
+
+		ClamAV:        *clamd,
+		ScanTimeout:   *scanTimeout,
+		QuarantineDir: "quarantine",
+		AllowE2E:      *allowE2E,
+		Compress:      *compress,
+		Quota:         limits,
+
+		RateLimits:     rateLimits,
+		TrustedProxies: proxies,
+	}
+
+	if *rotateKey != "" {
+		if err := rotate(masterKey, *rotateKey, config.UploadDir, config.QuarantineDir); err != nil {
+			fatal("Key rotation failed", err)
+		}
+		return
+	}
+	if masterKey != nil {
+		fileops.SetMasterKey(masterKey)
+		slog.Info("Encryption at rest enabled", "key", masterKey.ID())
 	}
 
 	// Ensure upload directory exists
 	if err := os.MkdirAll(config.UploadDir, 0755); err != nil {
-		log.Fatalf("Failed to create upload directory: %v", err)
+		fatal("Failed to create upload directory", err)
 	}
 
-	srv := server.New(config)
+	// Cancelled on SIGINT/SIGTERM; stops background tasks
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := server.New(ctx, config)
+	httpServer := &http.Server{
+		Addr:     fmt.Sprintf(":%d", config.Port),
+		Handler:  srv,
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+
+	go func() {
+		slog.Info("Starting server", "port", config.Port)
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fatal("Server failed", err)
+		}
+	}()
+
+	<-ctx.Done()
+	// A second signal kills the process immediately
+	stop()
+
+	slog.Info("Shutting down, waiting for transfers to finish", "timeout", *drainTimeout)
+	srv.Drain()
 
-	fmt.Printf("Starting server on port %d...\n", config.Port)
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", config.Port), srv); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Drain timed out, closing remaining connections", "err", err)
+		httpServer.Close()
 	}
+
+	if err := srv.Close(); err != nil {
+		slog.Error("Error removing incomplete uploads", "err", err)
+	}
+	slog.Info("Server stopped")
+}
+
+// loadMasterKey reads the master key from path, or from the environment
+// when no path is given. It returns nil when encryption is off.
+func loadMasterKey(path string) (*encryption.Key, error) {
+	if path != "" {
+		return encryption.LoadKey(path)
+	}
+	if env := os.Getenv("FILESTATION_MASTER_KEY"); env != "" {
+		return encryption.ParseKey([]byte(env))
+	}
+	return nil, nil
+}
+
+// rotate rewraps every stored file from the current master key to the one
+// in newKeyFile
+func rotate(current *encryption.Key, newKeyFile string, dirs ...string) error {
+	if current == nil {
+		return fmt.Errorf("the current master key is needed to rotate, set -key-file or FILESTATION_MASTER_KEY")
+	}
+	newKey, err := encryption.LoadKey(newKeyFile)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		n, skipped, err := fileops.RotateKey(dir, current, newKey)
+		if err != nil {
+			return err
+		}
+		// Files encrypted with their download password don't use the
+		// master key
+		slog.Info("Rewrapped data keys", "dir", dir, "files", n, "skipped", skipped, "from", current.ID(), "to", newKey.ID())
+	}
+	slog.Info("Key rotation done, restart the server with the new key", "key_file", newKeyFile)
+	return nil
+}
+
+// rateLimitFlags collects the repeated -rate-limit flags
+type rateLimitFlags []ratelimit.Rule
+
+func (f *rateLimitFlags) String() string {
+	rules := make([]string, len(*f))
+	for i, rule := range *f {
+		rules[i] = rule.String()
+	}
+	return strings.Join(rules, ", ")
+}
+
+func (f *rateLimitFlags) Set(value string) error {
+	rule, err := ratelimit.ParseRule(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, rule)
+	return nil
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
@@ -0,0 +1,96 @@
+// End-to-end encryption of uploads. Files are encrypted in the browser with
+// a random AES-GCM key that only travels in the #fragment of the link,
+// which browsers never send to the server. The server stores the
+// ciphertext and the sealed name and description as opaque data.
+const E2E = (() => {
+    // Plaintext bytes per chunk; chunks are sealed one by one so large
+    // files aren't encrypted in a single call
+    const CHUNK_SIZE = 1 << 20;
+    const TAG_SIZE = 16;
+    // No chunk index reaches a nonce starting with 0xff, so the metadata
+    // nonce never repeats one of theirs under the same key
+    const METADATA_IV = new Uint8Array([0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 2]);
+
+    const supported = !!(window.crypto && window.crypto.subtle);
+
+    // The nonce of a chunk is its index; the last chunk is flagged so a
+    // truncated file fails to decrypt instead of coming out short
+    function chunkIV(index, last) {
+        const iv = new Uint8Array(12);
+        const view = new DataView(iv.buffer);
+        view.setUint32(0, Math.floor(index / 0x100000000));
+        view.setUint32(4, index >>> 0);
+        iv[11] = last ? 1 : 0;
+        return iv;
+    }
+
+    function encode(buffer) {
+        const bytes = new Uint8Array(buffer);
+        let binary = '';
+        for (let i = 0; i < bytes.length; i++) {
+            binary += String.fromCharCode(bytes[i]);
+        }
+        return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+    }
+
+    function decode(text) {
+        const binary = atob(text.replace(/-/g, '+').replace(/_/g, '/'));
+        const bytes = new Uint8Array(binary.length);
+        for (let i = 0; i < binary.length; i++) {
+            bytes[i] = binary.charCodeAt(i);
+        }
+        return bytes;
+    }
+
+    // encryptFile seals file and its description under a new key. It
+    // returns the ciphertext, the sealed metadata to send along with it
+    // and the key to put in the link.
+    async function encryptFile(file, description, onProgress) {
+        const key = await crypto.subtle.generateKey({ name: 'AES-GCM', length: 256 }, true, ['encrypt', 'decrypt']);
+        const count = Math.max(1, Math.ceil(file.size / CHUNK_SIZE));
+        const parts = [];
+        for (let i = 0; i < count; i++) {
+            const plain = await file.slice(i * CHUNK_SIZE, (i + 1) * CHUNK_SIZE).arrayBuffer();
+            parts.push(await crypto.subtle.encrypt({ name: 'AES-GCM', iv: chunkIV(i, i === count - 1) }, key, plain));
+            if (onProgress) onProgress((i + 1) / count);
+        }
+        const info = JSON.stringify({ name: file.name, type: file.type, size: file.size, description: description || '' });
+        const metadata = await crypto.subtle.encrypt({ name: 'AES-GCM', iv: METADATA_IV }, key, new TextEncoder().encode(info));
+        const raw = await crypto.subtle.exportKey('raw', key);
+        return {
+            blob: new Blob(parts, { type: 'application/octet-stream' }),
+            metadata: encode(metadata),
+            key: encode(raw)
+        };
+    }
+
+    async function importKey(fragment) {
+        const raw = decode(fragment);
+        if (raw.length !== 32) {
+            throw new Error('invalid key');
+        }
+        return crypto.subtle.importKey('raw', raw, 'AES-GCM', false, ['decrypt']);
+    }
+
+    // decryptMetadata opens what encryptFile sealed as metadata
+    async function decryptMetadata(key, metadata) {
+        const plain = await crypto.subtle.decrypt({ name: 'AES-GCM', iv: METADATA_IV }, key, decode(metadata));
+        return JSON.parse(new TextDecoder().decode(plain));
+    }
+
+    // decryptData turns the ciphertext made by encryptFile back into a Blob
+    async function decryptData(key, data, type, onProgress) {
+        const sealedSize = CHUNK_SIZE + TAG_SIZE;
+        const count = Math.max(1, Math.ceil(data.byteLength / sealedSize));
+        const parts = [];
+        for (let i = 0; i < count; i++) {
+            const offset = i * sealedSize;
+            const chunk = new Uint8Array(data, offset, Math.min(sealedSize, data.byteLength - offset));
+            parts.push(await crypto.subtle.decrypt({ name: 'AES-GCM', iv: chunkIV(i, i === count - 1) }, key, chunk));
+            if (onProgress) onProgress((i + 1) / count);
+        }
+        return new Blob(parts, { type: type || 'application/octet-stream' });
+    }
+
+    return { supported, encryptFile, importKey, decryptMetadata, decryptData };
+})();
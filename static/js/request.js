@@ -0,0 +1,91 @@
+// Upload page of an upload request link. Files are sent one at a time so
+// each gets its own progress and result.
+document.addEventListener('DOMContentLoaded', () => {
+    const form = document.getElementById('requestForm');
+    if (!form) return;
+
+    const fileInput = document.getElementById('file');
+    const dropzone = document.getElementById('dropzone');
+    const list = document.getElementById('request-files');
+    const maxSize = parseInt(form.dataset.maxSize, 10) || 0;
+    let files = [];
+
+    function render() {
+        list.textContent = '';
+        files.forEach(item => {
+            const row = document.createElement('div');
+            row.className = 'request-file';
+            const name = document.createElement('span');
+            name.textContent = item.file.name;
+            item.status = document.createElement('span');
+            item.status.textContent = '等待上传';
+            if (maxSize && item.file.size > maxSize) {
+                item.status.textContent = '文件过大';
+                item.status.className = 'status-error';
+            }
+            row.appendChild(name);
+            row.appendChild(item.status);
+            list.appendChild(row);
+        });
+    }
+
+    function select(fileList) {
+        files = Array.from(fileList).map(file => ({ file: file }));
+        render();
+    }
+
+    fileInput.addEventListener('change', e => select(e.target.files));
+    ['dragover', 'dragleave', 'drop'].forEach(name => {
+        dropzone.addEventListener(name, e => {
+            e.preventDefault();
+            dropzone.classList.toggle('dragover', name === 'dragover');
+            if (name === 'drop') select(e.dataTransfer.files);
+        });
+    });
+
+    function send(item) {
+        return new Promise(resolve => {
+            const data = new FormData();
+            data.append('file', item.file);
+            data.append('message', document.getElementById('message').value);
+
+            const xhr = new XMLHttpRequest();
+            xhr.upload.addEventListener('progress', e => {
+                if (e.lengthComputable) {
+                    item.status.textContent = Math.round(e.loaded / e.total * 100) + '%';
+                }
+            });
+            xhr.addEventListener('loadend', () => {
+                let message = '上传失败';
+                let ok = false;
+                try {
+                    const result = JSON.parse(xhr.responseText);
+                    ok = xhr.status === 200 && result.success;
+                    message = result.message || message;
+                } catch (ignored) {
+                    if (xhr.status) message = '服务器错误: ' + xhr.status;
+                }
+                item.status.textContent = ok ? '已发送' : message;
+                item.status.className = ok ? 'status-success' : 'status-error';
+                resolve(ok);
+            });
+            xhr.open('POST', window.location.pathname);
+            // The password is checked before the file is accepted
+            const password = document.getElementById('password');
+            if (password) xhr.setRequestHeader('X-Request-Password', encodeURIComponent(password.value));
+            xhr.send(data);
+        });
+    }
+
+    form.addEventListener('submit', async e => {
+        e.preventDefault();
+        if (files.length === 0) return;
+        const button = form.querySelector('button[type="submit"]');
+        button.disabled = true;
+        for (const item of files) {
+            if (item.status.className === 'status-error' || item.status.className === 'status-success') continue;
+            await send(item);
+        }
+        button.disabled = false;
+    });
+});
@@ -0,0 +1,83 @@
+// Share dialog on the index cards: short link, full link and QR code
+document.addEventListener('DOMContentLoaded', function() {
+    const modal = document.getElementById('shareModal');
+    if (!modal) return;
+
+    const fileName = document.getElementById('shareFileName');
+    const shortUrl = document.getElementById('shareShortUrl');
+    const fullUrl = document.getElementById('shareFullUrl');
+    const qrImage = document.getElementById('shareQr');
+    const qrPng = document.getElementById('shareQrPng');
+    const qrSvg = document.getElementById('shareQrSvg');
+    const manage = document.getElementById('shareManage');
+    const manageLink = document.getElementById('shareManageLink');
+
+    function qrUrl(format, url, download) {
+        let src = '/qr/' + format + '?url=' + encodeURIComponent(url);
+        if (download) src += '&download=1';
+        return src;
+    }
+
+    function showQr(url) {
+        qrImage.src = qrUrl('svg', url);
+        qrPng.href = qrUrl('png', url, true);
+        qrSvg.href = qrUrl('svg', url, true);
+    }
+
+    function openShare(button) {
+        const filename = button.dataset.filename;
+        const path = '/files/' + encodeURIComponent(filename);
+
+        fileName.textContent = button.dataset.name;
+        fullUrl.value = window.location.origin + '/download/' + encodeURIComponent(filename);
+        shortUrl.value = '生成中...';
+        showQr(fullUrl.value);
+        manage.style.display = button.dataset.manage ? 'block' : 'none';
+        manageLink.href = path + '/share';
+        modal.style.display = 'block';
+
+        fetch(path + '/shortlink', { method: 'POST' })
+            .then(response => response.json())
+            .then(result => {
+                if (!result.success) throw new Error(result.message);
+                shortUrl.value = result.short_url;
+                fullUrl.value = result.url;
+                showQr(result.short_url);
+            })
+            .catch(error => {
+                shortUrl.value = '生成短链接失败: ' + error.message;
+            });
+    }
+
+    function closeShare() {
+        modal.style.display = 'none';
+    }
+
+    document.querySelectorAll('.share-btn-secondary').forEach(button => {
+        button.addEventListener('click', () => openShare(button));
+    });
+
+    modal.querySelectorAll('.share-copy-btn').forEach(button => {
+        button.addEventListener('click', () => {
+            const input = document.getElementById(button.dataset.copy);
+            input.select();
+            if (navigator.clipboard && window.isSecureContext) {
+                navigator.clipboard.writeText(input.value);
+            } else {
+                document.execCommand('copy');
+            }
+        });
+    });
+
+    [shortUrl, fullUrl].forEach(input => {
+        input.addEventListener('focus', () => input.select());
+    });
+
+    document.getElementById('shareCloseBtn').addEventListener('click', closeShare);
+    modal.addEventListener('click', e => {
+        if (e.target === modal) closeShare();
+    });
+    document.addEventListener('keydown', e => {
+        if (e.key === 'Escape' && modal.style.display === 'block') closeShare();
+    });
+});
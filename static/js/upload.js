@@ -17,7 +17,8 @@ document.addEventListener('DOMContentLoaded', () => {
     // State
     const state = {
         uploads: [],
-        completedUploads: 0
+        completedUploads: 0,
+        links: []
     };
 
     // Initialize
@@ -43,6 +44,19 @@ document.addEventListener('DOMContentLoaded', () => {
             elements.modalCloseBtn.addEventListener('click', closeModal);
         }
 
+        // A download password can't protect what the server can't read
+        const e2e = document.getElementById('e2e');
+        const password = document.getElementById('password');
+        if (e2e) {
+            if (!E2E.supported) {
+                e2e.disabled = true;
+                e2e.parentElement.title = '浏览器不支持加密，请通过 HTTPS 访问';
+            }
+            e2e.addEventListener('change', () => {
+                password.disabled = e2e.checked;
+            });
+        }
+
         window.addEventListener('click', (e) => {
             if (e.target === elements.modal) closeModal();
         });
@@ -111,6 +125,7 @@ document.addEventListener('DOMContentLoaded', () => {
         // Reset state
         state.uploads = files.map(file => ({ file, status: 'pending', progress: 0 }));
         state.completedUploads = 0;
+        state.links = [];
 
         // Update UI
         elements.uploadCount.textContent = files.length;
@@ -130,20 +145,71 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     }
 
-    function uploadFile(file, index, description) {
+    async function uploadFile(file, index, description) {
+        // End-to-end encrypted files are sealed here; the server only gets
+        // the ciphertext and never the name or description
+        const e2e = document.getElementById('e2e');
+        let sealed = null;
+        if (e2e && e2e.checked) {
+            updateFileStatus(index, 'encrypting');
+            try {
+                sealed = await E2E.encryptFile(file, description, progress => {
+                    updateFileProgress(index, Math.round(progress * 100));
+                });
+            } catch (error) {
+                updateFileStatus(index, 'error', 0, '加密失败: ' + error.message);
+                state.completedUploads++;
+                elements.completedCount.textContent = state.completedUploads;
+                throw error;
+            }
+        }
+
+        // Ask whether the file fits first; a refused upload would only be
+        // noticed after sending all of it
+        const size = sealed ? sealed.blob.size : file.size;
+        const check = await fetch('/upload/quota?size=' + size).catch(() => null);
+        if (check && check.status === 507) {
+            const result = await check.json().catch(() => ({}));
+            storageFull(index, result.message);
+            throw new Error(result.message);
+        }
+
         return new Promise((resolve, reject) => {
             const formData = new FormData();
-            formData.append('file', file);
-            formData.append('description', description);
-
-            const password = document.getElementById('password').value;
-            if (password) {
-                formData.append('password', password);
+            if (sealed) {
+                formData.append('file', sealed.blob, 'encrypted.bin');
+                formData.append('e2e', sealed.metadata);
+            } else {
+                formData.append('file', file);
+                formData.append('description', description);
+
+                const password = document.getElementById('password').value;
+                if (password) {
+                    formData.append('password', password);
+                }
             }
 
             const expiration = document.getElementById('expiration').value;
             formData.append('expiration', expiration);
 
+            const visibility = document.getElementById('visibility');
+            if (visibility) {
+                formData.append('visibility', visibility.value);
+            }
+
+            const maxDownloads = document.getElementById('max_downloads');
+            if (maxDownloads) {
+                formData.append('max_downloads', maxDownloads.value);
+            }
+
+            // Email fields only exist when the server has mail configured
+            ['notify_email', 'send_to'].forEach(name => {
+                const input = document.getElementById(name);
+                if (input && input.value.trim()) {
+                    formData.append(name, input.value.trim());
+                }
+            });
+
             updateFileStatus(index, 'uploading', 0);
 
             const xhr = new XMLHttpRequest();
@@ -167,8 +233,19 @@ document.addEventListener('DOMContentLoaded', () => {
                             state.completedUploads++;
                             elements.completedCount.textContent = state.completedUploads;
 
+                            // Files not on the index are only reachable by
+                            // their link, so show it instead of reloading.
+                            // The key of an encrypted file exists only here.
+                            if (result.url && sealed) {
+                                state.links.push({ name: file.name, url: new URL(result.url, window.location.href).href + '#' + sealed.key, e2e: true });
+                            } else if (result.url && result.visibility !== 'public') {
+                                state.links.push({ name: file.name, url: new URL(result.url, window.location.href).href });
+                            }
+
                             // Check if all uploads are completed
-                            if (state.completedUploads >= state.uploads.length) {
+                            if (state.completedUploads >= state.uploads.length && state.links.length > 0) {
+                                showLinks(state.links);
+                            } else if (state.completedUploads >= state.uploads.length) {
                                 // Small delay to show success status, then refresh
                                 setTimeout(() => {
                                     // If we're on the index page (has upload modal), reload the page
@@ -192,7 +269,18 @@ document.addEventListener('DOMContentLoaded', () => {
                             reject(new Error(result.message || '上传失败'));
                         }
                     } else {
-                        updateFileStatus(index, 'error', 0, '服务器错误: ' + xhr.status);
+                        // Error responses from /upload carry a JSON message
+                        let message = '服务器错误: ' + xhr.status;
+                        try {
+                            const result = JSON.parse(xhr.responseText);
+                            if (result.message) message = result.message;
+                        } catch (ignored) {}
+                        if (xhr.status === 507) {
+                            storageFull(index, message);
+                            reject(new Error(message));
+                            return;
+                        }
+                        updateFileStatus(index, 'error', 0, message);
                         state.completedUploads++;
                         elements.completedCount.textContent = state.completedUploads;
                         reject(new Error('Server error: ' + xhr.status));
@@ -217,6 +305,18 @@ document.addEventListener('DOMContentLoaded', () => {
         });
     }
 
+    // The server answers 507 when a quota or the disk is full; retrying
+    // the other files won't help, so say so once
+    function storageFull(index, message) {
+        message = message || '存储空间不足';
+        updateFileStatus(index, 'error', 0, message);
+        state.completedUploads++;
+        elements.completedCount.textContent = state.completedUploads;
+        if (elements.modal.style.display !== 'block') {
+            showModal('存储空间不足', message, 'error');
+        }
+    }
+
     function renderFileList(files) {
         elements.fileList.innerHTML = files.map((file, index) => `
             <div class="file-item" data-index="${index}">
@@ -246,6 +346,7 @@ document.addEventListener('DOMContentLoaded', () => {
             statusElement.className = `status ${status}`;
 
             const statusText = {
+                'encrypting': '正在加密...',
                 'uploading': '上传中...',
                 'processing': '正在保存，请勿关闭页面...',
                 'success': '上传成功',
@@ -292,6 +393,36 @@ document.addEventListener('DOMContentLoaded', () => {
 
     function closeModal() {
         elements.modal.style.display = 'none';
+        if (elements.modal.dataset.reload) {
+            window.location.reload();
+        }
+    }
+
+    // Show the links of uploaded files that are not listed on the index
+    function showLinks(links) {
+        showModal('上传成功', '', 'success');
+        elements.modalMessage.textContent = '';
+        const intro = document.createElement('p');
+        intro.textContent = links.some(link => link.e2e)
+            ? '请保存以下链接，加密文件的密钥只在链接中，丢失后无法解密：'
+            : '以下文件不会显示在首页，请保存链接：';
+        elements.modalMessage.appendChild(intro);
+        links.forEach(link => {
+            const row = document.createElement('p');
+            const a = document.createElement('a');
+            a.href = link.url;
+            a.textContent = link.name;
+            const input = document.createElement('input');
+            input.type = 'text';
+            input.readOnly = true;
+            input.value = link.url;
+            input.style.width = '100%';
+            input.addEventListener('focus', () => input.select());
+            row.appendChild(a);
+            row.appendChild(input);
+            elements.modalMessage.appendChild(row);
+        });
+        elements.modal.dataset.reload = '1';
     }
 
     function checkUrlParams() {